@@ -1,12 +1,295 @@
 package config
 
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Config is the configuration of both services, in the JSON encoding the fields of the
+// user manager are under "UserManager" and those of the disk service under "DiskService"
 type Config struct {
-	UserManagerConfig
-	DiskServiceConfig
+	UserManagerConfig `json:"UserManager"`
+	DiskServiceConfig `json:"DiskService"`
 }
 
 type UserManagerConfig struct {
+	// the chain id in the EIP-712 domain of signed requests
+	ChainId int64
+
+	IPRateLimit         RateLimitConfig
+	AddressRateLimit    RateLimitConfig
+	SecretHashRateLimit RateLimitConfig // per IP, for /getsecrethash
+
+	// the deleted files are purged from the trash after it
+	TrashRetention time.Duration
+
+	// the plans sold by /subscribe
+	Plans []Plan
+
+	Webhooks WebhookConfig
+}
+
+// WebhookConfig is how the notifications of the users are delivered to their webhooks
+type WebhookConfig struct {
+	MaxRules int // per user
+	// a failed delivery is retried after RetryDelay, doubled for each further attempt,
+	// until MaxAttempts attempts were made
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Timeout     time.Duration
+	// how often the balances are checked for the low balance and locked notifications
+	CheckInterval time.Duration
+	Concurrency   int  // how many deliveries are posted at once
+	AllowHTTP     bool // allow webhooks without TLS, for tests
+	// allow webhooks on loopback, private and link-local addresses, for tests
+	AllowPrivateAddrs bool
+}
+
+// Plan is a subscription of Blocks BCH blocks for Price points, which includes Storage
+// bytes kept in the home, versions and trash, and Transfer bytes read or written
+type Plan struct {
+	Id       string
+	Price    int64
+	Blocks   int64
+	Storage  int64
+	Transfer int64
+}
+
+func (c UserManagerConfig) FindPlan(id string) (Plan, bool) {
+	for _, plan := range c.Plans {
+		if plan.Id == id {
+			return plan, true
+		}
+	}
+	return Plan{}, false
 }
 
 type DiskServiceConfig struct {
+	IPRateLimit          RateLimitConfig
+	AddressRateLimit     RateLimitConfig
+	FailedLoginRateLimit RateLimitConfig // per IP and per address
+
+	Prices PriceTable
+
+	Backend BackendConfig
+
+	// how often the stored files are hashed again to detect corruption
+	ScrubInterval time.Duration
+
+	// the parts of a resumable upload are removed if it is not committed in time
+	UploadExpiry time.Duration
+	// the total size of the uncommitted parts of a user
+	MaxStagedSize int64
+
+	Bandwidth BandwidthConfig
+}
+
+// BandwidthConfig limits the bytes read and written per second through the disk service,
+// for all the users together and for each user by its tier
+type BandwidthConfig struct {
+	Global BandwidthLimit
+	// a user is in the last tier whose MinPoints it holds, so they are sorted by MinPoints
+	Tiers []BandwidthTier
+	// the points for a boost of 1MB/s for an hour, added to the limit of the tier
+	BoostPrice int64
+	// how long the limit of a user is used before its tier and boosts are looked up again
+	TierRefresh time.Duration
+}
+
+// BandwidthLimit allows Rate bytes per second in bursts of up to Burst bytes, a zero Rate
+// means no limit
+type BandwidthLimit struct {
+	Rate  int64
+	Burst int64
+}
+
+type BandwidthTier struct {
+	MinPoints int64
+	BandwidthLimit
+}
+
+// Limit returns the limit for a user holding the given points, with the boost in bytes
+// per second. A user holding fewer points than any tier, like one in debt, is in the
+// lowest tier.
+func (c BandwidthConfig) Limit(points, boost int64) BandwidthLimit {
+	var limit BandwidthLimit
+	if len(c.Tiers) != 0 {
+		limit = c.Tiers[0].BandwidthLimit
+	}
+	for _, tier := range c.Tiers {
+		if points >= tier.MinPoints {
+			limit = tier.BandwidthLimit
+		}
+	}
+	if limit.Rate == 0 {
+		return limit
+	}
+	limit.Rate += boost
+	limit.Burst += boost
+	return limit
+}
+
+const (
+	BackendLocal  = "local"  // the files are kept under the work directory
+	BackendS3     = "s3"     // the files are kept in an S3-compatible object store
+	BackendMemory = "memory" // the files are kept in memory and lost on restart, for tests
+)
+
+// BackendConfig selects where the files of the users are stored
+type BackendConfig struct {
+	Type  string
+	S3    S3Config
+	Dedup bool // store each distinct block of the files once, whichever files it is in
+}
+
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// RateLimitConfig allows MaxCount requests in the last NumTimeSlots time slots
+type RateLimitConfig struct {
+	SlotDuration time.Duration
+	NumTimeSlots int
+	MaxCount     uint32
+}
+
+// Operation is a method of webdav.FileSystem or webdav.File. WebDAV methods are charged
+// by the operations they are made of, e.g. a COPY is charged as the reading of the source
+// and the writing of the copy, and a MOVE as a Rename.
+type Operation string
+
+const (
+	OpMkdir     Operation = "Mkdir"
+	OpOpenFile  Operation = "OpenFile"
+	OpRemoveAll Operation = "RemoveAll"
+	OpRename    Operation = "Rename"
+	OpStat      Operation = "Stat" // both FileSystem.Stat and File.Stat
+	OpClose     Operation = "Close"
+	OpRead      Operation = "Read" // unit: a started KB of the bytes read, or sent for a GET
+	OpSeek      Operation = "Seek"
+	OpReaddir   Operation = "Readdir"   // unit: a listed entry
+	OpWrite     Operation = "Write"     // unit: a started KB
+	OpDeadProps Operation = "DeadProps" // unit: a returned dead property
+	OpPatch     Operation = "Patch"     // unit: a set or removed dead property, for PROPPATCH
+)
+
+// IsTransfer reports whether the units of op are KB transferred, which the transfer
+// included in a plan pays for
+func (op Operation) IsTransfer() bool {
+	return op == OpRead || op == OpWrite
+}
+
+// Price is PerCall points for each call of an operation, plus PerUnit points for each
+// unit it processes
+type Price struct {
+	PerCall int64
+	PerUnit int64
+}
+
+// PriceTable is the price of each operation, the missing operations are free
+type PriceTable map[Operation]Price
+
+func (t PriceTable) Cost(op Operation, units int64) int64 {
+	price := t[op]
+	return price.PerCall + price.PerUnit*units
+}
+
+func DefaultPriceTable() PriceTable {
+	return PriceTable{
+		OpMkdir:     {PerCall: 200},
+		OpOpenFile:  {},
+		OpRemoveAll: {PerCall: 100},
+		OpRename:    {PerCall: 150},
+		OpStat:      {PerCall: 30},
+		OpClose:     {},
+		OpRead:      {PerUnit: 1},
+		OpSeek:      {},
+		OpReaddir:   {PerUnit: 30},
+		OpWrite:     {PerUnit: 1},
+		OpDeadProps: {PerUnit: 1},
+		OpPatch:     {PerCall: 30, PerUnit: 10},
+	}
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		UserManagerConfig: UserManagerConfig{
+			ChainId:             10000, // smartBCH mainnet
+			IPRateLimit:         RateLimitConfig{time.Minute, 10, 1000},
+			AddressRateLimit:    RateLimitConfig{time.Minute, 10, 300},
+			SecretHashRateLimit: RateLimitConfig{time.Minute, 10, 30},
+			TrashRetention:      30 * 24 * time.Hour,
+			Plans: []Plan{
+				// about 30 days of blocks
+				{Id: "basic", Price: 5_000_000, Blocks: 4320, Storage: 10 << 30, Transfer: 50 << 30},
+				{Id: "pro", Price: 40_000_000, Blocks: 4320, Storage: 100 << 30, Transfer: 500 << 30},
+			},
+			Webhooks: WebhookConfig{
+				MaxRules:      5,
+				MaxAttempts:   10,
+				RetryDelay:    time.Minute,
+				Timeout:       10 * time.Second,
+				CheckInterval: time.Minute,
+				Concurrency:   10,
+			},
+		},
+		DiskServiceConfig: DiskServiceConfig{
+			IPRateLimit:          RateLimitConfig{time.Minute, 10, 20000},
+			AddressRateLimit:     RateLimitConfig{time.Minute, 10, 10000},
+			FailedLoginRateLimit: RateLimitConfig{time.Minute, 15, 10},
+			Prices:               DefaultPriceTable(),
+			Backend:              BackendConfig{Type: BackendLocal},
+			ScrubInterval:        24 * time.Hour,
+			UploadExpiry:         24 * time.Hour,
+			MaxStagedSize:        10 * 1024 * 1024 * 1024,
+			Bandwidth: BandwidthConfig{
+				Global: BandwidthLimit{Rate: 100 * 1024 * 1024, Burst: 100 * 1024 * 1024},
+				Tiers: []BandwidthTier{
+					{MinPoints: 0, BandwidthLimit: BandwidthLimit{Rate: 2 * 1024 * 1024, Burst: 4 * 1024 * 1024}},
+					{MinPoints: 10_000_000, BandwidthLimit: BandwidthLimit{Rate: 20 * 1024 * 1024, Burst: 40 * 1024 * 1024}},
+				},
+				BoostPrice:  1000,
+				TierRefresh: time.Minute,
+			},
+		},
+	}
+}
+
+// Load reads the configuration from the JSON file at path, over the default configuration,
+// so the file only needs the fields it changes. The durations are in nanoseconds, and a
+// price table or a list, like the plans and the tiers, replaces the default one as a
+// whole. An empty path gives the default configuration.
+func Load(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	bz, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// a price table is replaced, not merged into the default one
+	var prices struct {
+		DiskService struct{ Prices json.RawMessage }
+	}
+	err = json.Unmarshal(bz, &prices)
+	if err != nil {
+		return nil, err
+	}
+	if prices.DiskService.Prices != nil {
+		cfg.Prices = nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(bz))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
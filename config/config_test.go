@@ -0,0 +1,86 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	c := BandwidthConfig{Tiers: []BandwidthTier{
+		{MinPoints: 0, BandwidthLimit: BandwidthLimit{Rate: 2, Burst: 4}},
+		{MinPoints: 100, BandwidthLimit: BandwidthLimit{Rate: 20, Burst: 40}},
+	}}
+	cases := []struct {
+		points, boost int64
+		want          BandwidthLimit
+	}{
+		{0, 0, BandwidthLimit{2, 4}},
+		{99, 0, BandwidthLimit{2, 4}},
+		{100, 0, BandwidthLimit{20, 40}},
+		{100, 5, BandwidthLimit{25, 45}},
+		// a user in debt is limited like the lowest tier, not unlimited
+		{-1, 0, BandwidthLimit{2, 4}},
+		{-1, 5, BandwidthLimit{7, 9}},
+	}
+	for _, tc := range cases {
+		if got := c.Limit(tc.points, tc.boost); got != tc.want {
+			t.Errorf("Limit(%d, %d) = %v, want %v", tc.points, tc.boost, got, tc.want)
+		}
+	}
+	if got := (BandwidthConfig{}).Limit(-1, 5); got != (BandwidthLimit{}) {
+		t.Errorf("Limit without tiers = %v, want no limit", got)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil || cfg.Prices[OpMkdir] != DefaultPriceTable()[OpMkdir] {
+		t.Fatalf("default configuration: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(path, []byte(`{
+		"UserManager": {
+			"Plans": [{"Id": "only", "Price": 1, "Blocks": 2}],
+			"Webhooks": {"MaxRules": 7}
+		},
+		"DiskService": {
+			"IPRateLimit": {"MaxCount": 5},
+			"Prices": {"Mkdir": {"PerCall": 1}},
+			"Bandwidth": {"BoostPrice": 9, "Tiers": [{"MinPoints": 0, "Rate": 3, "Burst": 6}]}
+		}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Plans) != 1 || cfg.Plans[0].Id != "only" {
+		t.Errorf("plans: %+v", cfg.Plans)
+	}
+	// the fields missing from the file keep their default values
+	if cfg.Webhooks.MaxRules != 7 || cfg.Webhooks.MaxAttempts != DefaultConfig().Webhooks.MaxAttempts {
+		t.Errorf("webhooks: %+v", cfg.Webhooks)
+	}
+	if cfg.DiskServiceConfig.IPRateLimit.MaxCount != 5 || cfg.UserManagerConfig.IPRateLimit != DefaultConfig().UserManagerConfig.IPRateLimit {
+		t.Errorf("rate limits: %+v and %+v", cfg.DiskServiceConfig.IPRateLimit, cfg.UserManagerConfig.IPRateLimit)
+	}
+	// the price table is replaced as a whole
+	if len(cfg.Prices) != 1 || cfg.Prices.Cost(OpMkdir, 0) != 1 {
+		t.Errorf("prices: %+v", cfg.Prices)
+	}
+	if cfg.Bandwidth.BoostPrice != 9 || len(cfg.Bandwidth.Tiers) != 1 || cfg.Bandwidth.Limit(0, 0) != (BandwidthLimit{3, 6}) {
+		t.Errorf("bandwidth: %+v", cfg.Bandwidth)
+	}
+
+	err = os.WriteFile(path, []byte(`{"DiskService": {"Price": {}}}`), 0600)
+	if err == nil {
+		_, err = Load(path)
+	}
+	if err == nil {
+		t.Error("loaded an unknown field")
+	}
+}
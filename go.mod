@@ -11,6 +11,7 @@ require (
 	github.com/gcash/bchutil v0.0.0-20210113190856-6ea28dff4000
 	github.com/smartbch/stochastic-pay/sdk v0.0.0-20230507083213-a4a98dd93670
 	github.com/tyler-smith/go-bip32 v1.0.0
+	golang.org/x/crypto v0.8.0
 	golang.org/x/net v0.9.0
 )
 
@@ -37,7 +38,6 @@ require (
 	github.com/klauspost/compress v1.15.15 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	go.opencensus.io v0.22.6 // indirect
-	golang.org/x/crypto v0.8.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
 )
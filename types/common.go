@@ -1,5 +1,7 @@
 package types
 
+import "github.com/ethereum/go-ethereum/common"
+
 type GetSecretHashRes struct {
 	Hash          []byte `json:"hash"`
 	UniqTimestamp int64  `json:"uniqTimestamp"`
@@ -15,13 +17,12 @@ type BuyPointsParam struct {
 	Expiration    int64    `json:"expiration"`
 	Probability   int64    `json:"probability"`
 	FriendAddress [20]byte `json:"friendAddress"`
-	Sig           []byte   `json:"signature"`
 }
 
+// the params of the user manager are sent as the Params of SignedRequest
 type ViewHistoryParam struct {
-	BeginTimestamp int64  `json:"beginTimestamp"`
-	EndTimestamp   int64  `json:"endTimestamp"`
-	Sig            []byte `json:"signature"`
+	BeginTimestamp int64 `json:"beginTimestamp"`
+	EndTimestamp   int64 `json:"endTimestamp"`
 }
 
 type OperationRecord struct {
@@ -36,7 +37,6 @@ type ViewHistoryRes struct {
 
 type SetPasswordHashParam struct {
 	NewPasswordHash [32]byte `json:"newPasswordHash"`
-	Sig             []byte   `json:"signature"`
 }
 
 type ShareDirParam struct {
@@ -44,5 +44,253 @@ type ShareDirParam struct {
 	PasswordHash [32]byte `json:"passwordHash"`
 	Dir          string   `json:"dir"`
 	ExpiredTime  int64    `json:"expiredTime"`
-	Sig          []byte   `json:"signature"`
+	Permissions  byte     `json:"permissions"` // bitwise OR of the Perm* constants, zero means PermRead
+	Payer        byte     `json:"payer"`       // one of the Payer* constants
+}
+
+type ListSharesParam struct {
+}
+
+type ShareInfo struct {
+	Owner       common.Address `json:"owner"`
+	Friend      common.Address `json:"friend"`
+	Dir         string         `json:"dir"`
+	ExpiredTime int64          `json:"expiredTime"`
+	Permissions byte           `json:"permissions"`
+	Payer       byte           `json:"payer"`
+}
+
+type ListSharesRes struct {
+	Outgoing []ShareInfo `json:"outgoing"`
+	Incoming []ShareInfo `json:"incoming"`
+}
+
+type RevokeShareParam struct {
+	Friend [20]byte `json:"friend"`
+	Dir    string   `json:"dir"`
+}
+
+type CreateShareLinkParam struct {
+	Path         string   `json:"path"`
+	ExpiredTime  int64    `json:"expiredTime"`
+	PasswordHash [32]byte `json:"passwordHash"` // all zero for a link without password
+	MaxDownloads int64    `json:"maxDownloads"` // zero for unlimited downloads
+}
+
+type CreateShareLinkRes struct {
+	Token string `json:"token"`
+	Url   string `json:"url"` // relative to the disk service
+}
+
+type RevokeShareLinkParam struct {
+	Token string `json:"token"`
+}
+
+type GetLoginNonceRes struct {
+	Nonce   string `json:"nonce"`
+	Message string `json:"message"` // to be signed with EIP-191 personal_sign
+}
+
+type LoginParam struct {
+	Address common.Address `json:"address"`
+	Nonce   string         `json:"nonce"`
+	Sig     []byte         `json:"signature"`
+}
+
+type LoginRes struct {
+	Token       string `json:"token"`
+	ExpiredTime int64  `json:"expiredTime"`
+}
+
+type CreateAppPasswordParam struct {
+	Label    string `json:"label"`
+	ReadOnly bool   `json:"readOnly"`
+	Scope    string `json:"scope"` // a directory under /home, empty for all
+}
+
+type CreateAppPasswordRes struct {
+	Label    string `json:"label"`
+	Password string `json:"password"` // only returned once
+}
+
+type ListAppPasswordsParam struct {
+}
+
+type AppPasswordInfo struct {
+	Label        string `json:"label"`
+	CreatedTime  int64  `json:"createdTime"`
+	LastUsedTime int64  `json:"lastUsedTime"`
+	ReadOnly     bool   `json:"readOnly"`
+	Scope        string `json:"scope"` // the app can only access this directory under /home if it is not empty
+}
+
+type ListAppPasswordsRes struct {
+	Passwords []AppPasswordInfo `json:"passwords"`
+}
+
+type RevokeAppPasswordParam struct {
+	Label string `json:"label"`
+}
+
+type SetVersioningParam struct {
+	Dir         string `json:"dir"`
+	MaxVersions int64  `json:"maxVersions"` // zero disables versioning of dir
+}
+
+type ListVersionsParam struct {
+	Path string `json:"path"` // empty for the versions of all the files
+}
+
+type FileVersionInfo struct {
+	Path      string `json:"path"`
+	VersionId int64  `json:"versionId"` // the unix nano time when this version was replaced
+	Size      int64  `json:"size"`
+}
+
+type ListVersionsRes struct {
+	Versions []FileVersionInfo `json:"versions"`
+}
+
+type RestoreVersionParam struct {
+	Path      string `json:"path"`
+	VersionId int64  `json:"versionId"`
+}
+
+type TrashEntryInfo struct {
+	DeletedTime int64  `json:"deletedTime"` // unix nano, also the id of the entry in the trash
+	Path        string `json:"path"`        // the original path under /home
+	Size        int64  `json:"size"`
+	IsDir       bool   `json:"isDir"`
+}
+
+type ListTrashParam struct {
+}
+
+type ListTrashRes struct {
+	Entries []TrashEntryInfo `json:"entries"`
+}
+
+type RestoreTrashParam struct {
+	DeletedTime int64 `json:"deletedTime"`
+}
+
+type PurgeTrashParam struct {
+	DeletedTime int64 `json:"deletedTime"` // zero to empty the whole trash
+}
+
+type BoostBandwidthParam struct {
+	Rate  int64 `json:"rate"` // the bytes per second added, charged by the started MB/s
+	Hours int64 `json:"hours"`
+}
+
+type BoostBandwidthRes struct {
+	Cost       int64 `json:"cost"`
+	ExpireTime int64 `json:"expireTime"` // unix nano
+}
+
+type PlanInfo struct {
+	Id       string `json:"id"`
+	Price    int64  `json:"price"`    // points
+	Blocks   int64  `json:"blocks"`   // how long a subscription lasts
+	Storage  int64  `json:"storage"`  // the bytes stored for free
+	Transfer int64  `json:"transfer"` // the bytes read or written for free
+}
+
+type ListPlansRes struct {
+	Plans []PlanInfo `json:"plans"`
+}
+
+type SubscribeParam struct {
+	Plan      string `json:"plan"`
+	AutoRenew bool   `json:"autoRenew"` // renew from the points when it expires
+}
+
+type GetSubscriptionParam struct {
+}
+
+type CancelSubscriptionParam struct {
+}
+
+type SubscriptionRes struct {
+	Plan             string `json:"plan"`
+	StartHeight      int64  `json:"startHeight"`
+	EndHeight        int64  `json:"endHeight"` // the first block it no longer covers
+	Storage          int64  `json:"storage"`
+	Transfer         int64  `json:"transfer"`
+	RemainedTransfer int64  `json:"remainedTransfer"` // bytes
+	AutoRenew        bool   `json:"autoRenew"`
+	Active           bool   `json:"active"`
+}
+
+type SetNotificationParam struct {
+	Url       string `json:"url"`       // an https url, which identifies the rule
+	Events    byte   `json:"events"`    // bitwise OR of the Notify* constants
+	Threshold int64  `json:"threshold"` // the balance in points below which NotifyLowBalance is sent
+}
+
+type NotificationRule struct {
+	Url       string `json:"url"`
+	Events    byte   `json:"events"`
+	Threshold int64  `json:"threshold"`
+	Secret    string `json:"secret"` // hex, the key of the HMAC-SHA256 signatures of the payloads
+}
+
+type ListNotificationsParam struct {
+}
+
+type ListNotificationsRes struct {
+	Rules []NotificationRule `json:"rules"`
+}
+
+type DeleteNotificationParam struct {
+	Url string `json:"url"`
+}
+
+// NotificationPayload is posted to the webhooks, with its HMAC-SHA256 in the hex
+// X-Cashdisk-Signature header
+type NotificationPayload struct {
+	Id        int64          `json:"id"` // the same in the retries of a delivery
+	Event     string         `json:"event"`
+	Address   common.Address `json:"address"`
+	Timestamp int64          `json:"timestamp"` // unix nano
+	Balance   int64          `json:"balance"`
+	Amount    int64          `json:"amount,omitempty"` // the points added, for paymentConfirmed
+	Txid      string         `json:"txid,omitempty"`
+	Owner     string         `json:"owner,omitempty"` // who shared Dir, for shareReceived
+	Dir       string         `json:"dir,omitempty"`
+	From      string         `json:"from,omitempty"` // who transferred Amount, for pointsReceived
+	Transfer  string         `json:"transfer,omitempty"`
+}
+
+type AccountParam struct {
+}
+
+// UnlockPayment is what a locked user must pay to be unlocked, either with a normal
+// payment of at least MinAmount satoshis, or with a stochastic payment of Amount
+// satoshis and Probability
+type UnlockPayment struct {
+	MinAmount   int64 `json:"minAmount"`
+	Amount      int64 `json:"amount"`
+	Probability int64 `json:"probability"`
+}
+
+type AccountRes struct {
+	Address        common.Address `json:"address"`
+	Balance        int64          `json:"balance"`
+	Locked         bool           `json:"locked"`
+	PendingCredits int64          `json:"pendingCredits"` // the points of the payments waiting for confirmations
+	StorageUsage   int64          `json:"storageUsage"`   // bytes in the home, the versions and the trash, as of the last storage scan
+	SharesFrom     int            `json:"sharesFrom"`     // the active shares to friends
+	SharesTo       int            `json:"sharesTo"`       // the active shares from friends
+	Unlock         *UnlockPayment `json:"unlock,omitempty"`
+}
+
+type TransferPointsParam struct {
+	To     [20]byte `json:"to"` // a registered user
+	Amount int64    `json:"amount"`
+}
+
+type TransferPointsRes struct {
+	Transfer  string `json:"transfer"`  // the hex id of the transfer, recorded in the history of both users
+	Timestamp int64  `json:"timestamp"` // of the records in the history
 }
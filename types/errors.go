@@ -3,5 +3,7 @@ package types
 import "errors"
 
 var (
-	ErrReadOnly = errors.New("the shared directory is readonly")
+	ErrReadOnly     = errors.New("the shared directory is readonly")
+	ErrNoPermission = errors.New("the shared directory does not permit this operation")
+	ErrBadSharedDir = errors.New("the shared directory entry is malformed")
 )
@@ -1,9 +1,12 @@
 package types
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/OneOfOne/xxhash"
@@ -16,15 +19,31 @@ import (
 const (
 	RemainedPoints = byte(100) // key: RemainedPoints + uid, value: 8-byte int64
 	DeductPoints   = byte(102) // key: DeductPoints + uid + timestamp, value: 8-byte int64 + operation
-	AddPoints      = byte(104) // key: AddPoints + uid + 0x01(finalized tx) or 0x02(pending tx) or 0x04(dead tx) + timestamp, value: 8-byte int64 + 32-byte txid
-	PasswordHash   = byte(106) // key: PasswordHash + 20-byte address, value: 32-byte passwd hash
-	SharedDir      = byte(108) // key: SharedDir + from-uid + to-uid + sha256(dir), value: 8-byte expiretime + dir
+	AddPoints      = byte(104) // key: AddPoints + uid + 0x01(finalized tx) or 0x02(pending tx) or 0x04(dead tx) + timestamp, value: 8-byte int64 + 32-byte txid, or transfer id for the transfers between users
+	PasswordHash   = byte(106) // key: PasswordHash + 20-byte address, value: passwd hash encoded by utils.HashPassword
+	SharedDir      = byte(108) // key: SharedDir + from-uid + to-uid + sha256(dir), value: 8-byte expiretime + 1-byte permissions + 1-byte payer + dir
 	UserToId       = byte(110) // key: UserToId + 20-byte address, value: 8-byte uid
 	IdToUser       = byte(112) // key: IdToUser + uid, value: 20-byte address
+	SharedDirTo    = byte(114) // key: SharedDirTo + to-uid + from-uid + sha256(dir), value: same as SharedDir
+	ShareLink      = byte(116) // key: ShareLink + sha256(token), value: 8-byte uid + 8-byte expiretime + 8-byte remained downloads + 1-byte len(passwd hash) + passwd hash encoded by utils.HashPassword + path
+	AppPassword    = byte(118) // key: AppPassword + 20-byte address + sha256(passwd), value: 8-byte created time + 8-byte last used time + 1-byte readonly + 1-byte len(label) + label + scope
+	UsedNonce      = byte(120) // key: UsedNonce + 20-byte address + 8-byte nonce, value: empty, expires together with the signed request
+	VersionedDir   = byte(122) // key: VersionedDir + uid + sha256(dir), value: 8-byte max versions + dir
+	FileVersion    = byte(124) // key: FileVersion + uid + sha256(path) + 8-byte version id (timestamp), value: 8-byte size + path
+	TrashEntry     = byte(126) // key: TrashEntry + uid + 8-byte deleted time, value: 8-byte size + 1-byte isDir + original path
+	DeadProps      = byte(128) // key: DeadProps + uid + sha256(path), value: the encoded dead properties
+	DataKey        = byte(130) // key: DataKey + 20-byte address, value: 8-byte creation time + the data key wrapped by the master key
+	BlockRef       = byte(132) // key: BlockRef + 32-byte block hash, value: 8-byte reference count + 8-byte size
+	FileChecksum   = byte(134) // key: FileChecksum + uid + path, value: 32-byte sha256 of the content
+	BandwidthBoost = byte(136) // key: BandwidthBoost + uid + 8-byte expire time, value: 8-byte bytes per second
+	Subscription   = byte(138) // key: Subscription + uid, value: 8-byte start height + 8-byte end height + 8-byte included storage + 8-byte included transfer + 8-byte used transfer in KB + 1-byte auto renew + plan id
+	ChainHeight    = byte(140) // key: ChainHeight, value: 8-byte height of the latest BCH block seen
+	WebhookRule    = byte(142) // key: WebhookRule + uid + sha256(url), value: 8-byte low balance threshold + 1-byte events + 1-byte fired events + 32-byte secret + url
+	WebhookQueue   = byte(144) // key: WebhookQueue + 8-byte next attempt time + 8-byte id, value: 8-byte uid + 4-byte attempts + 2-byte len(url) + url + payload
+	SchemaVersion  = byte(146) // key: SchemaVersion, value: 8-byte number of the migrations applied to the database
+	StorageUsage   = byte(148) // key: StorageUsage + uid, value: 8-byte bytes of the files found by the last storage scan
+	UploadStart    = byte(150) // key: UploadStart + 20-byte address + upload id, value: 8-byte time the upload was started, expires after the upload is purged
 
-	PointsPerFileInfo         = int64(30)
-	PointsOfMkdir             = int64(200)
-	PointsOfRename            = int64(150)
 	PointsOfUserManagerAccess = int64(10)
 	PointsForStorage          = int64(1000)
 
@@ -33,13 +52,34 @@ const (
 	TxFinalized byte = 0x01
 	TxPending   byte = 0x02
 	TxDead      byte = 0x04
+
+	// permissions granted to a friend on a shared directory
+	PermRead   byte = 0x01
+	PermWrite  byte = 0x02 // modify the content of existing files
+	PermCreate byte = 0x04 // create new files and directories
+	PermDelete byte = 0x08
+	PermRename byte = 0x10
+	PermModify      = PermWrite | PermCreate | PermDelete | PermRename
+	PermAll         = PermRead | PermModify
+
+	// who pays for the reads of a friend in a shared directory
+	PayerOwner  byte = 0x00
+	PayerReader byte = 0x01
+	PayerSplit  byte = 0x02 // the owner and the reader pay half each
+
+	// the events a webhook is notified of
+	NotifyLowBalance       byte = 0x01 // the balance falls below the threshold of the rule
+	NotifyLocked           byte = 0x02 // the account is locked for a negative balance
+	NotifyPaymentConfirmed byte = 0x04
+	NotifyShareReceived    byte = 0x08 // a friend shares a directory with the user
+	NotifyPointsReceived   byte = 0x10 // another user transfers points to the user
+	NotifyAll                   = NotifyLowBalance | NotifyLocked | NotifyPaymentConfirmed | NotifyShareReceived | NotifyPointsReceived
 )
 
 func AddressToUID(db *badger.DB, addr common.Address) int64 {
 	h := xxhash.New64()
 	h.Write(addr.Bytes())
-	h.Reset()
-	uid := int64(h.Sum64())
+	uid := int64(h.Sum64() >> 1) // negative uid means "not found" in GetUID
 	for {
 		_, err := GetAddressByUID(db, uid)
 		if err != nil {
@@ -67,7 +107,7 @@ func AddNewUser(db *badger.DB, address common.Address, uid int64, passwordHash [
 			return err
 		}
 		key = append([]byte{PasswordHash}, address.Bytes()...)
-		return txn.Set(key, passwordHash[:])
+		return txn.Set(key, utils.HashPassword(passwordHash))
 	})
 }
 
@@ -106,6 +146,10 @@ func GetUID(db *badger.DB, addr common.Address) (uid int64) {
 	return
 }
 
+// UpdatePoints adds changeAmount to the balance of uid. Unlike ConsumePoints, it does not
+// log the change and refuses to deduct more points than the balance has. The balance may
+// stay negative when points are added to it. The transaction is retried on conflicts
+// with concurrent charges.
 func UpdatePoints(db *badger.DB, uid int64, changeAmount int64) error {
 	key := append([]byte{RemainedPoints}, utils.Int64ToBytes(uid)...)
 	update := func(txn *badger.Txn) error {
@@ -114,13 +158,21 @@ func UpdatePoints(db *badger.DB, uid int64, changeAmount int64) error {
 			return err
 		}
 		balB, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
 		balance := utils.BytesToInt64(balB) + changeAmount
-		if balance < 0 {
+		if changeAmount < 0 && balance < 0 {
 			return errors.New("balance not enough")
 		}
 		return txn.Set(key, utils.Int64ToBytes(balance))
 	}
-	return db.Update(update)
+	for {
+		err := db.Update(update)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
 }
 
 func IsUserLock(db *badger.DB, uid int64) (bool, int64, error) {
@@ -152,46 +204,307 @@ func UpdateUserPasswordHash(db *badger.DB, addr common.Address, passwordHash [32
 		if err != nil {
 			return err
 		}
-		return txn.Set(key, passwordHash[:])
+		return txn.Set(key, utils.HashPassword(passwordHash))
+	}
+	return db.Update(update)
+}
+
+func GetPasswordHash(db *badger.DB, addr common.Address) (res []byte, err error) {
+	key := append([]byte{PasswordHash}, addr[:]...)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		res, err = item.ValueCopy(nil)
+		return err
+	})
+	return
+}
+
+// UpgradePasswordHash re-encodes a stored password hash, unless it has been changed since
+// it was read as oldHash
+func UpgradePasswordHash(db *badger.DB, addr common.Address, oldHash []byte, passwordHash [32]byte) error {
+	key := append([]byte{PasswordHash}, addr[:]...)
+	newHash := utils.HashPassword(passwordHash)
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		current, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, oldHash) {
+			return nil
+		}
+		return txn.Set(key, newHash)
 	}
 	return db.Update(update)
 }
 
-func UpdateSharedDir(db *badger.DB, fromUid, toUid int64, dir string, expiredTime int64) error {
+func sharedDirKey(prefix byte, uidA, uidB int64, dir string) []byte {
 	key := make([]byte, 1+8+8+32)
-	key[0] = SharedDir
-	binary.BigEndian.PutUint64(key[1:9], uint64(fromUid))
-	binary.BigEndian.PutUint64(key[9:17], uint64(toUid))
+	key[0] = prefix
+	binary.BigEndian.PutUint64(key[1:9], uint64(uidA))
+	binary.BigEndian.PutUint64(key[9:17], uint64(uidB))
 	dirHash := sha256.Sum256([]byte(dir))
 	copy(key[17:], dirHash[:])
+	return key
+}
+
+// CleanPath converts p into the form used in the keys of shares and other per-path
+// settings: a cleaned slash-separated path without leading and trailing slashes, "" for
+// the root
+func CleanPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// walkUpDirs calls try with p and then with each of its ancestors, until try returns true
+func walkUpDirs(p string, try func(dir string) bool) {
+	dir := CleanPath(p)
+	for !try(dir) && dir != "" {
+		dir = path.Dir(dir)
+		if dir == "." {
+			dir = ""
+		}
+	}
+}
+
+// the SharedDir entry is indexed by the owner and the SharedDirTo entry by the friend,
+// both expire together with the share itself
+func UpdateSharedDir(db *badger.DB, fromUid, toUid int64, dir string, expiredTime int64, perm, payer byte) error {
+	value := append(utils.Int64ToBytes(expiredTime), perm, payer)
+	value = append(value, dir...)
+	update := func(txn *badger.Txn) error {
+		for _, key := range [][]byte{
+			sharedDirKey(SharedDir, fromUid, toUid, dir),
+			sharedDirKey(SharedDirTo, toUid, fromUid, dir),
+		} {
+			e := badger.NewEntry(key, value)
+			if expiredTime > 0 {
+				e.ExpiresAt = uint64(time.Unix(0, expiredTime).Add(time.Second).Unix())
+			}
+			err := txn.SetEntry(e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return db.Update(update)
+}
+
+func DeleteSharedDir(db *badger.DB, fromUid, toUid int64, dir string) error {
+	key := sharedDirKey(SharedDir, fromUid, toUid, dir)
 	update := func(txn *badger.Txn) error {
-		return txn.Set(key, append(utils.Int64ToBytes(expiredTime), dir...))
+		_, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(key)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(sharedDirKey(SharedDirTo, toUid, fromUid, dir))
 	}
 	return db.Update(update)
 }
 
-func ConsumePoints(db *badger.DB, uid, points int64, operation string) error {
-	key := append([]byte{RemainedPoints}, utils.Int64ToBytes(uid)...)
-	m := db.GetMergeOperator(key, utils.AddFunc, 200*time.Millisecond)
-	defer m.Stop()
+type SharedDirInfo struct {
+	FromUid     int64
+	ToUid       int64
+	Dir         string
+	ExpiredTime int64
+	Permissions byte
+	Payer       byte
+}
+
+func parseSharedDir(k, v []byte) (SharedDirInfo, error) {
+	if len(k) != 1+8+8+32 || len(v) < 10 {
+		return SharedDirInfo{}, ErrBadSharedDir
+	}
+	info := SharedDirInfo{
+		FromUid:     utils.BytesToInt64(k[1:9]),
+		ToUid:       utils.BytesToInt64(k[9:17]),
+		ExpiredTime: utils.BytesToInt64(v[:8]),
+		Permissions: v[8],
+		Payer:       v[9],
+		Dir:         string(v[10:]),
+	}
+	if k[0] == SharedDirTo {
+		info.FromUid, info.ToUid = info.ToUid, info.FromUid
+	}
+	return info, nil
+}
+
+// GetSharedDir returns the share of dir from fromUid to toUid, or badger.ErrKeyNotFound
+// if there is no such share or it has expired
+func GetSharedDir(db *badger.DB, fromUid, toUid int64, dir string) (info SharedDirInfo, err error) {
+	key := sharedDirKey(SharedDir, fromUid, toUid, dir)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info, err = parseSharedDir(key, val)
+			return err
+		})
+	})
+	if err == nil && info.ExpiredTime < time.Now().UnixNano() {
+		err = badger.ErrKeyNotFound
+	}
+	return
+}
+
+// FindSharedDir looks for the share from fromUid to toUid which covers p, i.e. the share
+// of p itself or of its nearest ancestor directory
+func FindSharedDir(db *badger.DB, fromUid, toUid int64, p string) (info SharedDirInfo, err error) {
+	walkUpDirs(p, func(dir string) bool {
+		info, err = GetSharedDir(db, fromUid, toUid, dir)
+		return !errors.Is(err, badger.ErrKeyNotFound)
+	})
+	return
+}
+
+// GetSharedDirsFrom returns the unexpired directories shared by uid
+func GetSharedDirsFrom(db *badger.DB, uid int64) ([]SharedDirInfo, error) {
+	return getSharedDirs(db, SharedDir, uid, time.Now().UnixNano())
+}
+
+// GetSharedDirsTo returns the unexpired directories shared with uid
+func GetSharedDirsTo(db *badger.DB, uid int64) ([]SharedDirInfo, error) {
+	return getSharedDirs(db, SharedDirTo, uid, time.Now().UnixNano())
+}
+
+func getSharedDirs(db *badger.DB, prefixByte byte, uid int64, now int64) ([]SharedDirInfo, error) {
+	var infos []SharedDirInfo
+	getter := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := append([]byte{prefixByte}, utils.Int64ToBytes(uid)...)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			err := item.Value(func(v []byte) error {
+				info, err := parseSharedDir(k, v)
+				if err == nil && info.ExpiredTime >= now {
+					infos = append(infos, info)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.View(getter)
+	return infos, err
+}
 
-	m.Add(utils.Int64ToBytes(-points))
+// DeleteExpiredSharedDirs removes the shares which expired before now, including
+// the ones written before expiring entries were supported
+func DeleteExpiredSharedDirs(db *badger.DB, now int64) (int, error) {
+	var expired []SharedDirInfo
+	getter := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte{SharedDir}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			err := item.Value(func(v []byte) error {
+				info, err := parseSharedDir(k, v)
+				if err == nil && info.ExpiredTime < now {
+					expired = append(expired, info)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.View(getter)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range expired {
+		err = DeleteSharedDir(db, info.FromUid, info.ToUid, info.Dir)
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
 
-	res, err := m.Get()
+func ConsumePoints(db *badger.DB, uid, points int64, operation string) error {
+	balance, err := changePoints(db, uid, -points, operation)
 	if err != nil {
 		return err
 	}
-	if utils.BytesToInt64(res) < 0 {
+	if balance < 0 {
 		return errors.New("Not enough points after operation: " + operation)
 	}
+	return nil
+}
 
-	key = append([]byte{DeductPoints}, utils.Int64ToBytes(uid)...)
-	key = append(key, utils.Int64ToBytes(utils.GetTimestamp())...)
-	value := append(utils.Int64ToBytes(uid), operation...)
-	return db.Update(func(txn *badger.Txn) error {
-		e := badger.NewEntry(key, value).WithTTL(ConsumeLogDuration)
-		return txn.SetEntry(e)
+// RefundPoints gives back the points consumed by an operation which could not be
+// carried out because another payer of it failed to pay
+func RefundPoints(db *badger.DB, uid, points int64, operation string) error {
+	_, err := changePoints(db, uid, points, "refund: "+operation)
+	return err
+}
+
+// changePoints adds delta to the balance of uid, which may become negative, and logs the
+// operation. The balance is changed in a transaction which is retried on conflicts, so
+// that concurrent changes are never lost.
+func changePoints(db *badger.DB, uid, delta int64, operation string) (balance int64, err error) {
+	for {
+		err = db.Update(func(txn *badger.Txn) error {
+			balance, err = getBalance(txn, uid)
+			if err != nil {
+				return err
+			}
+			balance += delta
+			return setBalance(txn, uid, balance, operation)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return
+		}
+	}
+}
+
+// getBalance returns the points of uid, zero if it has none
+func getBalance(txn *badger.Txn, uid int64) (balance int64, err error) {
+	item, err := txn.Get(append([]byte{RemainedPoints}, utils.Int64ToBytes(uid)...))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = item.Value(func(v []byte) error {
+		balance = utils.BytesToInt64(v)
+		return nil
 	})
+	return
+}
+
+// setBalance sets the points of uid, and logs the operation changing them
+func setBalance(txn *badger.Txn, uid, balance int64, operation string) error {
+	err := txn.Set(append([]byte{RemainedPoints}, utils.Int64ToBytes(uid)...), utils.Int64ToBytes(balance))
+	if err != nil {
+		return err
+	}
+	logKey := append([]byte{DeductPoints}, utils.Int64ToBytes(uid)...)
+	logKey = append(logKey, utils.Int64ToBytes(utils.GetTimestamp())...)
+	value := append(utils.Int64ToBytes(uid), operation...)
+	return txn.SetEntry(badger.NewEntry(logKey, value).WithTTL(ConsumeLogDuration))
 }
 
 type PendingPaymentInfo struct {
@@ -201,6 +514,64 @@ type PendingPaymentInfo struct {
 	Value     int64
 }
 
+var (
+	ErrNotEnoughPoints = errors.New("not enough points")
+	ErrStillLocked     = errors.New("the receiver would still be locked after the transfer")
+)
+
+// TransferPoints moves amount points from fromUid to toUid in a single transaction, and
+// records it as finalized AddPoints of -amount and amount with the transfer id in place
+// of the txid. Transfers cannot use credit, so the balance of fromUid must stay
+// non-negative, and like a payment, a transfer to a locked user must make its balance
+// positive.
+func TransferPoints(db *badger.DB, fromUid, toUid, amount int64, id [32]byte) (timestamp int64, err error) {
+	fromKey := append([]byte{RemainedPoints}, utils.Int64ToBytes(fromUid)...)
+	toKey := append([]byte{RemainedPoints}, utils.Int64ToBytes(toUid)...)
+	update := func(txn *badger.Txn) error {
+		fromBalance, err := getBalance(txn, fromUid)
+		if err != nil {
+			return err
+		}
+		// the friends added by a share have no points until they pay or receive some
+		toBalance, err := getBalance(txn, toUid)
+		if err != nil {
+			return err
+		}
+		if fromBalance < amount {
+			return ErrNotEnoughPoints
+		}
+		if toBalance <= -1_000_000 && toBalance+amount <= 0 {
+			return ErrStillLocked
+		}
+		for _, change := range []struct {
+			uid, balance, amount int64
+			key                  []byte
+		}{
+			{fromUid, fromBalance - amount, -amount, fromKey},
+			{toUid, toBalance + amount, amount, toKey},
+		} {
+			err = txn.Set(change.key, utils.Int64ToBytes(change.balance))
+			if err != nil {
+				return err
+			}
+			key := append([]byte{AddPoints}, utils.Int64ToBytes(change.uid)...)
+			key = append(append(key, TxFinalized), utils.Int64ToBytes(timestamp)...)
+			err = txn.Set(key, append(utils.Int64ToBytes(change.amount), id[:]...))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		timestamp = utils.GetTimestamp()
+		err = db.Update(update)
+		if !errors.Is(err, badger.ErrConflict) {
+			return
+		}
+	}
+}
+
 func GetAllPendingTxInfo(db *badger.DB) []*PendingPaymentInfo {
 	var infos []*PendingPaymentInfo
 	getter := func(txn *badger.Txn) error {
@@ -208,7 +579,7 @@ func GetAllPendingTxInfo(db *badger.DB) []*PendingPaymentInfo {
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		prefix := append([]byte{AddPoints})
+		prefix := []byte{AddPoints}
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			k := item.Key()
@@ -267,22 +638,1342 @@ func UpdateAddPointRecord(db *badger.DB, uid, timestamp int64, txStatus byte, tx
 	return db.Update(update)
 }
 
+// GetDirShareInfos counts the unexpired shares of each owner
 func GetDirShareInfos(db *badger.DB) (map[int64]int64, error) {
 	var infos = map[int64]int64{}
+	now := time.Now().UnixNano()
 	getter := func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
-		prefix := append([]byte{SharedDir})
+		prefix := []byte{SharedDir}
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			k := item.Key()
-			uid := utils.BytesToInt64(k[1:9])
-			infos[uid] = infos[uid] + 1
+			err := item.Value(func(v []byte) error {
+				if utils.BytesToInt64(v[:8]) >= now {
+					uid := utils.BytesToInt64(k[1:9])
+					infos[uid] = infos[uid] + 1
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	}
 	err := db.View(getter)
 	return infos, err
 }
+
+type ShareLinkInfo struct {
+	Uid               int64
+	ExpiredTime       int64
+	RemainedDownloads int64  // negative for unlimited
+	PasswordHash      []byte // empty for a link without password
+	Path              string
+}
+
+var ErrNoMoreDownloads = errors.New("the download limit of the share link is reached")
+
+func shareLinkKey(token string) []byte {
+	tokenHash := sha256.Sum256([]byte(token))
+	return append([]byte{ShareLink}, tokenHash[:]...)
+}
+
+func encodeShareLink(info ShareLinkInfo) []byte {
+	value := make([]byte, 0, 8+8+8+1+len(info.PasswordHash)+len(info.Path))
+	value = append(value, utils.Int64ToBytes(info.Uid)...)
+	value = append(value, utils.Int64ToBytes(info.ExpiredTime)...)
+	value = append(value, utils.Int64ToBytes(info.RemainedDownloads)...)
+	value = append(value, byte(len(info.PasswordHash)))
+	value = append(value, info.PasswordHash...)
+	return append(value, info.Path...)
+}
+
+func decodeShareLink(v []byte) (info ShareLinkInfo) {
+	info.Uid = utils.BytesToInt64(v[:8])
+	info.ExpiredTime = utils.BytesToInt64(v[8:16])
+	info.RemainedDownloads = utils.BytesToInt64(v[16:24])
+	end := 25 + int(v[24])
+	info.PasswordHash = append([]byte{}, v[25:end]...)
+	info.Path = string(v[end:])
+	return
+}
+
+// only the hash of token is stored, so the links cannot be recovered from the database
+func AddShareLink(db *badger.DB, token string, info ShareLinkInfo) error {
+	update := func(txn *badger.Txn) error {
+		e := badger.NewEntry(shareLinkKey(token), encodeShareLink(info))
+		e.ExpiresAt = uint64(time.Unix(0, info.ExpiredTime).Add(time.Second).Unix())
+		return txn.SetEntry(e)
+	}
+	return db.Update(update)
+}
+
+func GetShareLink(db *badger.DB, token string) (info ShareLinkInfo, err error) {
+	key := shareLinkKey(token)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info = decodeShareLink(val)
+			return nil
+		})
+	})
+	if err == nil && info.ExpiredTime < time.Now().UnixNano() {
+		err = badger.ErrKeyNotFound
+	}
+	return
+}
+
+// UseShareLink counts one download against the limit of the share link
+func UseShareLink(db *badger.DB, token string) error {
+	key := shareLinkKey(token)
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info := decodeShareLink(val)
+		if info.RemainedDownloads < 0 {
+			return nil
+		}
+		if info.RemainedDownloads == 0 {
+			return ErrNoMoreDownloads
+		}
+		info.RemainedDownloads--
+		e := badger.NewEntry(key, encodeShareLink(info))
+		e.ExpiresAt = item.ExpiresAt()
+		return txn.SetEntry(e)
+	}
+	for {
+		err := db.Update(update)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// ReleaseShareLink gives back the download counted by UseShareLink for a download which
+// failed
+func ReleaseShareLink(db *badger.DB, token string) error {
+	key := shareLinkKey(token)
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info := decodeShareLink(val)
+		if info.RemainedDownloads < 0 {
+			return nil
+		}
+		info.RemainedDownloads++
+		e := badger.NewEntry(key, encodeShareLink(info))
+		e.ExpiresAt = item.ExpiresAt()
+		return txn.SetEntry(e)
+	}
+	for {
+		err := db.Update(update)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func DeleteShareLink(db *badger.DB, token string, uid int64) error {
+	key := shareLinkKey(token)
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if decodeShareLink(val).Uid != uid {
+			return badger.ErrKeyNotFound
+		}
+		return txn.Delete(key)
+	}
+	return db.Update(update)
+}
+
+// App passwords are generated by the server with enough entropy, so they are indexed
+// by their plain sha256 hashes instead of going through the slow password hash.
+
+var ErrAppPasswordExists = errors.New("an app password with the same label already exists")
+
+func appPasswordKey(addr common.Address, passwordHash [32]byte) []byte {
+	return append(append([]byte{AppPassword}, addr[:]...), passwordHash[:]...)
+}
+
+func encodeAppPassword(info AppPasswordInfo) []byte {
+	value := make([]byte, 0, 8+8+1+1+len(info.Label)+len(info.Scope))
+	value = append(value, utils.Int64ToBytes(info.CreatedTime)...)
+	value = append(value, utils.Int64ToBytes(info.LastUsedTime)...)
+	if info.ReadOnly {
+		value = append(value, 1)
+	} else {
+		value = append(value, 0)
+	}
+	value = append(value, byte(len(info.Label)))
+	value = append(value, info.Label...)
+	return append(value, info.Scope...)
+}
+
+func decodeAppPassword(v []byte) (info AppPasswordInfo) {
+	info.CreatedTime = utils.BytesToInt64(v[:8])
+	info.LastUsedTime = utils.BytesToInt64(v[8:16])
+	info.ReadOnly = v[16] != 0
+	labelEnd := 18 + int(v[17])
+	info.Label = string(v[18:labelEnd])
+	info.Scope = string(v[labelEnd:])
+	return
+}
+
+func AddAppPassword(db *badger.DB, addr common.Address, passwordHash [32]byte, info AppPasswordInfo) error {
+	if len(info.Label) > 255 {
+		return errors.New("label is too long")
+	}
+	update := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := append([]byte{AppPassword}, addr[:]...)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if decodeAppPassword(v).Label == info.Label {
+				return ErrAppPasswordExists
+			}
+		}
+		return txn.Set(appPasswordKey(addr, passwordHash), encodeAppPassword(info))
+	}
+	return db.Update(update)
+}
+
+func GetAppPassword(db *badger.DB, addr common.Address, passwordHash [32]byte) (info AppPasswordInfo, err error) {
+	key := appPasswordKey(addr, passwordHash)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info = decodeAppPassword(val)
+			return nil
+		})
+	})
+	return
+}
+
+func ListAppPasswords(db *badger.DB, addr common.Address) ([]AppPasswordInfo, error) {
+	var infos []AppPasswordInfo
+	getter := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := append([]byte{AppPassword}, addr[:]...)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(v []byte) error {
+				infos = append(infos, decodeAppPassword(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.View(getter)
+	return infos, err
+}
+
+func DeleteAppPassword(db *badger.DB, addr common.Address, label string) error {
+	update := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := append([]byte{AppPassword}, addr[:]...)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if decodeAppPassword(v).Label == label {
+				return txn.Delete(item.KeyCopy(nil))
+			}
+		}
+		return badger.ErrKeyNotFound
+	}
+	return db.Update(update)
+}
+
+func TouchAppPassword(db *badger.DB, addr common.Address, passwordHash [32]byte, lastUsedTime int64) error {
+	key := appPasswordKey(addr, passwordHash)
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info := decodeAppPassword(v)
+		info.LastUsedTime = lastUsedTime
+		return txn.Set(key, encodeAppPassword(info))
+	}
+	return db.Update(update)
+}
+
+var ErrNonceUsed = errors.New("the nonce of the signed request has been used")
+
+// UseNonce marks the nonce of a signed request as used until the request expires
+func UseNonce(db *badger.DB, addr common.Address, nonce uint64, expiry int64) error {
+	key := append(append([]byte{UsedNonce}, addr[:]...), utils.Int64ToBytes(int64(nonce))...)
+	update := func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err == nil {
+			return ErrNonceUsed
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		e := badger.NewEntry(key, nil)
+		e.ExpiresAt = uint64(time.Unix(0, expiry).Unix()) + 1
+		return txn.SetEntry(e)
+	}
+	// after a conflict, the retry reads the nonce again and decides with the other use
+	for {
+		err := db.Update(update)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func versionedDirKey(uid int64, dir string) []byte {
+	dirHash := sha256.Sum256([]byte(dir))
+	return append(append([]byte{VersionedDir}, utils.Int64ToBytes(uid)...), dirHash[:]...)
+}
+
+// SetVersionedDir keeps at most maxVersions old versions of each file under dir,
+// zero maxVersions disables versioning
+func SetVersionedDir(db *badger.DB, uid int64, dir string, maxVersions int64) error {
+	key := versionedDirKey(uid, dir)
+	update := func(txn *badger.Txn) error {
+		if maxVersions <= 0 {
+			return txn.Delete(key)
+		}
+		return txn.Set(key, append(utils.Int64ToBytes(maxVersions), dir...))
+	}
+	return db.Update(update)
+}
+
+// FindVersionedDir returns the max versions set on p or its nearest ancestor, zero if
+// versioning is not enabled for p
+func FindVersionedDir(db *badger.DB, uid int64, p string) (maxVersions int64, err error) {
+	walkUpDirs(p, func(dir string) bool {
+		err = db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(versionedDirKey(uid, dir))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				maxVersions = utils.BytesToInt64(val[:8])
+				return nil
+			})
+		})
+		return !errors.Is(err, badger.ErrKeyNotFound)
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	return
+}
+
+func fileVersionKey(uid int64, p string, versionId int64) []byte {
+	pathHash := sha256.Sum256([]byte(p))
+	key := append(append([]byte{FileVersion}, utils.Int64ToBytes(uid)...), pathHash[:]...)
+	return append(key, utils.Int64ToBytes(versionId)...)
+}
+
+func AddFileVersion(db *badger.DB, uid int64, info FileVersionInfo) error {
+	update := func(txn *badger.Txn) error {
+		key := fileVersionKey(uid, info.Path, info.VersionId)
+		return txn.Set(key, append(utils.Int64ToBytes(info.Size), info.Path...))
+	}
+	return db.Update(update)
+}
+
+func DeleteFileVersion(db *badger.DB, uid int64, p string, versionId int64) error {
+	key := fileVersionKey(uid, p, versionId)
+	update := func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	}
+	return db.Update(update)
+}
+
+// GetFileVersions returns the versions of p from the oldest to the newest, or the versions
+// of all the files of uid if p is nil
+func GetFileVersions(db *badger.DB, uid int64, p *string) ([]FileVersionInfo, error) {
+	var infos []FileVersionInfo
+	prefix := append([]byte{FileVersion}, utils.Int64ToBytes(uid)...)
+	if p != nil {
+		pathHash := sha256.Sum256([]byte(*p))
+		prefix = append(prefix, pathHash[:]...)
+	}
+	getter := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			err := item.Value(func(v []byte) error {
+				infos = append(infos, FileVersionInfo{
+					Path:      string(v[8:]),
+					VersionId: utils.BytesToInt64(k[len(k)-8:]),
+					Size:      utils.BytesToInt64(v[:8]),
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.View(getter)
+	return infos, err
+}
+
+func trashEntryKey(uid, deletedTime int64) []byte {
+	return append(append([]byte{TrashEntry}, utils.Int64ToBytes(uid)...), utils.Int64ToBytes(deletedTime)...)
+}
+
+func AddTrashEntry(db *badger.DB, uid int64, info TrashEntryInfo) error {
+	value := append(utils.Int64ToBytes(info.Size), 0)
+	if info.IsDir {
+		value[8] = 1
+	}
+	value = append(value, info.Path...)
+	update := func(txn *badger.Txn) error {
+		return txn.Set(trashEntryKey(uid, info.DeletedTime), value)
+	}
+	return db.Update(update)
+}
+
+func parseTrashEntry(k, v []byte) TrashEntryInfo {
+	return TrashEntryInfo{
+		DeletedTime: utils.BytesToInt64(k[9:17]),
+		Path:        string(v[9:]),
+		Size:        utils.BytesToInt64(v[:8]),
+		IsDir:       v[8] != 0,
+	}
+}
+
+func GetTrashEntry(db *badger.DB, uid, deletedTime int64) (info TrashEntryInfo, err error) {
+	key := trashEntryKey(uid, deletedTime)
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info = parseTrashEntry(key, val)
+			return nil
+		})
+	})
+	return
+}
+
+func DeleteTrashEntry(db *badger.DB, uid, deletedTime int64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(trashEntryKey(uid, deletedTime))
+	})
+}
+
+// GetTrashEntries returns the trashed entries of uid from the oldest to the newest, or the
+// entries of all the users, keyed by their uids, if uid is negative
+func GetTrashEntries(db *badger.DB, uid int64) (map[int64][]TrashEntryInfo, error) {
+	res := make(map[int64][]TrashEntryInfo)
+	prefix := []byte{TrashEntry}
+	if uid >= 0 {
+		prefix = append(prefix, utils.Int64ToBytes(uid)...)
+	}
+	getter := func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			err := item.Value(func(v []byte) error {
+				owner := utils.BytesToInt64(k[1:9])
+				res[owner] = append(res[owner], parseTrashEntry(k, v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := db.View(getter)
+	return res, err
+}
+
+func deadPropsKey(uid int64, p string) []byte {
+	pathHash := sha256.Sum256([]byte(p))
+	return append(append([]byte{DeadProps}, utils.Int64ToBytes(uid)...), pathHash[:]...)
+}
+
+// GetDeadProps returns nil if p has no dead properties
+func GetDeadProps(db *badger.DB, uid int64, p string) (value []byte, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(deadPropsKey(uid, p))
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return
+}
+
+// SetDeadProps replaces the dead properties of p, an empty value deletes them
+func SetDeadProps(db *badger.DB, uid int64, p string, value []byte) error {
+	return db.Update(func(txn *badger.Txn) error {
+		if len(value) == 0 {
+			return txn.Delete(deadPropsKey(uid, p))
+		}
+		return txn.Set(deadPropsKey(uid, p), value)
+	})
+}
+
+func GetDataKey(db *badger.DB, addr common.Address) (wrapped []byte, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte{DataKey}, addr[:]...))
+		if err != nil {
+			return err
+		}
+		wrapped, err = item.ValueCopy(nil)
+		return err
+	})
+	return
+}
+
+// SetDataKeyIfAbsent stores the wrapped data key of addr, unless addr already has one,
+// and returns the stored key
+func SetDataKeyIfAbsent(db *badger.DB, addr common.Address, wrapped []byte) (stored []byte, err error) {
+	key := append([]byte{DataKey}, addr[:]...)
+	err = db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			stored, err = item.ValueCopy(nil)
+			return err
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		stored = wrapped
+		return txn.Set(key, wrapped)
+	})
+	return
+}
+
+// RefBlock adds a reference to the block of hash, and returns true if the block is new,
+// whose content must be stored by the caller
+func RefBlock(db *badger.DB, hash [32]byte, size int64) (isNew bool, err error) {
+	key := append([]byte{BlockRef}, hash[:]...)
+	err = db.Update(func(txn *badger.Txn) error {
+		refs := int64(0)
+		item, err := txn.Get(key)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				refs = utils.BytesToInt64(val[:8])
+				return nil
+			})
+		}
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		isNew = refs == 0
+		return txn.Set(key, append(utils.Int64ToBytes(refs+1), utils.Int64ToBytes(size)...))
+	})
+	return
+}
+
+// UnrefBlock removes a reference to the block of hash, and returns true if it has no more
+// references, whose content can be deleted by the caller
+func UnrefBlock(db *badger.DB, hash [32]byte) (unused bool, err error) {
+	key := append([]byte{BlockRef}, hash[:]...)
+	err = db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		refs := utils.BytesToInt64(val[:8]) - 1
+		if refs <= 0 {
+			unused = true
+			return txn.Delete(key)
+		}
+		return txn.Set(key, append(utils.Int64ToBytes(refs), val[8:]...))
+	})
+	return
+}
+
+// GetBlockRefs returns the reference count of the block of hash, zero if it is not stored
+func GetBlockRefs(db *badger.DB, hash [32]byte) (refs int64, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte{BlockRef}, hash[:]...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			refs = utils.BytesToInt64(val[:8])
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	return
+}
+
+type FileChecksumInfo struct {
+	Uid  int64
+	Path string
+	Sum  []byte
+}
+
+func checksumKey(uid int64, p string) []byte {
+	return append(append([]byte{FileChecksum}, utils.Int64ToBytes(uid)...), p...)
+}
+
+// GetChecksum returns nil if p has no recorded checksum
+func GetChecksum(db *badger.DB, uid int64, p string) (sum []byte, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(checksumKey(uid, p))
+		if err != nil {
+			return err
+		}
+		sum, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return
+}
+
+// SetChecksum records the checksum of the content of p, a nil sum deletes it
+func SetChecksum(db *badger.DB, uid int64, p string, sum []byte) error {
+	return db.Update(func(txn *badger.Txn) error {
+		if sum == nil {
+			return txn.Delete(checksumKey(uid, p))
+		}
+		return txn.Set(checksumKey(uid, p), sum)
+	})
+}
+
+// GetChecksums returns the checksums of the files of uid, or of all the users if uid < 0
+func GetChecksums(db *badger.DB, uid int64) ([]FileChecksumInfo, error) {
+	var res []FileChecksumInfo
+	prefix := []byte{FileChecksum}
+	if uid >= 0 {
+		prefix = append(prefix, utils.Int64ToBytes(uid)...)
+	}
+	err := db.View(func(txn *badger.Txn) (err error) {
+		res, err = checksumsUnder(txn, prefix, false)
+		return err
+	})
+	return res, err
+}
+
+// checksumsUnder returns the checksums whose keys start with prefix, which are those of
+// the files under a directory, as the keys are ordered by path. With exact, the checksum
+// of the path of prefix itself is also returned.
+func checksumsUnder(txn *badger.Txn, prefix []byte, exact bool) ([]FileChecksumInfo, error) {
+	var res []FileChecksumInfo
+	if exact {
+		item, err := txn.Get(prefix)
+		if err == nil {
+			res, err = appendChecksum(res, item)
+		}
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, err
+		}
+		prefix = append(prefix, '/')
+	}
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var err error
+		res, err = appendChecksum(res, it.Item())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func appendChecksum(res []FileChecksumInfo, item *badger.Item) ([]FileChecksumInfo, error) {
+	sum, err := item.ValueCopy(nil)
+	if err != nil {
+		return res, err
+	}
+	return append(res, FileChecksumInfo{
+		Uid:  utils.BytesToInt64(item.Key()[1:9]),
+		Path: string(item.Key()[9:]),
+		Sum:  sum,
+	}), nil
+}
+
+// updateChecksumsUnder calls fn with the checksums of p and everything under it, in the
+// transaction which reads them
+func updateChecksumsUnder(db *badger.DB, uid int64, p string, fn func(txn *badger.Txn, infos []FileChecksumInfo) error) error {
+	for {
+		err := db.Update(func(txn *badger.Txn) error {
+			infos, err := checksumsUnder(txn, checksumKey(uid, p), p != "")
+			if err != nil {
+				return err
+			}
+			return fn(txn, infos)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// MoveChecksums moves the checksums of p and everything under it to newPath
+func MoveChecksums(db *badger.DB, uid int64, p, newPath string) error {
+	return updateChecksumsUnder(db, uid, p, func(txn *badger.Txn, infos []FileChecksumInfo) error {
+		for _, info := range infos {
+			err := txn.Delete(checksumKey(uid, info.Path))
+			if err != nil {
+				return err
+			}
+		}
+		for _, info := range infos {
+			moved := strings.Trim(path.Join(newPath, strings.TrimPrefix(info.Path, p)), "/")
+			err := txn.Set(checksumKey(uid, moved), info.Sum)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteChecksums deletes the checksums of p and everything under it
+func DeleteChecksums(db *badger.DB, uid int64, p string) error {
+	return updateChecksumsUnder(db, uid, p, func(txn *badger.Txn, infos []FileChecksumInfo) error {
+		for _, info := range infos {
+			err := txn.Delete(checksumKey(uid, info.Path))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BuyBandwidthBoost adds rate bytes per second to the bandwidth of uid until expireTime,
+// on top of the boosts it already has, and makes uid pay price for it in the same
+// transaction. It fails with ErrNotEnoughPoints if uid holds less than price.
+func BuyBandwidthBoost(db *badger.DB, uid, rate, expireTime, price int64, operation string) error {
+	key := append(append([]byte{BandwidthBoost}, utils.Int64ToBytes(uid)...), utils.Int64ToBytes(expireTime)...)
+	for {
+		err := db.Update(func(txn *badger.Txn) error {
+			balance, err := getBalance(txn, uid)
+			if err != nil {
+				return err
+			}
+			if balance < price {
+				return ErrNotEnoughPoints
+			}
+			total := rate
+			item, err := txn.Get(key)
+			if err == nil {
+				err = item.Value(func(val []byte) error {
+					total += utils.BytesToInt64(val)
+					return nil
+				})
+			}
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			err = txn.Set(key, utils.Int64ToBytes(total))
+			if err != nil {
+				return err
+			}
+			return setBalance(txn, uid, balance-price, operation)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// GetBandwidthBoost returns the total rate of the boosts of uid which are not expired at now
+func GetBandwidthBoost(db *badger.DB, uid, now int64) (rate int64, err error) {
+	prefix := append([]byte{BandwidthBoost}, utils.Int64ToBytes(uid)...)
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(append(prefix, utils.Int64ToBytes(now)...)); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				rate += utils.BytesToInt64(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// DeleteExpiredBandwidthBoosts removes the boosts of all the users which expired before now
+func DeleteExpiredBandwidthBoosts(db *badger.DB, now int64) (int, error) {
+	var expired [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte{BandwidthBoost}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k := it.Item().KeyCopy(nil)
+			if utils.BytesToInt64(k[9:17]) < now {
+				expired = append(expired, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, k := range expired {
+			err := txn.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(expired), err
+}
+
+// SubscriptionInfo is the plan uid subscribed to, which lasts from the block StartHeight
+// until before the block EndHeight. The included storage and transfer are copied from
+// the plan when it is bought or renewed.
+type SubscriptionInfo struct {
+	Uid          int64
+	PlanId       string
+	StartHeight  int64
+	EndHeight    int64
+	Storage      int64 // bytes
+	Transfer     int64 // bytes
+	UsedTransfer int64 // KB
+	AutoRenew    bool
+}
+
+func (info SubscriptionInfo) ActiveAt(height int64) bool {
+	return info.StartHeight <= height && height < info.EndHeight
+}
+
+// RemainedTransfer returns the KB of the included transfer not used yet
+func (info SubscriptionInfo) RemainedTransfer() int64 {
+	remained := info.Transfer/1024 - info.UsedTransfer
+	if remained < 0 {
+		return 0
+	}
+	return remained
+}
+
+func encodeSubscription(info SubscriptionInfo) []byte {
+	v := make([]byte, 0, 41+len(info.PlanId))
+	v = append(v, utils.Int64ToBytes(info.StartHeight)...)
+	v = append(v, utils.Int64ToBytes(info.EndHeight)...)
+	v = append(v, utils.Int64ToBytes(info.Storage)...)
+	v = append(v, utils.Int64ToBytes(info.Transfer)...)
+	v = append(v, utils.Int64ToBytes(info.UsedTransfer)...)
+	if info.AutoRenew {
+		v = append(v, 1)
+	} else {
+		v = append(v, 0)
+	}
+	return append(v, info.PlanId...)
+}
+
+func decodeSubscription(uid int64, v []byte) SubscriptionInfo {
+	return SubscriptionInfo{
+		Uid:          uid,
+		StartHeight:  utils.BytesToInt64(v[:8]),
+		EndHeight:    utils.BytesToInt64(v[8:16]),
+		Storage:      utils.BytesToInt64(v[16:24]),
+		Transfer:     utils.BytesToInt64(v[24:32]),
+		UsedTransfer: utils.BytesToInt64(v[32:40]),
+		AutoRenew:    v[40] != 0,
+		PlanId:       string(v[41:]),
+	}
+}
+
+func subscriptionKey(uid int64) []byte {
+	return append([]byte{Subscription}, utils.Int64ToBytes(uid)...)
+}
+
+func getSubscription(txn *badger.Txn, uid int64) (info SubscriptionInfo, err error) {
+	item, err := txn.Get(subscriptionKey(uid))
+	if err != nil {
+		return
+	}
+	err = item.Value(func(v []byte) error {
+		info = decodeSubscription(uid, v)
+		return nil
+	})
+	return
+}
+
+// GetSubscription returns the subscription of uid, badger.ErrKeyNotFound if it has none
+func GetSubscription(db *badger.DB, uid int64) (info SubscriptionInfo, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		info, err = getSubscription(txn, uid)
+		return err
+	})
+	return
+}
+
+// UpdateSubscription changes the subscription of uid with update, which is given a zero
+// SubscriptionInfo if uid has none
+func UpdateSubscription(db *badger.DB, uid int64, update func(info *SubscriptionInfo) error) error {
+	for {
+		err := db.Update(func(txn *badger.Txn) error {
+			info, err := getSubscription(txn, uid)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				info, err = SubscriptionInfo{Uid: uid}, nil
+			}
+			if err != nil {
+				return err
+			}
+			err = update(&info)
+			if err != nil {
+				return err
+			}
+			return txn.Set(subscriptionKey(uid), encodeSubscription(info))
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// BuySubscription changes the subscription of uid with update, which returns the operation
+// to log, and makes uid pay price for it in the same transaction. It fails with
+// ErrNotEnoughPoints, leaving the subscription as it is, if uid holds less than price.
+func BuySubscription(db *badger.DB, uid, price int64,
+	update func(info *SubscriptionInfo) (operation string, err error)) error {
+	for {
+		err := db.Update(func(txn *badger.Txn) error {
+			balance, err := getBalance(txn, uid)
+			if err != nil {
+				return err
+			}
+			if balance < price {
+				return ErrNotEnoughPoints
+			}
+			info, err := getSubscription(txn, uid)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				info, err = SubscriptionInfo{Uid: uid}, nil
+			}
+			if err != nil {
+				return err
+			}
+			operation, err := update(&info)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(subscriptionKey(uid), encodeSubscription(info))
+			if err != nil {
+				return err
+			}
+			return setBalance(txn, uid, balance-price, operation)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// GetSubscriptions returns the subscriptions of all the users, expired or not
+func GetSubscriptions(db *badger.DB) ([]SubscriptionInfo, error) {
+	var infos []SubscriptionInfo
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte{Subscription}
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			uid := utils.BytesToInt64(item.Key()[1:])
+			err := item.Value(func(v []byte) error {
+				infos = append(infos, decodeSubscription(uid, v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return infos, err
+}
+
+// UseSubscriptionTransfer uses up to units KB of the transfer included in the active
+// subscription of uid, and returns how many KB were covered by it
+func UseSubscriptionTransfer(db *badger.DB, uid, units int64) (covered int64, err error) {
+	for {
+		covered = 0
+		err = db.Update(func(txn *badger.Txn) error {
+			height, err := getChainHeight(txn)
+			if err != nil {
+				return err
+			}
+			info, err := getSubscription(txn, uid)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !info.ActiveAt(height) || info.RemainedTransfer() == 0 {
+				return nil
+			}
+			covered = units
+			if covered > info.RemainedTransfer() {
+				covered = info.RemainedTransfer()
+			}
+			info.UsedTransfer += covered
+			return txn.Set(subscriptionKey(uid), encodeSubscription(info))
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			return
+		}
+	}
+}
+
+func getChainHeight(txn *badger.Txn) (height int64, err error) {
+	item, err := txn.Get([]byte{ChainHeight})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = item.Value(func(v []byte) error {
+		height = utils.BytesToInt64(v)
+		return nil
+	})
+	return
+}
+
+// GetChainHeight returns the height of the latest BCH block seen by the user manager, zero
+// if none was seen yet
+func GetChainHeight(db *badger.DB) (height int64, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		height, err = getChainHeight(txn)
+		return err
+	})
+	return
+}
+
+func SetChainHeight(db *badger.DB, height int64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte{ChainHeight}, utils.Int64ToBytes(height))
+	})
+}
+
+// GetStorageUsage returns the bytes of the files of uid found by the last storage scan,
+// zero if it was never scanned
+func GetStorageUsage(db *badger.DB, uid int64) (usage int64, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte{StorageUsage}, utils.Int64ToBytes(uid)...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			usage = utils.BytesToInt64(v)
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	return
+}
+
+func SetStorageUsage(db *badger.DB, uid, usage int64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{StorageUsage}, utils.Int64ToBytes(uid)...), utils.Int64ToBytes(usage))
+	})
+}
+
+// WebhookRuleInfo notifies Url of the Events of Uid, with the payloads signed by Secret.
+// Fired has the events about the balance which were notified and must not be notified
+// again until the balance recovers.
+type WebhookRuleInfo struct {
+	Uid       int64
+	Url       string
+	Events    byte
+	Threshold int64 // for NotifyLowBalance
+	Secret    [32]byte
+	Fired     byte
+}
+
+func webhookRuleKey(uid int64, url string) []byte {
+	urlHash := sha256.Sum256([]byte(url))
+	return append(append([]byte{WebhookRule}, utils.Int64ToBytes(uid)...), urlHash[:]...)
+}
+
+func encodeWebhookRule(info WebhookRuleInfo) []byte {
+	value := make([]byte, 0, 8+1+1+32+len(info.Url))
+	value = append(value, utils.Int64ToBytes(info.Threshold)...)
+	value = append(value, info.Events, info.Fired)
+	value = append(value, info.Secret[:]...)
+	return append(value, info.Url...)
+}
+
+func decodeWebhookRule(k, v []byte) (info WebhookRuleInfo) {
+	info.Uid = utils.BytesToInt64(k[1:9])
+	info.Threshold = utils.BytesToInt64(v[:8])
+	info.Events = v[8]
+	info.Fired = v[9]
+	copy(info.Secret[:], v[10:42])
+	info.Url = string(v[42:])
+	return
+}
+
+// SetWebhookRule adds or replaces the rule of info.Uid for info.Url, keeping its secret
+// if it exists. It returns the rule as stored.
+func SetWebhookRule(db *badger.DB, info WebhookRuleInfo) (WebhookRuleInfo, error) {
+	key := webhookRuleKey(info.Uid, info.Url)
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			err = item.Value(func(v []byte) error {
+				info.Secret = decodeWebhookRule(key, v).Secret
+				return nil
+			})
+		}
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		return txn.Set(key, encodeWebhookRule(info))
+	})
+	return info, err
+}
+
+// GetWebhookRules returns the rules of uid, or of all the users if uid is negative
+func GetWebhookRules(db *badger.DB, uid int64) ([]WebhookRuleInfo, error) {
+	var infos []WebhookRuleInfo
+	prefix := []byte{WebhookRule}
+	if uid >= 0 {
+		prefix = append(prefix, utils.Int64ToBytes(uid)...)
+	}
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			err := item.Value(func(v []byte) error {
+				infos = append(infos, decodeWebhookRule(item.Key(), v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return infos, err
+}
+
+func DeleteWebhookRule(db *badger.DB, uid int64, url string) error {
+	key := webhookRuleKey(uid, url)
+	return db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
+// SetWebhookFired records the fired events of the rule of uid for url, if it still exists
+func SetWebhookFired(db *badger.DB, uid int64, url string, fired byte) error {
+	key := webhookRuleKey(uid, url)
+	return db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info := decodeWebhookRule(key, v)
+		info.Fired = fired
+		return txn.Set(key, encodeWebhookRule(info))
+	})
+}
+
+// WebhookDelivery is a payload waiting to be posted to Url, at NextTime or later
+type WebhookDelivery struct {
+	Id       int64
+	NextTime int64
+	Uid      int64
+	Url      string
+	Attempts int
+	Payload  []byte
+}
+
+func webhookDeliveryKey(d WebhookDelivery) []byte {
+	return append(append([]byte{WebhookQueue}, utils.Int64ToBytes(d.NextTime)...), utils.Int64ToBytes(d.Id)...)
+}
+
+func encodeWebhookDelivery(d WebhookDelivery) ([]byte, error) {
+	if len(d.Url) > 0xffff {
+		return nil, errors.New("url is too long")
+	}
+	value := make([]byte, 0, 8+4+2+len(d.Url)+len(d.Payload))
+	value = append(value, utils.Int64ToBytes(d.Uid)...)
+	value = binary.BigEndian.AppendUint32(value, uint32(d.Attempts))
+	value = binary.BigEndian.AppendUint16(value, uint16(len(d.Url)))
+	value = append(value, d.Url...)
+	value = append(value, d.Payload...)
+	return value, nil
+}
+
+func AddWebhookDelivery(db *badger.DB, d WebhookDelivery) error {
+	value, err := encodeWebhookDelivery(d)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(webhookDeliveryKey(d), value)
+	})
+}
+
+// RescheduleWebhookDelivery replaces the queued delivery d with next, which differs in its
+// NextTime or Attempts
+func RescheduleWebhookDelivery(db *badger.DB, d, next WebhookDelivery) error {
+	value, err := encodeWebhookDelivery(next)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete(webhookDeliveryKey(d))
+		if err != nil {
+			return err
+		}
+		return txn.Set(webhookDeliveryKey(next), value)
+	})
+}
+
+// GetDueWebhookDeliveries returns up to limit deliveries whose NextTime is not after now,
+// the earliest first
+func GetDueWebhookDeliveries(db *badger.DB, now int64, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte{WebhookQueue}
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(deliveries) < limit; it.Next() {
+			k := it.Item().Key()
+			d := WebhookDelivery{NextTime: utils.BytesToInt64(k[1:9]), Id: utils.BytesToInt64(k[9:17])}
+			if d.NextTime > now {
+				break
+			}
+			err := it.Item().Value(func(v []byte) error {
+				d.Uid = utils.BytesToInt64(v[:8])
+				d.Attempts = int(binary.BigEndian.Uint32(v[8:12]))
+				urlEnd := 14 + int(binary.BigEndian.Uint16(v[12:14]))
+				d.Url = string(v[14:urlEnd])
+				d.Payload = append([]byte(nil), v[urlEnd:]...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, d)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+func DeleteWebhookDelivery(db *badger.DB, d WebhookDelivery) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(webhookDeliveryKey(d))
+	})
+}
+
+func uploadStartKey(addr common.Address, id string) []byte {
+	return append(append([]byte{UploadStart}, addr[:]...), id...)
+}
+
+// StartUpload records startTime as the time the upload id of addr was started, unless
+// it was recorded before, and returns the recorded time. The record expires after ttl.
+func StartUpload(db *badger.DB, addr common.Address, id string, startTime int64, ttl time.Duration) (started int64, err error) {
+	key := uploadStartKey(addr, id)
+	err = db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			return item.Value(func(v []byte) error {
+				started = utils.BytesToInt64(v)
+				return nil
+			})
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		started = startTime
+		return txn.SetEntry(badger.NewEntry(key, utils.Int64ToBytes(startTime)).WithTTL(ttl))
+	})
+	return
+}
+
+// EndUpload deletes the start time of the upload id of addr, once it is committed or removed
+func EndUpload(db *badger.DB, addr common.Address, id string) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(uploadStartKey(addr, id))
+	})
+}
@@ -0,0 +1,194 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"log"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// The databases written by the older versions are upgraded by the migrations below when
+// the service starts. The number of the migrations already applied is kept under the
+// SchemaVersion key, so each of them runs once. New migrations are appended at the end.
+// The version is stored after the entries of a migration are written, so a migration runs
+// again if the service stops in between, and must leave the entries it already migrated
+// as they are.
+var migrations = []func(db *badger.DB) error{
+	backfillSharedDirTo,
+	addSharePermissions,
+	cleanSharedDirKeys,
+	keyChecksumsByPath,
+}
+
+func getSchemaVersion(db *badger.DB) (version int64, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte{SchemaVersion})
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			version = utils.BytesToInt64(v)
+			return nil
+		})
+	})
+	return
+}
+
+func setSchemaVersion(db *badger.DB, version int64) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte{SchemaVersion}, utils.Int64ToBytes(version))
+	})
+}
+
+// Migrate applies the migrations which were not applied to db yet
+func Migrate(db *badger.DB) error {
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for ; version < int64(len(migrations)); version++ {
+		log.Printf("Migrating the database to schema version %d\n", version+1)
+		err = migrations[version](db)
+		if err != nil {
+			return err
+		}
+		err = setSchemaVersion(db, version+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type migratedEntry struct {
+	key       []byte
+	value     []byte
+	expiresAt uint64
+}
+
+// rewriteEntries calls rewrite with each entry under prefix and stores the entries it
+// returns, keeping the expire time of the original entry. The entries are read before
+// any of them is written, so rewrite may return keys under prefix.
+func rewriteEntries(db *badger.DB, prefix []byte, rewrite func(k, v []byte) (del bool, entries []migratedEntry)) error {
+	var deleted [][]byte
+	var written []migratedEntry
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			k := item.KeyCopy(nil)
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			del, entries := rewrite(k, v)
+			if del {
+				deleted = append(deleted, k)
+			}
+			for _, e := range entries {
+				e.expiresAt = item.ExpiresAt()
+				written = append(written, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range deleted {
+		err = wb.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range written {
+		entry := badger.NewEntry(e.key, e.value)
+		entry.ExpiresAt = e.expiresAt
+		err = wb.SetEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// backfillSharedDirTo adds the SharedDirTo entries of the shares created before the
+// friends could list the directories shared with them
+func backfillSharedDirTo(db *badger.DB) error {
+	return rewriteEntries(db, []byte{SharedDir}, func(k, v []byte) (bool, []migratedEntry) {
+		key := append([]byte{SharedDirTo}, k[9:17]...)
+		key = append(key, k[1:9]...)
+		key = append(key, k[17:]...)
+		return false, []migratedEntry{{key: key, value: v}}
+	})
+}
+
+// addSharePermissions converts the shares which hold only the expire time and the dir
+// into read-only shares paid by the owner, as all the shares were before the permissions
+func addSharePermissions(db *badger.DB) error {
+	for _, prefix := range []byte{SharedDir, SharedDirTo} {
+		err := rewriteEntries(db, []byte{prefix}, func(k, v []byte) (bool, []migratedEntry) {
+			if len(v) < 8 {
+				return true, nil
+			}
+			// the key of an old share is hashed from the dir following the expire time,
+			// the dir of a converted one follows the permissions
+			if dirHash := sha256.Sum256(v[8:]); !bytes.Equal(k[17:], dirHash[:]) {
+				return false, nil
+			}
+			value := append(append([]byte{}, v[:8]...), PermRead, PayerOwner)
+			value = append(value, v[8:]...)
+			return false, []migratedEntry{{key: k, value: value}}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanSharedDirKeys moves the shares to the keys hashed from the cleaned dir, which are
+// the ones the ancestors of a path are looked up with
+func cleanSharedDirKeys(db *badger.DB) error {
+	for _, prefix := range []byte{SharedDir, SharedDirTo} {
+		err := rewriteEntries(db, []byte{prefix}, func(k, v []byte) (bool, []migratedEntry) {
+			if len(v) < 10 {
+				return true, nil
+			}
+			dir := CleanPath(string(v[10:]))
+			key := sharedDirKey(prefix, utils.BytesToInt64(k[1:9]), utils.BytesToInt64(k[9:17]), dir)
+			if bytes.Equal(key, k) && dir == string(v[10:]) {
+				return false, nil
+			}
+			value := append(append([]byte{}, v[:10]...), dir...)
+			return !bytes.Equal(key, k), []migratedEntry{{key: key, value: value}}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyChecksumsByPath moves the checksums from the keys hashed from the path to the keys
+// holding the path, so the checksums under a directory are one range of keys
+func keyChecksumsByPath(db *badger.DB) error {
+	return rewriteEntries(db, []byte{FileChecksum}, func(k, v []byte) (bool, []migratedEntry) {
+		// the value of a moved checksum is the sum alone
+		if len(v) <= sha256.Size {
+			return false, nil
+		}
+		key := checksumKey(utils.BytesToInt64(k[1:9]), string(v[sha256.Size:]))
+		return true, []migratedEntry{{key: key, value: v[:sha256.Size]}}
+	})
+}
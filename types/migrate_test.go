@@ -0,0 +1,72 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/utils"
+)
+
+func TestMigrationsRunAgain(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// a share as stored before the migrations
+	const fromUid, toUid, dir = 1, 2, "/photos/"
+	key := make([]byte, 1+8+8+32)
+	key[0] = SharedDir
+	binary.BigEndian.PutUint64(key[1:9], uint64(fromUid))
+	binary.BigEndian.PutUint64(key[9:17], uint64(toUid))
+	dirHash := sha256.Sum256([]byte(dir))
+	copy(key[17:], dirHash[:])
+	// and a checksum
+	const file = "photos/a.jpg"
+	fileHash := sha256.Sum256([]byte(file))
+	sum := sha256.Sum256([]byte("content"))
+	checksumKey := append(append([]byte{FileChecksum}, utils.Int64ToBytes(fromUid)...), fileHash[:]...)
+	err = db.Update(func(txn *badger.Txn) error {
+		err := txn.Set(key, append(utils.Int64ToBytes(1<<62), dir...))
+		if err != nil {
+			return err
+		}
+		return txn.Set(checksumKey, append(sum[:], file...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each migration runs twice, as if the service stopped before storing the version
+	for _, migrate := range migrations {
+		for i := 0; i < 2; i++ {
+			err = migrate(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, get := range []func() ([]SharedDirInfo, error){
+		func() ([]SharedDirInfo, error) { return GetSharedDirsFrom(db, fromUid) },
+		func() ([]SharedDirInfo, error) { return GetSharedDirsTo(db, toUid) },
+	} {
+		infos, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Dir != "photos" || infos[0].Permissions != PermRead || infos[0].Payer != PayerOwner {
+			t.Errorf("shares after the migrations: %+v", infos)
+		}
+	}
+	checksums, err := GetChecksums(db, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checksums) != 1 || checksums[0].Uid != fromUid || checksums[0].Path != file || !bytes.Equal(checksums[0].Sum, sum[:]) {
+		t.Errorf("checksums after the migrations: %+v", checksums)
+	}
+}
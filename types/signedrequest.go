@@ -0,0 +1,86 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	SignDomainName    = "CashDisk"
+	SignDomainVersion = "1"
+
+	SigTypeEIP712 = "eip712"
+	SigTypeEIP191 = "eip191"
+)
+
+// SignedRequest is the envelope of all the signed requests to the user manager. The
+// signature covers the service domain and chain id, the action, so that the request
+// cannot be used for another endpoint, and an expiry and a nonce, so that it cannot be
+// replayed. Params is the JSON of the action's param and is signed verbatim.
+type SignedRequest struct {
+	Action  string          `json:"action"`
+	Params  json.RawMessage `json:"params"`
+	ChainId int64           `json:"chainId"`
+	Expiry  int64           `json:"expiry"` // unix nano
+	Nonce   uint64          `json:"nonce"`
+	SigType string          `json:"sigType"` // SigTypeEIP712 (default) or SigTypeEIP191
+	Sig     []byte          `json:"signature"`
+}
+
+// TypedData returns the EIP-712 typed data of the request, which wallets can show to
+// their users in a readable form with eth_signTypedData_v4
+func (req *SignedRequest) TypedData() apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+				{Name: "chainId", Type: "uint256"},
+			},
+			"Request": {
+				{Name: "action", Type: "string"},
+				{Name: "params", Type: "string"},
+				{Name: "expiry", Type: "uint256"},
+				{Name: "nonce", Type: "uint256"},
+			},
+		},
+		PrimaryType: "Request",
+		Domain: apitypes.TypedDataDomain{
+			Name:    SignDomainName,
+			Version: SignDomainVersion,
+			ChainId: math.NewHexOrDecimal256(req.ChainId),
+		},
+		Message: apitypes.TypedDataMessage{
+			"action": req.Action,
+			"params": string(req.Params),
+			"expiry": big.NewInt(req.Expiry),
+			"nonce":  new(big.Int).SetUint64(req.Nonce),
+		},
+	}
+}
+
+// Text returns the message to be signed with personal_sign for SigTypeEIP191
+func (req *SignedRequest) Text() string {
+	return fmt.Sprintf("%s %s\nAction: %s\nParams: %s\nChain: %d\nExpiry: %d\nNonce: %d",
+		SignDomainName, SignDomainVersion, req.Action, req.Params, req.ChainId, req.Expiry, req.Nonce)
+}
+
+func (req *SignedRequest) SigningHash() (hash [32]byte, err error) {
+	switch req.SigType {
+	case "", SigTypeEIP712:
+		var bz []byte
+		bz, _, err = apitypes.TypedDataAndHash(req.TypedData())
+		copy(hash[:], bz)
+	case SigTypeEIP191:
+		copy(hash[:], accounts.TextHash([]byte(req.Text())))
+	default:
+		err = errors.New("unknown signature type: " + req.SigType)
+	}
+	return
+}
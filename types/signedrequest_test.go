@@ -0,0 +1,139 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/smartbch/cashdisk/utils"
+)
+
+func TestSigningHash(t *testing.T) {
+	base := SignedRequest{
+		Action:  "transferPoints",
+		Params:  json.RawMessage(`{"amount":1}`),
+		ChainId: 10000,
+		Expiry:  1_700_000_000_000_000_000,
+		Nonce:   1,
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[[32]byte]string)
+	for _, sigType := range []string{"", SigTypeEIP712, SigTypeEIP191} {
+		for _, c := range []struct {
+			name   string
+			change func(req *SignedRequest)
+		}{
+			{"base", func(req *SignedRequest) {}},
+			{"action", func(req *SignedRequest) { req.Action = "createAppPassword" }},
+			{"params", func(req *SignedRequest) { req.Params = json.RawMessage(`{"amount":2}`) }},
+			{"chain", func(req *SignedRequest) { req.ChainId = 10001 }},
+			{"expiry", func(req *SignedRequest) { req.Expiry++ }},
+			{"nonce", func(req *SignedRequest) { req.Nonce++ }},
+		} {
+			req := base
+			req.SigType = sigType
+			c.change(&req)
+			hash, err := req.SigningHash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// EIP-712 is the default signature type
+			name := sigType + " " + c.name
+			if sigType == "" {
+				name = SigTypeEIP712 + " " + c.name
+			}
+			if other, ok := hashes[hash]; ok && other != name {
+				t.Errorf("%s and %s have the same signing hash", name, other)
+			}
+			hashes[hash] = name
+
+			// the signer is recovered from the signatures of wallets, whose recovery
+			// id is 27 or 28
+			sig, err := crypto.Sign(hash[:], key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig[crypto.RecoveryIDOffset] += 27
+			signer, err := utils.GetAddressAndCheckSig(hash, sig)
+			if err != nil || signer != crypto.PubkeyToAddress(key.PublicKey) {
+				t.Errorf("%s: recovered %s: %v", name, signer, err)
+			}
+		}
+	}
+	if len(hashes) != 12 {
+		t.Errorf("%d distinct signing hashes", len(hashes))
+	}
+
+	req := base
+	req.SigType = SigTypeEIP191
+	hash, _ := req.SigningHash()
+	if common.Hash(hash) != common.BytesToHash(accounts.TextHash([]byte(req.Text()))) {
+		t.Error("the EIP-191 hash is not the personal_sign hash of the text")
+	}
+	req.SigType = "eip999"
+	if _, err = req.SigningHash(); err == nil {
+		t.Error("signed with an unknown signature type")
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	alice := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bob := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	const expiry = 1 << 62
+
+	// of the concurrent uses of a nonce, one succeeds and the others see it used
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- UseNonce(db, alice, 1, expiry)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	used := 0
+	for err := range errs {
+		if err == nil {
+			used++
+		} else if !errors.Is(err, ErrNonceUsed) {
+			t.Error(err)
+		}
+	}
+	if used != 1 {
+		t.Errorf("the nonce is used %d times", used)
+	}
+	// the nonces are per address
+	for _, c := range []struct {
+		addr  common.Address
+		nonce uint64
+		err   error
+	}{
+		{alice, 1, ErrNonceUsed},
+		{alice, 2, nil},
+		{bob, 1, nil},
+		{bob, 1, ErrNonceUsed},
+	} {
+		if err := UseNonce(db, c.addr, c.nonce, expiry); !errors.Is(err, c.err) {
+			t.Errorf("nonce %d of %s: %v, want %v", c.nonce, c.addr, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package usermanager
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+// accountInfo returns the state of the account of user
+func (u *UserManager) accountInfo(user common.Address, uid int64) (res types.AccountRes, err error) {
+	res.Address = user
+	res.Locked, res.Balance, err = types.IsUserLock(u.DB, uid)
+	if err != nil {
+		return
+	}
+	u.lock.RLock()
+	for _, p := range u.pendingPaymentCache {
+		if p.Uid == uid {
+			res.PendingCredits += p.Value
+		}
+	}
+	u.lock.RUnlock()
+	res.StorageUsage, err = types.GetStorageUsage(u.DB, uid)
+	if err != nil {
+		return
+	}
+	sharesFrom, err := types.GetSharedDirsFrom(u.DB, uid)
+	if err != nil {
+		return
+	}
+	sharesTo, err := types.GetSharedDirsTo(u.DB, uid)
+	if err != nil {
+		return
+	}
+	res.SharesFrom, res.SharesTo = len(sharesFrom), len(sharesTo)
+	if res.Locked {
+		res.Unlock = &types.UnlockPayment{
+			MinAmount:   1 - res.Balance, // a normal payment must make amount+balance positive
+			Amount:      unlockStochasticAmount,
+			Probability: unlockProbability(res.Balance),
+		}
+	}
+	return
+}
@@ -1,18 +1,21 @@
 package usermanager
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
 
 	"github.com/smartbch/cashdisk/types"
 	"github.com/smartbch/cashdisk/utils"
+	"github.com/smartbch/cashdisk/webdavledger"
 )
 
 const (
@@ -29,8 +32,25 @@ func (u *UserManager) StartDirScanRoutine() {
 		time.Sleep(30 * time.Second)
 		latestBlk, _ := u.bchClient.GetBlockCount()
 		if latestBlk > prevBlk {
+			err := types.SetChainHeight(u.DB, latestBlk)
+			if err != nil {
+				panic(err)
+			}
+			u.renewSubscriptions(latestBlk)
 			blkHash, _ := u.bchClient.GetBlockHash(latestBlk)
-			DirScan(u.DB, ".", *blkHash, dirFeeThreshold, nil)
+			DirScan(u.DB, u.root, *blkHash, dirFeeThreshold, log.Default())
+			_, err = types.DeleteExpiredSharedDirs(u.DB, time.Now().UnixNano())
+			if err != nil {
+				panic(err)
+			}
+			_, err = types.DeleteExpiredBandwidthBoosts(u.DB, time.Now().UnixNano())
+			if err != nil {
+				panic(err)
+			}
+			_, err = u.trash.PurgeExpired(time.Now().Add(-u.cfg.TrashRetention).UnixNano())
+			if err != nil {
+				panic(err)
+			}
 			infos, err := types.GetDirShareInfos(u.DB)
 			if err != nil {
 				panic(err)
@@ -50,16 +70,79 @@ func (u *UserManager) StartDirScanRoutine() {
 	}
 }
 
-func dirScan(db *badger.DB, workDir string, hash [32]byte, thres int64, logger *log.Logger,
+// dirScan charges uid for the files in its home, and for the old versions and the trashed
+// files it retains. The storage included in its active subscription is free. The total
+// size of the content of the files is recorded as the storage usage of uid, rather than
+// the space they take in a deduplicating backend, which would tell whether the content of
+// a file is also stored by another user.
+func dirScan(db *badger.DB, root webdav.FileSystem, hash [32]byte, thres int64, logger *log.Logger,
 	uid int64, addr common.Address) {
-	dir := filepath.Join(workDir, addr.Hex())
-	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+	included := int64(0)
+	height, err := types.GetChainHeight(db)
+	if err != nil {
+		logger.Printf("Error in GetChainHeight: %s\n", err.Error())
+		return
+	}
+	sub, err := types.GetSubscription(db, uid)
+	if err == nil && sub.ActiveAt(height) {
+		included = sub.Storage
+	}
+	usage := int64(0)
+	for _, dir := range storageDirs(addr) {
+		dirScanOne(db, root, dir, hash, thres, logger, uid, &included, &usage)
+	}
+	err = types.SetStorageUsage(db, uid, usage)
+	if err != nil {
+		logger.Printf("Error in SetStorageUsage: %s\n", err.Error())
+	}
+}
+
+// storageDirs returns the directories of the backend holding the files of addr
+func storageDirs(addr common.Address) []string {
+	return []string{
+		path.Join("/", addr.Hex()),
+		path.Join("/", webdavledger.VersionsDir, addr.Hex()),
+		path.Join("/", webdavledger.TrashDir, addr.Hex()),
+	}
+}
+
+// storageSize returns the bytes stored for the file at path in root
+func storageSize(root webdav.FileSystem, path string, f os.FileInfo) (int64, error) {
+	if sizer, ok := root.(webdavledger.StorageSizer); ok {
+		return sizer.StorageSize(context.Background(), path)
+	}
+	return f.Size(), nil
+}
+
+// dirScanOne charges uid for the files under dir, after using up the free bytes in
+// included, and adds the sizes of the files to usage
+func dirScanOne(db *badger.DB, root webdav.FileSystem, dir string, hash [32]byte, thres int64,
+	logger *log.Logger, uid int64, included, usage *int64) {
+	err := webdavledger.Walk(context.Background(), root, dir, func(path string, f os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
-			logger.Printf("Error in filepath.Walk: %s\n", err.Error())
+			logger.Printf("Error in Walk: %s\n", err.Error())
+			return nil
 		}
-		size := int64(1)
+		bytes := int64(Mega) // a directory is charged as 1MB
 		if !f.IsDir() {
-			size = (f.Size() + Mega - 1) / Mega
+			*usage += f.Size()
+			bytes, err = storageSize(root, path, f)
+			if err != nil {
+				logger.Printf("Error in StorageSize: %s\n", err.Error())
+				return nil
+			}
+		}
+		free := bytes
+		if free > *included {
+			free = *included
+		}
+		*included -= free
+		size := (bytes - free + Mega - 1) / Mega
+		if size == 0 {
+			return nil
 		}
 		hash := sha256.Sum256(append(hash[:], path...))
 		n := utils.BytesToInt64(hash[:8])
@@ -70,11 +153,11 @@ func dirScan(db *badger.DB, workDir string, hash [32]byte, thres int64, logger *
 		return nil
 	})
 	if err != nil {
-		logger.Printf("Error in filepath.Walk: %s\n", err.Error())
+		logger.Printf("Error in Walk: %s\n", err.Error())
 	}
 }
 
-func DirScan(db *badger.DB, workDir string, hash [32]byte, thres int64, logger *log.Logger) {
+func DirScan(db *badger.DB, root webdav.FileSystem, hash [32]byte, thres int64, logger *log.Logger) {
 	err := db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
@@ -86,7 +169,7 @@ func DirScan(db *badger.DB, workDir string, hash [32]byte, thres int64, logger *
 				uid := utils.BytesToInt64(v)
 				var addr common.Address
 				copy(addr[:], k[1:])
-				dirScan(db, workDir, hash, thres, logger, uid, addr)
+				dirScan(db, root, hash, thres, logger, uid, addr)
 				return nil
 			})
 			if err != nil {
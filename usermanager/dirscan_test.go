@@ -0,0 +1,65 @@
+package usermanager
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/webdavledger"
+)
+
+func TestStorageUsageOverDedup(t *testing.T) {
+	u := newTestManager(t)
+	root, err := webdavledger.NewBackend(config.BackendConfig{Type: config.BackendMemory, Dedup: true}, "", u.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.root = root
+	ctx := context.Background()
+	content := strings.Repeat("the same content in two homes ", 1000)
+	users := []common.Address{
+		common.HexToAddress("0x1111111111111111111111111111111111111111"),
+		common.HexToAddress("0x2222222222222222222222222222222222222222"),
+	}
+	for i, addr := range users {
+		home := path.Join("/", addr.Hex())
+		err = root.Mkdir(ctx, home, 0755)
+		var f webdav.File
+		if err == nil {
+			f, err = root.OpenFile(ctx, path.Join(home, "f.txt"), os.O_CREATE|os.O_WRONLY, 0644)
+		}
+		if err == nil {
+			_, err = f.Write([]byte(content))
+		}
+		if err == nil {
+			err = f.Close()
+		}
+		if err == nil {
+			err = types.RefundPoints(u.DB, int64(i+1), 1_000_000, "test")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, addr := range users {
+		res, err := u.accountInfo(addr, int64(i+1))
+		if err != nil || res.StorageUsage != 0 {
+			t.Fatalf("usage %d before the scan: %v", res.StorageUsage, err)
+		}
+		dirScan(u.DB, root, [32]byte{}, 0, log.New(io.Discard, "", 0), int64(i+1), addr)
+		res, err = u.accountInfo(addr, int64(i+1))
+		// the usage is the size of the content, however many users store it
+		if err != nil || res.StorageUsage != int64(len(content)) {
+			t.Errorf("usage %d after the scan, want %d: %v", res.StorageUsage, len(content), err)
+		}
+	}
+}
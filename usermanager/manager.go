@@ -2,6 +2,7 @@ package usermanager
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -22,22 +23,27 @@ import (
 	"github.com/gcash/bchutil"
 	"github.com/smartbch/stochastic-pay/sdk"
 	"github.com/tyler-smith/go-bip32"
+	"golang.org/x/net/webdav"
 
 	"github.com/smartbch/cashdisk/config"
 	"github.com/smartbch/cashdisk/types"
 	"github.com/smartbch/cashdisk/utils"
+	"github.com/smartbch/cashdisk/webdavledger"
 )
 
 var (
 	minExpirationBlocksInMainnet int64 = 10
 	pointsPerBCHSatochi          int64 = 100_000_000
 	minPointsWhenFirstBuy        int64 = 10_000_000
+	unlockStochasticAmount       int64 = 10_000_000 // the satoshis of a stochastic payment of a locked user
+	maxSignedRequestLifetime           = time.Hour
 )
 
 type UserManager struct {
 	cfg *config.Config
 
 	listenUrl string
+	root      webdav.FileSystem
 
 	key *bip32.Key
 	DB  *badger.DB
@@ -50,23 +56,37 @@ type UserManager struct {
 	pendingPaymentCache []*types.PendingPaymentInfo
 
 	unSpentStochasticTxCache *ttlcache.Cache
+
+	versions *webdavledger.VersionStore
+	trash    *webdavledger.TrashBin
+
+	ipLimiter         *utils.RateLimiter
+	addrLimiter       *utils.RateLimiter
+	secretHashLimiter *utils.RateLimiter
+
+	pwAuth *webdavledger.PasswordAuth // for the requests made with WebDAV credentials
+
+	webhookClient *http.Client
 }
 
-func NewUserManager(listenUrl string, bchRpcUrl string, dbPath string, receiverPubkeyHash string) *UserManager {
+func newRateLimiter(c config.RateLimitConfig) *utils.RateLimiter {
+	return utils.NewRateLimiter(c.SlotDuration, c.NumTimeSlots, c.MaxCount)
+}
+
+func NewUserManager(cfg *config.Config, listenUrl string, bchRpcUrl string, db *badger.DB, root webdav.FileSystem, receiverPubkeyHash string) *UserManager {
 	m := &UserManager{
-		cfg:       &config.Config{},
+		cfg:       cfg,
 		listenUrl: listenUrl,
+		root:      root,
 	}
 	client, err := utils.NewBchMainnetClient(bchRpcUrl)
 	if err != nil {
 		panic(err)
 	}
 	m.bchClient = client
-	db, err := badger.Open(badger.DefaultOptions(dbPath))
-	if err != nil {
-		panic(err)
-	}
 	m.DB = db
+	m.versions = webdavledger.NewVersionStore(db, root)
+	m.trash = webdavledger.NewTrashBin(db, root)
 	seed, err := bip32.NewSeed()
 	if err != nil {
 		panic(err)
@@ -98,6 +118,11 @@ func NewUserManager(listenUrl string, bchRpcUrl string, dbPath string, receiverP
 	cache := ttlcache.NewCache()
 	cache.SetTTL(5 * time.Minute)
 	m.unSpentStochasticTxCache = cache
+	m.ipLimiter = newRateLimiter(m.cfg.UserManagerConfig.IPRateLimit)
+	m.addrLimiter = newRateLimiter(m.cfg.UserManagerConfig.AddressRateLimit)
+	m.secretHashLimiter = newRateLimiter(m.cfg.SecretHashRateLimit)
+	m.pwAuth = webdavledger.NewPasswordAuth(db, m.cfg.FailedLoginRateLimit)
+	m.webhookClient = newWebhookClient(m.cfg.Webhooks)
 	return m
 }
 
@@ -105,9 +130,10 @@ func (u *UserManager) Run() {
 	fmt.Printf("start user manager service on %s\n", u.listenUrl)
 	go u.StartPaymentWatcher()
 	go u.StartDirScanRoutine()
+	go u.StartWebhookRoutine()
 	mux := http.NewServeMux()
 	u.registerHttpEndpoint(mux)
-	err := http.ListenAndServe(u.listenUrl, mux)
+	err := http.ListenAndServe(u.listenUrl, utils.LimitByIP(u.ipLimiter, mux))
 	if err != nil {
 		panic(err)
 	}
@@ -119,9 +145,36 @@ func (u *UserManager) registerHttpEndpoint(mux *http.ServeMux) {
 	mux.HandleFunc("/viewhistory", u.handleViewHistory)
 	mux.HandleFunc("/setpassword", u.handleSetPassword)
 	mux.HandleFunc("/sharedir", u.handleShareDir)
+	mux.HandleFunc("/listshares", u.handleListShares)
+	mux.HandleFunc("/revokeshare", u.handleRevokeShare)
+	mux.HandleFunc("/createsharelink", u.handleCreateShareLink)
+	mux.HandleFunc("/revokesharelink", u.handleRevokeShareLink)
+	mux.HandleFunc("/apppasswords/create", u.handleCreateAppPassword)
+	mux.HandleFunc("/apppasswords/list", u.handleListAppPasswords)
+	mux.HandleFunc("/apppasswords/revoke", u.handleRevokeAppPassword)
+	mux.HandleFunc("/versioning/set", u.handleSetVersioning)
+	mux.HandleFunc("/versions/list", u.handleListVersions)
+	mux.HandleFunc("/versions/restore", u.handleRestoreVersion)
+	mux.HandleFunc("/trash/list", u.handleListTrash)
+	mux.HandleFunc("/trash/restore", u.handleRestoreTrash)
+	mux.HandleFunc("/trash/purge", u.handlePurgeTrash)
+	mux.HandleFunc("/bandwidth/boost", u.handleBoostBandwidth)
+	mux.HandleFunc("/plans", u.handleListPlans)
+	mux.HandleFunc("/subscribe", u.handleSubscribe)
+	mux.HandleFunc("/subscription/get", u.handleGetSubscription)
+	mux.HandleFunc("/subscription/cancel", u.handleCancelSubscription)
+	mux.HandleFunc("/notifications/set", u.handleSetNotification)
+	mux.HandleFunc("/notifications/list", u.handleListNotifications)
+	mux.HandleFunc("/notifications/delete", u.handleDeleteNotification)
+	mux.HandleFunc("/account", u.handleAccount)
+	mux.HandleFunc("/transferpoints", u.handleTransferPoints)
 }
 
 func (u *UserManager) handleGetSecretHash(w http.ResponseWriter, r *http.Request) {
+	if !u.secretHashLimiter.Allow(utils.ClientIP(r)) {
+		utils.WriteTooManyRequests(w, u.secretHashLimiter.RetryAfter())
+		return
+	}
 	keyBz, err := u.key.Serialize()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -141,14 +194,12 @@ func (u *UserManager) handleGetSecretHash(w http.ResponseWriter, r *http.Request
 
 func (u *UserManager) handleBuyPoints(w http.ResponseWriter, r *http.Request) {
 	var param types.BuyPointsParam
-	body, _ := io.ReadAll(r.Body)
-	err := json.Unmarshal(body, &param)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("param parsed failed: " + err.Error()))
+	// the buyer may not be registered yet, and a locked user buys points to unlock
+	user, ok := u.parseSignedRequest(w, r, "buyPoints", &param)
+	if !ok {
 		return
 	}
-	err = u.handleBuyPointsAndAddUser(&param)
+	err := u.handleBuyPointsAndAddUser(user, &param)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("handle buy points failed: " + err.Error()))
@@ -158,15 +209,7 @@ func (u *UserManager) handleBuyPoints(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func (u *UserManager) handleBuyPointsAndAddUser(param *types.BuyPointsParam) error {
-	sig := param.Sig
-	param.Sig = nil
-	out, _ := json.Marshal(param)
-	hash := sha256.Sum256(out)
-	user, err := utils.GetAddressAndCheckSig(hash, sig)
-	if err != nil {
-		return err
-	}
+func (u *UserManager) handleBuyPointsAndAddUser(user common.Address, param *types.BuyPointsParam) error {
 	var zeroAddress = [20]byte{}
 	if param.FriendAddress != zeroAddress {
 		// pay for friend
@@ -266,9 +309,7 @@ func (u *UserManager) handleMainnetUserPayment(user common.Address, uid int64, t
 			}
 		}
 		if isLocked {
-			probabilityInRatio := (balance / -1000_000) / 10
-			probability := sdk.GetProbabilityByRatio(float64(probabilityInRatio))
-			if probability != param.Probability || amount != 10_000_000 {
+			if unlockProbability(balance) != param.Probability || amount != unlockStochasticAmount {
 				return errors.New("probability or amount is not match when user is locked")
 			}
 		}
@@ -302,52 +343,23 @@ func (u *UserManager) handleMainnetUserPayment(user common.Address, uid int64, t
 	return nil
 }
 
+// unlockProbability returns the probability a stochastic payment of a user locked with
+// balance must have
+func unlockProbability(balance int64) int64 {
+	probabilityInRatio := (balance / -1000_000) / 10
+	return sdk.GetProbabilityByRatio(float64(probabilityInRatio))
+}
+
 func (u *UserManager) handleViewHistory(w http.ResponseWriter, r *http.Request) {
 	var param types.ViewHistoryParam
-	body, _ := io.ReadAll(r.Body)
-	err := json.Unmarshal(body, &param)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("param parsed failed: " + err.Error()))
-		return
-	}
-	sig := param.Sig
-	param.Sig = nil
-	out, _ := json.Marshal(param)
-	hash := sha256.Sum256(out)
-	user, err := utils.GetAddressAndCheckSig(hash, sig)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user address parsed failed: " + err.Error()))
-		return
-	}
-	uid := types.GetUID(u.DB, user)
-	if uid < 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user not register"))
-		return
-	}
-	isLocked, _, err := types.IsUserLock(u.DB, uid)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("get user lock status error" + err.Error()))
-		return
-	}
-	if isLocked {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user is locked"))
-		return
-	}
-	err = types.ConsumePoints(u.DB, uid, types.PointsOfUserManagerAccess, "viewHistory")
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("deduct points failed: " + err.Error()))
+	_, uid, ok := u.checkSignedRequest(w, r, "viewHistory", &param)
+	if !ok {
 		return
 	}
 	startTime := param.BeginTimestamp
 	endTime := param.EndTimestamp
 	var res types.ViewHistoryRes
-	err = u.DB.View(func(txn *badger.Txn) error {
+	err := u.DB.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -381,121 +393,787 @@ func (u *UserManager) handleViewHistory(w http.ResponseWriter, r *http.Request)
 		w.Write([]byte("view history failed: " + err.Error()))
 		return
 	}
-	out, _ = json.Marshal(res)
+	out, _ := json.Marshal(res)
 	w.Write(out)
 	return
 }
 
 func (u *UserManager) handleSetPassword(w http.ResponseWriter, r *http.Request) {
 	var param types.SetPasswordHashParam
-	body, _ := io.ReadAll(r.Body)
-	err := json.Unmarshal(body, &param)
+	user, _, ok := u.checkSignedRequest(w, r, "setPassword", &param)
+	if !ok {
+		return
+	}
+	err := types.UpdateUserPasswordHash(u.DB, user, param.NewPasswordHash)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("param parsed failed: " + err.Error()))
+		w.Write([]byte("set password failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleShareDir(w http.ResponseWriter, r *http.Request) {
+	var param types.ShareDirParam
+	user, uid, ok := u.checkSignedRequest(w, r, "shareDir", &param)
+	if !ok {
+		return
+	}
+	perm := param.Permissions
+	if perm == 0 {
+		perm = types.PermRead
+	}
+	if perm&^types.PermAll != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid permissions"))
+		return
+	}
+	if param.Payer > types.PayerSplit {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid payer"))
 		return
 	}
-	sig := param.Sig
-	param.Sig = nil
-	out, _ := json.Marshal(param)
-	hash := sha256.Sum256(out)
-	user, err := utils.GetAddressAndCheckSig(hash, sig)
+	fUid := types.GetUID(u.DB, param.Friend)
+	if fUid < 0 {
+		fUid = types.AddressToUID(u.DB, param.Friend)
+		err := types.AddNewUser(u.DB, param.Friend, fUid, param.PasswordHash)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("add new user failed: " + err.Error()))
+			return
+		}
+	}
+	dir := types.CleanPath(param.Dir)
+	err := types.UpdateSharedDir(u.DB, uid, fUid, dir, param.ExpiredTime, perm, param.Payer)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user address parsed failed: " + err.Error()))
+		w.Write([]byte("share directory failed: " + err.Error()))
 		return
 	}
-	uid := types.GetUID(u.DB, user)
-	if uid < 0 {
+	u.notify(fUid, types.NotifyShareReceived, func(payload *types.NotificationPayload) {
+		payload.Owner = user.Hex()
+		payload.Dir = dir
+	})
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleListShares(w http.ResponseWriter, r *http.Request) {
+	var param types.ListSharesParam
+	_, uid, ok := u.checkSignedRequest(w, r, "listShares", &param)
+	if !ok {
+		return
+	}
+	outgoing, err := types.GetSharedDirsFrom(u.DB, uid)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user not register"))
+		w.Write([]byte("list outgoing shares failed: " + err.Error()))
 		return
 	}
-	isLocked, _, err := types.IsUserLock(u.DB, uid)
+	incoming, err := types.GetSharedDirsTo(u.DB, uid)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("get user lock status error" + err.Error()))
+		w.Write([]byte("list incoming shares failed: " + err.Error()))
 		return
 	}
-	if isLocked {
+	res := types.ListSharesRes{
+		Outgoing: u.toShareInfos(outgoing),
+		Incoming: u.toShareInfos(incoming),
+	}
+	out, _ := json.Marshal(res)
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) toShareInfos(dirs []types.SharedDirInfo) []types.ShareInfo {
+	infos := make([]types.ShareInfo, 0, len(dirs))
+	for _, d := range dirs {
+		owner, err := types.GetAddressByUID(u.DB, d.FromUid)
+		if err != nil {
+			continue
+		}
+		friend, err := types.GetAddressByUID(u.DB, d.ToUid)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, types.ShareInfo{
+			Owner:       owner,
+			Friend:      friend,
+			Dir:         d.Dir,
+			ExpiredTime: d.ExpiredTime,
+			Permissions: d.Permissions,
+			Payer:       d.Payer,
+		})
+	}
+	return infos
+}
+
+func (u *UserManager) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	var param types.RevokeShareParam
+	_, uid, ok := u.checkSignedRequest(w, r, "revokeShare", &param)
+	if !ok {
+		return
+	}
+	fUid := types.GetUID(u.DB, param.Friend)
+	if fUid < 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user is locked"))
+		w.Write([]byte("friend not register"))
 		return
 	}
-	err = types.ConsumePoints(u.DB, uid, types.PointsOfUserManagerAccess, "setPassword")
+	err := types.DeleteSharedDir(u.DB, uid, fUid, types.CleanPath(param.Dir))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("deduct points failed: " + err.Error()))
+		w.Write([]byte("revoke share failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var param types.CreateShareLinkParam
+	_, uid, ok := u.checkSignedRequest(w, r, "createShareLink", &param)
+	if !ok {
+		return
+	}
+	if param.ExpiredTime < time.Now().UnixNano() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("share link already expired"))
+		return
+	}
+	var tokenBz [16]byte
+	_, err := rand.Read(tokenBz[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = types.UpdateUserPasswordHash(u.DB, user, param.NewPasswordHash)
+	token := hex.EncodeToString(tokenBz[:])
+	remainedDownloads := param.MaxDownloads
+	if remainedDownloads <= 0 {
+		remainedDownloads = -1
+	}
+	var passwordHash []byte
+	if param.PasswordHash != [32]byte{} {
+		passwordHash = utils.HashPassword(param.PasswordHash)
+	}
+	err = types.AddShareLink(u.DB, token, types.ShareLinkInfo{
+		Uid:               uid,
+		ExpiredTime:       param.ExpiredTime,
+		RemainedDownloads: remainedDownloads,
+		PasswordHash:      passwordHash,
+		Path:              types.CleanPath(param.Path),
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("set password failed: " + err.Error()))
+		w.Write([]byte("create share link failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(types.CreateShareLinkRes{
+		Token: token,
+		Url:   "/s/" + token,
+	})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	var param types.RevokeShareLinkParam
+	_, uid, ok := u.checkSignedRequest(w, r, "revokeShareLink", &param)
+	if !ok {
+		return
+	}
+	err := types.DeleteShareLink(u.DB, param.Token, uid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("revoke share link failed: " + err.Error()))
 		return
 	}
 	w.Write([]byte("success"))
 	return
 }
 
-func (u *UserManager) handleShareDir(w http.ResponseWriter, r *http.Request) {
-	var param types.ShareDirParam
-	body, _ := io.ReadAll(r.Body)
-	err := json.Unmarshal(body, &param)
+func (u *UserManager) handleCreateAppPassword(w http.ResponseWriter, r *http.Request) {
+	var param types.CreateAppPasswordParam
+	user, _, ok := u.checkSignedRequest(w, r, "createAppPassword", &param)
+	if !ok {
+		return
+	}
+	if len(param.Label) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("label is empty"))
+		return
+	}
+	var passwordBz [16]byte
+	_, err := rand.Read(passwordBz[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	password := hex.EncodeToString(passwordBz[:])
+	now := time.Now().UnixNano()
+	err = types.AddAppPassword(u.DB, user, sha256.Sum256([]byte(password)), types.AppPasswordInfo{
+		Label:       param.Label,
+		CreatedTime: now,
+		ReadOnly:    param.ReadOnly,
+		Scope:       types.CleanPath(param.Scope),
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("param parsed failed: " + err.Error()))
+		w.Write([]byte("create app password failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(types.CreateAppPasswordRes{
+		Label:    param.Label,
+		Password: password,
+	})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleListAppPasswords(w http.ResponseWriter, r *http.Request) {
+	var param types.ListAppPasswordsParam
+	user, _, ok := u.checkSignedRequest(w, r, "listAppPasswords", &param)
+	if !ok {
 		return
 	}
-	sig := param.Sig
-	param.Sig = nil
-	out, _ := json.Marshal(param)
-	hash := sha256.Sum256(out)
-	user, err := utils.GetAddressAndCheckSig(hash, sig)
+	passwords, err := types.ListAppPasswords(u.DB, user)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user address parsed failed: " + err.Error()))
+		w.Write([]byte("list app passwords failed: " + err.Error()))
 		return
 	}
-	uid := types.GetUID(u.DB, user)
-	if uid < 0 {
+	out, _ := json.Marshal(types.ListAppPasswordsRes{Passwords: passwords})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleRevokeAppPassword(w http.ResponseWriter, r *http.Request) {
+	var param types.RevokeAppPasswordParam
+	user, _, ok := u.checkSignedRequest(w, r, "revokeAppPassword", &param)
+	if !ok {
+		return
+	}
+	err := types.DeleteAppPassword(u.DB, user, param.Label)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("user not register"))
+		w.Write([]byte("revoke app password failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleSetVersioning(w http.ResponseWriter, r *http.Request) {
+	var param types.SetVersioningParam
+	_, uid, ok := u.checkSignedRequest(w, r, "setVersioning", &param)
+	if !ok {
+		return
+	}
+	if param.MaxVersions < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("max versions is negative"))
+		return
+	}
+	err := types.SetVersionedDir(u.DB, uid, types.CleanPath(param.Dir), param.MaxVersions)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("set versioning failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	var param types.ListVersionsParam
+	_, uid, ok := u.checkSignedRequest(w, r, "listVersions", &param)
+	if !ok {
+		return
+	}
+	versions, err := u.versions.List(uid, param.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("list versions failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(types.ListVersionsRes{Versions: versions})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	var param types.RestoreVersionParam
+	user, uid, ok := u.checkSignedRequest(w, r, "restoreVersion", &param)
+	if !ok {
+		return
+	}
+	err := u.versions.Restore(user, uid, param.Path, param.VersionId)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("restore version failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	var param types.ListTrashParam
+	_, uid, ok := u.checkSignedRequest(w, r, "listTrash", &param)
+	if !ok {
+		return
+	}
+	entries, err := u.trash.List(uid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("list trash failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(types.ListTrashRes{Entries: entries})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	var param types.RestoreTrashParam
+	user, uid, ok := u.checkSignedRequest(w, r, "restoreTrash", &param)
+	if !ok {
+		return
+	}
+	err := u.trash.Restore(user, uid, param.DeletedTime)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("restore trash failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func (u *UserManager) handlePurgeTrash(w http.ResponseWriter, r *http.Request) {
+	var param types.PurgeTrashParam
+	user, uid, ok := u.checkSignedRequest(w, r, "purgeTrash", &param)
+	if !ok {
+		return
+	}
+	err := u.trash.Purge(user, uid, param.DeletedTime)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("purge trash failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+const (
+	maxBoostRate  = 1024 * Mega
+	maxBoostHours = 24 * 31
+)
+
+// handleBoostBandwidth adds to the bandwidth limit of the caller for some hours, paid
+// with points. It takes effect on the disk service within TierRefresh.
+func (u *UserManager) handleBoostBandwidth(w http.ResponseWriter, r *http.Request) {
+	var param types.BoostBandwidthParam
+	_, uid, ok := u.checkSignedRequest(w, r, "boostBandwidth", &param)
+	if !ok {
+		return
+	}
+	if param.Rate <= 0 || param.Hours <= 0 || param.Rate > maxBoostRate || param.Hours > maxBoostHours {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("rate or hours out of range"))
+		return
+	}
+	cost := u.cfg.Bandwidth.BoostPrice * ((param.Rate + Mega - 1) / Mega) * param.Hours
+	operation := fmt.Sprintf("Boost bandwidth by %d bytes/s for %d hours", param.Rate, param.Hours)
+	expireTime := time.Now().Add(time.Duration(param.Hours) * time.Hour).UnixNano()
+	err := types.BuyBandwidthBoost(u.DB, uid, param.Rate, expireTime, cost, operation)
+	if errors.Is(err, errNotEnoughPoints) {
+		err = fmt.Errorf("%w: %d points are needed for the boost", err, cost)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("boost bandwidth failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(types.BoostBandwidthRes{Cost: cost, ExpireTime: expireTime})
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleListPlans(w http.ResponseWriter, r *http.Request) {
+	res := types.ListPlansRes{Plans: []types.PlanInfo{}}
+	for _, plan := range u.cfg.Plans {
+		res.Plans = append(res.Plans, types.PlanInfo{
+			Id:       plan.Id,
+			Price:    plan.Price,
+			Blocks:   plan.Blocks,
+			Storage:  plan.Storage,
+			Transfer: plan.Transfer,
+		})
+	}
+	out, _ := json.Marshal(res)
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	var param types.SubscribeParam
+	_, uid, ok := u.checkSignedRequest(w, r, "subscribe", &param)
+	if !ok {
+		return
+	}
+	plan, ok := u.cfg.FindPlan(param.Plan)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("no such plan"))
+		return
+	}
+	height, err := u.chainHeight()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("subscribe failed: " + err.Error()))
+		return
+	}
+	sub, err := u.buyPlan(uid, plan, height, param.AutoRenew, false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("subscribe failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(toSubscriptionRes(sub, height))
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleGetSubscription(w http.ResponseWriter, r *http.Request) {
+	var param types.GetSubscriptionParam
+	_, uid, ok := u.checkSignedRequest(w, r, "getSubscription", &param)
+	if !ok {
+		return
+	}
+	sub, err := types.GetSubscription(u.DB, uid)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("get subscription failed: " + errNoSubscription.Error()))
+		return
+	}
+	var height int64
+	if err == nil {
+		height, err = u.chainHeight()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("get subscription failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(toSubscriptionRes(sub, height))
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleCancelSubscription(w http.ResponseWriter, r *http.Request) {
+	var param types.CancelSubscriptionParam
+	_, uid, ok := u.checkSignedRequest(w, r, "cancelSubscription", &param)
+	if !ok {
+		return
+	}
+	err := u.cancelSubscription(uid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("cancel subscription failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+func toNotificationRule(rule types.WebhookRuleInfo) types.NotificationRule {
+	return types.NotificationRule{
+		Url:       rule.Url,
+		Events:    rule.Events,
+		Threshold: rule.Threshold,
+		Secret:    hex.EncodeToString(rule.Secret[:]),
+	}
+}
+
+func (u *UserManager) handleSetNotification(w http.ResponseWriter, r *http.Request) {
+	var param types.SetNotificationParam
+	_, uid, ok := u.checkSignedRequest(w, r, "setNotification", &param)
+	if !ok {
+		return
+	}
+	if param.Events == 0 || param.Events&^types.NotifyAll != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid events"))
+		return
+	}
+	err := u.checkWebhookUrl(param.Url)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("set notification failed: " + err.Error()))
+		return
+	}
+	rules, err := types.GetWebhookRules(u.DB, uid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("set notification failed: " + err.Error()))
+		return
+	}
+	exists := false
+	for _, rule := range rules {
+		exists = exists || rule.Url == param.Url
+	}
+	if !exists && len(rules) >= u.cfg.Webhooks.MaxRules {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("too many notification rules"))
+		return
+	}
+	rule := types.WebhookRuleInfo{
+		Uid:       uid,
+		Url:       param.Url,
+		Events:    param.Events,
+		Threshold: param.Threshold,
+	}
+	_, err = rand.Read(rule.Secret[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rule, err = types.SetWebhookRule(u.DB, rule)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("set notification failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(toNotificationRule(rule))
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleListNotifications(w http.ResponseWriter, r *http.Request) {
+	var param types.ListNotificationsParam
+	_, uid, ok := u.checkSignedRequest(w, r, "listNotifications", &param)
+	if !ok {
+		return
+	}
+	rules, err := types.GetWebhookRules(u.DB, uid)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("list notifications failed: " + err.Error()))
+		return
+	}
+	res := types.ListNotificationsRes{Rules: []types.NotificationRule{}}
+	for _, rule := range rules {
+		res.Rules = append(res.Rules, toNotificationRule(rule))
+	}
+	out, _ := json.Marshal(res)
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleDeleteNotification(w http.ResponseWriter, r *http.Request) {
+	var param types.DeleteNotificationParam
+	_, uid, ok := u.checkSignedRequest(w, r, "deleteNotification", &param)
+	if !ok {
+		return
+	}
+	err := types.DeleteWebhookRule(u.DB, uid, param.Url)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("delete notification failed: " + err.Error()))
+		return
+	}
+	w.Write([]byte("success"))
+	return
+}
+
+// handleAccount is free and also serves locked users, who need it to learn how to unlock.
+// It accepts the WebDAV credentials of the user as well as a signed request.
+func (u *UserManager) handleAccount(w http.ResponseWriter, r *http.Request) {
+	var user common.Address
+	var uid int64
+	if _, _, ok := r.BasicAuth(); ok {
+		var status int
+		var errStr string
+		user, status, errStr = u.pwAuth.Authenticate(r)
+		if status != 0 {
+			if status == http.StatusUnauthorized {
+				w.Header().Add("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(errStr))
+			return
+		}
+		if !u.addrLimiter.Allow(user[:]) {
+			utils.WriteTooManyRequests(w, u.addrLimiter.RetryAfter())
+			return
+		}
+		uid = types.GetUID(u.DB, user)
+		if uid < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("user not register"))
+			return
+		}
+	} else {
+		var param types.AccountParam
+		user, uid, ok = u.verifySignedRequest(w, r, "account", &param)
+		if !ok {
+			return
+		}
+	}
+	res, err := u.accountInfo(user, uid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("get account failed: " + err.Error()))
+		return
+	}
+	out, _ := json.Marshal(res)
+	w.Write(out)
+	return
+}
+
+func (u *UserManager) handleTransferPoints(w http.ResponseWriter, r *http.Request) {
+	var param types.TransferPointsParam
+	user, uid, ok := u.checkSignedRequest(w, r, "transferPoints", &param)
+	if !ok {
+		return
+	}
+	if param.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid amount"))
+		return
+	}
+	toUid := types.GetUID(u.DB, param.To)
+	if toUid < 0 || toUid == uid {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid receiver"))
+		return
+	}
+	var id [32]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	timestamp, err := types.TransferPoints(u.DB, uid, toUid, param.Amount, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("transfer points failed: " + err.Error()))
+		return
+	}
+	transfer := hex.EncodeToString(id[:])
+	u.notify(toUid, types.NotifyPointsReceived, func(payload *types.NotificationPayload) {
+		payload.Amount = param.Amount
+		payload.From = user.Hex()
+		payload.Transfer = transfer
+	})
+	out, _ := json.Marshal(types.TransferPointsRes{Transfer: transfer, Timestamp: timestamp})
+	w.Write(out)
+	return
+}
+
+// checkSignedRequest verifies the SignedRequest in the body of r for action and decodes
+// its params into param. It makes sure the signer is a registered and unlocked user, uses
+// up the nonce of the request, and charges the access fee for action. It writes the error
+// response itself and returns ok=false on failure.
+func (u *UserManager) checkSignedRequest(w http.ResponseWriter, r *http.Request, action string,
+	param any) (user common.Address, uid int64, ok bool) {
+	user, uid, ok = u.verifySignedRequest(w, r, action, param)
+	if !ok {
 		return
 	}
 	isLocked, _, err := types.IsUserLock(u.DB, uid)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("get user lock status error" + err.Error()))
-		return
+		return user, uid, false
 	}
 	if isLocked {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("user is locked"))
-		return
+		return user, uid, false
 	}
-	err = types.ConsumePoints(u.DB, uid, types.PointsOfUserManagerAccess, "shareDir")
+	err = types.ConsumePoints(u.DB, uid, types.PointsOfUserManagerAccess, action)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("deduct points failed: " + err.Error()))
+		return user, uid, false
+	}
+	return user, uid, true
+}
+
+// verifySignedRequest is checkSignedRequest without the lock check and the access fee,
+// for the requests locked users can make
+func (u *UserManager) verifySignedRequest(w http.ResponseWriter, r *http.Request, action string,
+	param any) (user common.Address, uid int64, ok bool) {
+	user, ok = u.parseSignedRequest(w, r, action, param)
+	if !ok {
 		return
 	}
-	fUid := types.GetUID(u.DB, param.Friend)
-	if fUid < 0 {
-		fUid = types.AddressToUID(u.DB, param.Friend)
-		err = types.AddNewUser(u.DB, param.Friend, fUid, param.PasswordHash)
+	uid = types.GetUID(u.DB, user)
+	if uid < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("user not register"))
+		return user, uid, false
+	}
+	return user, uid, true
+}
+
+// parseSignedRequest verifies the SignedRequest in the body of r for action, decodes its
+// params into param and uses up its nonce, and returns the signer, which may not be
+// registered yet
+func (u *UserManager) parseSignedRequest(w http.ResponseWriter, r *http.Request, action string,
+	param any) (user common.Address, ok bool) {
+	var req types.SignedRequest
+	body, _ := io.ReadAll(r.Body)
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("param parsed failed: " + err.Error()))
+		return
+	}
+	if req.Action != action || req.ChainId != u.cfg.ChainId {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the request is signed for another action or chain"))
+		return
+	}
+	now := time.Now().UnixNano()
+	if req.Expiry < now || req.Expiry > now+int64(maxSignedRequestLifetime) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the request is expired or its expiry is too far"))
+		return
+	}
+	if len(req.Params) != 0 {
+		err = json.Unmarshal(req.Params, param)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("add new user failed: " + err.Error()))
+			w.Write([]byte("param parsed failed: " + err.Error()))
 			return
 		}
 	}
-	err = types.UpdateSharedDir(u.DB, uid, fUid, param.Dir, param.ExpiredTime)
+	hash, err := req.SigningHash()
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("share directory failed: " + err.Error()))
+		w.Write([]byte("signing hash failed: " + err.Error()))
 		return
 	}
-	w.Write([]byte("success"))
-	return
+	user, err = utils.GetAddressAndCheckSig(hash, req.Sig)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("user address parsed failed: " + err.Error()))
+		return
+	}
+	if !u.addrLimiter.Allow(user[:]) {
+		utils.WriteTooManyRequests(w, u.addrLimiter.RetryAfter())
+		return
+	}
+	err = types.UseNonce(u.DB, user, req.Nonce, req.Expiry)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("use nonce failed: " + err.Error()))
+		return
+	}
+	return user, true
 }
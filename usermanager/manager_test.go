@@ -0,0 +1,284 @@
+package usermanager
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+type testSigner struct {
+	key   *ecdsa.PrivateKey
+	addr  common.Address
+	nonce uint64
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}
+}
+
+// signRequest returns the body of a request for action signed by s with a new nonce,
+// after letting change modify it
+func (s *testSigner) signRequest(t *testing.T, u *UserManager, action string, params any,
+	change func(req *types.SignedRequest)) []byte {
+	bz, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.nonce++
+	req := types.SignedRequest{
+		Action:  action,
+		Params:  bz,
+		ChainId: u.cfg.ChainId,
+		Expiry:  time.Now().Add(10 * time.Minute).UnixNano(),
+		Nonce:   s.nonce,
+	}
+	if change != nil {
+		change(&req)
+	}
+	hash, err := req.SigningHash()
+	if err == nil {
+		req.Sig, err = crypto.Sign(hash[:], s.key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func post(handler http.HandlerFunc, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return w
+}
+
+func (s *testSigner) register(t *testing.T, u *UserManager, uid int64) {
+	err := types.AddNewUser(u.DB, s.addr, uid, [32]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setBalance(t *testing.T, u *UserManager, uid, balance int64) {
+	err := u.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{types.RemainedPoints}, utils.Int64ToBytes(uid)...), utils.Int64ToBytes(balance))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type transferRecord struct {
+	timestamp, amount int64
+	id                string
+}
+
+// transferRecords returns the finalized AddPoints records of uid
+func transferRecords(t *testing.T, u *UserManager, uid int64) []transferRecord {
+	var records []transferRecord
+	prefix := append(append([]byte{types.AddPoints}, utils.Int64ToBytes(uid)...), types.TxFinalized)
+	err := u.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k := it.Item().Key()
+			err := it.Item().Value(func(v []byte) error {
+				records = append(records, transferRecord{
+					timestamp: utils.BytesToInt64(k[len(prefix):]),
+					amount:    utils.BytesToInt64(v[:8]),
+					id:        hex.EncodeToString(v[8:]),
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestTransferPoints(t *testing.T) {
+	u := newTestManager(t)
+	alice, bob, carol := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	const aliceUid, bobUid, fee = 1, 2, types.PointsOfUserManagerAccess
+	alice.register(t, u, aliceUid)
+	// bob was added by a share, and never had points
+	bob.register(t, u, bobUid)
+	setBalance(t, u, aliceUid, 1000)
+
+	transfer := func(to common.Address, amount int64) *httptest.ResponseRecorder {
+		body := alice.signRequest(t, u, "transferPoints", types.TransferPointsParam{To: to, Amount: amount}, nil)
+		return post(u.handleTransferPoints, body)
+	}
+	for _, c := range []struct {
+		name   string
+		to     common.Address
+		amount int64
+		errStr string
+	}{
+		{"insufficient balance", bob.addr, 1000, types.ErrNotEnoughPoints.Error()},
+		{"self-transfer", alice.addr, 10, "invalid receiver"},
+		{"unregistered receiver", carol.addr, 10, "invalid receiver"},
+		{"zero amount", bob.addr, 0, "invalid amount"},
+	} {
+		before := balanceOf(t, u, aliceUid)
+		w := transfer(c.to, c.amount)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), c.errStr) {
+			t.Errorf("%s: status %d, %s", c.name, w.Code, w.Body.String())
+		}
+		// only the access fee is charged
+		if balanceOf(t, u, aliceUid) != before-fee || balanceOf(t, u, bobUid) != 0 {
+			t.Errorf("%s: balances %d and %d", c.name, balanceOf(t, u, aliceUid), balanceOf(t, u, bobUid))
+		}
+	}
+	if len(transferRecords(t, u, aliceUid)) != 0 || len(transferRecords(t, u, bobUid)) != 0 {
+		t.Error("the failed transfers were recorded")
+	}
+
+	// both records of a transfer share its id and its timestamp
+	setBalance(t, u, aliceUid, 1000)
+	body := alice.signRequest(t, u, "transferPoints", types.TransferPointsParam{To: bob.addr, Amount: 300}, nil)
+	w := post(u.handleTransferPoints, body)
+	var res types.TransferPointsRes
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &res) != nil {
+		t.Fatalf("transfer: status %d, %s", w.Code, w.Body.String())
+	}
+	if balanceOf(t, u, aliceUid) != 1000-fee-300 || balanceOf(t, u, bobUid) != 300 {
+		t.Errorf("balances %d and %d after the transfer", balanceOf(t, u, aliceUid), balanceOf(t, u, bobUid))
+	}
+	for _, c := range []struct {
+		uid    int64
+		amount int64
+	}{{aliceUid, -300}, {bobUid, 300}} {
+		records := transferRecords(t, u, c.uid)
+		if len(records) != 1 || records[0] != (transferRecord{res.Timestamp, c.amount, res.Transfer}) {
+			t.Errorf("records of uid %d: %+v, want %s at %d", c.uid, records, res.Transfer, res.Timestamp)
+		}
+	}
+
+	// the same signed request is not served twice
+	w = post(u.handleTransferPoints, body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), types.ErrNonceUsed.Error()) {
+		t.Errorf("replayed transfer: status %d, %s", w.Code, w.Body.String())
+	}
+	if balanceOf(t, u, aliceUid) != 1000-fee-300 || balanceOf(t, u, bobUid) != 300 {
+		t.Errorf("balances %d and %d after the replay", balanceOf(t, u, aliceUid), balanceOf(t, u, bobUid))
+	}
+}
+
+func TestTransferToLockedUser(t *testing.T) {
+	u := newTestManager(t)
+	const fromUid, toUid, locked = 1, 2, -1_000_000
+	setBalance(t, u, fromUid, 2_000_000)
+	setBalance(t, u, toUid, locked)
+	var id [32]byte
+	// a transfer must unlock the receiver, as a payment does
+	_, err := types.TransferPoints(u.DB, fromUid, toUid, -locked, id)
+	if err != types.ErrStillLocked || balanceOf(t, u, fromUid) != 2_000_000 || balanceOf(t, u, toUid) != locked {
+		t.Errorf("transfer leaving the receiver locked: %v, balances %d and %d",
+			err, balanceOf(t, u, fromUid), balanceOf(t, u, toUid))
+	}
+	_, err = types.TransferPoints(u.DB, fromUid, toUid, -locked+1, id)
+	if err != nil || balanceOf(t, u, fromUid) != 999_999 || balanceOf(t, u, toUid) != 1 {
+		t.Errorf("transfer unlocking the receiver: %v, balances %d and %d",
+			err, balanceOf(t, u, fromUid), balanceOf(t, u, toUid))
+	}
+	// a receiver above the lock threshold may stay negative
+	setBalance(t, u, toUid, locked+1)
+	_, err = types.TransferPoints(u.DB, fromUid, toUid, 1, id)
+	if err != nil || balanceOf(t, u, toUid) != locked+2 {
+		t.Errorf("transfer to a user in debt: %v, balance %d", err, balanceOf(t, u, toUid))
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	u := newTestManager(t)
+	alice := newTestSigner(t)
+	const uid = 1
+	alice.register(t, u, uid)
+	setBalance(t, u, uid, 1000)
+	list := func(change func(req *types.SignedRequest)) *httptest.ResponseRecorder {
+		body := alice.signRequest(t, u, "listAppPasswords", types.ListAppPasswordsParam{}, change)
+		return post(u.handleListAppPasswords, body)
+	}
+	for _, c := range []struct {
+		name   string
+		change func(req *types.SignedRequest)
+		errStr string
+	}{
+		{"eip712", nil, ""},
+		{"eip712 by name", func(req *types.SignedRequest) { req.SigType = types.SigTypeEIP712 }, ""},
+		{"eip191", func(req *types.SignedRequest) { req.SigType = types.SigTypeEIP191 }, ""},
+		{"expired", func(req *types.SignedRequest) { req.Expiry = time.Now().Add(-time.Second).UnixNano() }, "expired"},
+		{"expiry too far", func(req *types.SignedRequest) {
+			req.Expiry = time.Now().Add(maxSignedRequestLifetime + time.Minute).UnixNano()
+		}, "too far"},
+		{"another chain", func(req *types.SignedRequest) { req.ChainId++ }, "another action or chain"},
+		{"another action", func(req *types.SignedRequest) { req.Action = "revokeAppPassword" }, "another action or chain"},
+	} {
+		before := balanceOf(t, u, uid)
+		w := list(c.change)
+		if c.errStr == "" {
+			if w.Code != http.StatusOK || balanceOf(t, u, uid) != before-types.PointsOfUserManagerAccess {
+				t.Errorf("%s: status %d, %s, charged %d", c.name, w.Code, w.Body.String(), before-balanceOf(t, u, uid))
+			}
+			continue
+		}
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), c.errStr) || balanceOf(t, u, uid) != before {
+			t.Errorf("%s: status %d, %s, charged %d", c.name, w.Code, w.Body.String(), before-balanceOf(t, u, uid))
+		}
+	}
+
+	// a request is served once, whatever the signature type
+	for _, sigType := range []string{types.SigTypeEIP712, types.SigTypeEIP191} {
+		body := alice.signRequest(t, u, "listAppPasswords", types.ListAppPasswordsParam{},
+			func(req *types.SignedRequest) { req.SigType = sigType })
+		if w := post(u.handleListAppPasswords, body); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, %s", sigType, w.Code, w.Body.String())
+		}
+		w := post(u.handleListAppPasswords, body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), types.ErrNonceUsed.Error()) {
+			t.Errorf("replayed %s request: status %d, %s", sigType, w.Code, w.Body.String())
+		}
+	}
+
+	// the signature covers the params, changing them changes the signer
+	body := alice.signRequest(t, u, "transferPoints", types.TransferPointsParam{To: alice.addr, Amount: 1}, nil)
+	var req types.SignedRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Params, _ = json.Marshal(types.TransferPointsParam{To: common.Address{1}, Amount: 1000})
+	body, _ = json.Marshal(req)
+	before := balanceOf(t, u, uid)
+	w := post(u.handleTransferPoints, body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not register") || balanceOf(t, u, uid) != before {
+		t.Errorf("tampered params: status %d, %s", w.Code, w.Body.String())
+	}
+}
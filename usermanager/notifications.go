@@ -0,0 +1,372 @@
+package usermanager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// The notifications of a user are posted to the webhooks it configured with
+// /notifications/set. Each payload is queued in the database and posted until a webhook
+// answers with a 2xx status, so the notifications survive restarts and outages of the
+// webhooks. The balance events are found by checking the balances periodically, and
+// are sent once each time the balance crosses the limit.
+
+var eventNames = map[byte]string{
+	types.NotifyLowBalance:       "lowBalance",
+	types.NotifyLocked:           "locked",
+	types.NotifyPaymentConfirmed: "paymentConfirmed",
+	types.NotifyShareReceived:    "shareReceived",
+	types.NotifyPointsReceived:   "pointsReceived",
+}
+
+var errPrivateAddr = errors.New("the webhook must be on a globally reachable address")
+
+// specialPurposePrefixes are the blocks of the IANA special-purpose address registries
+// which are not globally reachable, with the blocks embedding IPv4 addresses, like those
+// of NAT64, 6to4 and Teredo, through which the internal IPv4 addresses could be reached
+var specialPurposePrefixes = mustParsePrefixes(
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // shared address space (CGNAT)
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.31.196.0/24", // AS112
+	"192.52.193.0/24", // AMT
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"192.175.48.0/24", // AS112
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved, and the limited broadcast
+	"::/96",           // unspecified, loopback and IPv4-compatible
+	"::ffff:0:0/96",   // IPv4-mapped
+	"64:ff9b::/96",    // NAT64
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard-only
+	"2001::/23",       // IETF protocol assignments, with Teredo
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4
+	"3fff::/20",       // documentation
+	"5f00::/16",       // segment routing
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link local
+	"fec0::/10",       // site local
+	"ff00::/8",        // multicast
+)
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	res := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		res[i] = netip.MustParsePrefix(p)
+	}
+	return res
+}
+
+// isPublicAddr reports whether a webhook may be posted to ip, which must not reach the
+// host itself or the services of its network
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range specialPurposePrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns the client posting to the webhooks. The addresses are checked
+// as they are dialed, after the host names are resolved, so that a name which is resolved
+// to a private address after the webhook is set cannot reach the host either.
+func newWebhookClient(c config.WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	if !c.AllowPrivateAddrs {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addr.Addr()) {
+				return errPrivateAddr
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		// no proxy is used, which would dial the webhooks in place of the dialer
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: c.Timeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: c.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkWebhookUrl makes sure rawUrl can be posted to. The host names are only checked as
+// they are dialed.
+func (u *UserManager) checkWebhookUrl(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if parsed.Host == "" || (parsed.Scheme != "https" && !(parsed.Scheme == "http" && u.cfg.Webhooks.AllowHTTP)) {
+		return errors.New("the webhook must be an https url")
+	}
+	ip, err := netip.ParseAddr(parsed.Hostname())
+	if err == nil && !isPublicAddr(ip) && !u.cfg.Webhooks.AllowPrivateAddrs {
+		return errPrivateAddr
+	}
+	return nil
+}
+
+// queueNotification queues payload for the webhook of rule
+func (u *UserManager) queueNotification(rule types.WebhookRuleInfo, payload types.NotificationPayload) error {
+	id := utils.GetTimestamp()
+	payload.Id = id
+	out, _ := json.Marshal(payload)
+	return types.AddWebhookDelivery(u.DB, types.WebhookDelivery{
+		Id:       id,
+		NextTime: time.Now().UnixNano(),
+		Uid:      rule.Uid,
+		Url:      rule.Url,
+		Payload:  out,
+	})
+}
+
+// newPayload returns the payload of event for uid, with its current balance
+func (u *UserManager) newPayload(uid int64, event byte, balance int64) (types.NotificationPayload, error) {
+	addr, err := types.GetAddressByUID(u.DB, uid)
+	if err != nil {
+		return types.NotificationPayload{}, err
+	}
+	return types.NotificationPayload{
+		Event:     eventNames[event],
+		Address:   addr,
+		Timestamp: time.Now().UnixNano(),
+		Balance:   balance,
+	}, nil
+}
+
+// notify queues event for the webhooks of uid which want it, with the fields specific to
+// the event set by fill
+func (u *UserManager) notify(uid int64, event byte, fill func(payload *types.NotificationPayload)) {
+	rules, err := types.GetWebhookRules(u.DB, uid)
+	if err != nil {
+		log.Printf("Error in GetWebhookRules: %s\n", err.Error())
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+	_, balance, err := types.IsUserLock(u.DB, uid)
+	var payload types.NotificationPayload
+	if err == nil {
+		payload, err = u.newPayload(uid, event, balance)
+	}
+	if err != nil {
+		log.Printf("Error in notifying uid %d: %s\n", uid, err.Error())
+		return
+	}
+	fill(&payload)
+	for _, rule := range rules {
+		if rule.Events&event == 0 {
+			continue
+		}
+		err = u.queueNotification(rule, payload)
+		if err != nil {
+			log.Printf("Error in queueNotification: %s\n", err.Error())
+		}
+	}
+}
+
+// checkBalances notifies the webhooks which want to know the balance fell below their
+// threshold or the account is locked, and re-arms them once the balance recovers
+func (u *UserManager) checkBalances() {
+	rules, err := types.GetWebhookRules(u.DB, -1)
+	if err != nil {
+		log.Printf("Error in GetWebhookRules: %s\n", err.Error())
+		return
+	}
+	for _, rule := range rules {
+		if rule.Events&(types.NotifyLowBalance|types.NotifyLocked) == 0 {
+			continue
+		}
+		isLocked, balance, err := types.IsUserLock(u.DB, rule.Uid)
+		if err != nil {
+			log.Printf("Error in IsUserLock: %s\n", err.Error())
+			continue
+		}
+		fired := rule.Fired
+		for _, check := range []struct {
+			event byte
+			cond  bool
+		}{
+			{types.NotifyLowBalance, balance < rule.Threshold},
+			{types.NotifyLocked, isLocked},
+		} {
+			if !check.cond {
+				fired &^= check.event
+				continue
+			}
+			if rule.Events&check.event == 0 || fired&check.event != 0 {
+				continue
+			}
+			payload, err := u.newPayload(rule.Uid, check.event, balance)
+			if err == nil {
+				err = u.queueNotification(rule, payload)
+			}
+			if err != nil {
+				log.Printf("Error in notifying uid %d: %s\n", rule.Uid, err.Error())
+				continue
+			}
+			fired |= check.event
+		}
+		if fired != rule.Fired {
+			err = types.SetWebhookFired(u.DB, rule.Uid, rule.Url, fired)
+			if err != nil {
+				log.Printf("Error in SetWebhookFired: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// postWebhook posts the payload of d signed with secret, and fails unless the webhook
+// answers with a 2xx status
+func (u *UserManager) postWebhook(d types.WebhookDelivery, secret [32]byte) error {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, d.Url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cashdisk-Signature", hex.EncodeToString(mac.Sum(nil)))
+	res, err := u.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("the webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// deliverWebhooks posts the queued notifications which are due at now, up to Concurrency
+// at once, and returns once they are all posted
+func (u *UserManager) deliverWebhooks(now time.Time) {
+	deliveries, err := types.GetDueWebhookDeliveries(u.DB, now.UnixNano(), 100)
+	if err != nil {
+		log.Printf("Error in GetDueWebhookDeliveries: %s\n", err.Error())
+		return
+	}
+	concurrency := u.cfg.Webhooks.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(d types.WebhookDelivery) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			u.deliverWebhook(d, now)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// deliverWebhook posts d, which is scheduled for its next attempt before it is posted and
+// removed from the queue once it is delivered, so that it is retried even if the user
+// manager stops while it is posted. The notifications of a removed rule are dropped.
+func (u *UserManager) deliverWebhook(d types.WebhookDelivery, now time.Time) {
+	rules, err := types.GetWebhookRules(u.DB, d.Uid)
+	if err != nil {
+		log.Printf("Error in GetWebhookRules: %s\n", err.Error())
+		return
+	}
+	var rule *types.WebhookRuleInfo
+	for i := range rules {
+		if rules[i].Url == d.Url {
+			rule = &rules[i]
+		}
+	}
+	if rule == nil {
+		err = types.DeleteWebhookDelivery(u.DB, d)
+		if err != nil {
+			log.Printf("Error in DeleteWebhookDelivery: %s\n", err.Error())
+		}
+		return
+	}
+	attempts := d.Attempts + 1
+	last := attempts >= u.cfg.Webhooks.MaxAttempts
+	if !last {
+		next := d
+		next.Attempts = attempts
+		next.NextTime = now.Add(u.cfg.Webhooks.RetryDelay << (attempts - 1)).UnixNano()
+		err = types.RescheduleWebhookDelivery(u.DB, d, next)
+		if err != nil {
+			log.Printf("Error in RescheduleWebhookDelivery: %s\n", err.Error())
+			return
+		}
+		d = next
+	}
+	err = u.postWebhook(d, rule.Secret)
+	if err != nil && !last {
+		return
+	}
+	if err != nil {
+		log.Printf("Notification %d to %s dropped after %d attempts: %s\n", d.Id, d.Url, attempts, err.Error())
+	}
+	err = types.DeleteWebhookDelivery(u.DB, d)
+	if err != nil {
+		log.Printf("Error in DeleteWebhookDelivery: %s\n", err.Error())
+	}
+}
+
+func (u *UserManager) StartWebhookRoutine() {
+	var lastCheck time.Time
+	for {
+		if time.Since(lastCheck) >= u.cfg.Webhooks.CheckInterval {
+			lastCheck = time.Now()
+			u.checkBalances()
+		}
+		u.deliverWebhooks(time.Now())
+		time.Sleep(5 * time.Second)
+	}
+}
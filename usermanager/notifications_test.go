@@ -0,0 +1,114 @@
+package usermanager
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+func TestCheckWebhookUrl(t *testing.T) {
+	u := newTestManager(t)
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/hook", true},
+		{"https://8.8.8.8/hook", true},
+		{"http://example.com/hook", false},
+		{"https://127.0.0.1/hook", false},
+		{"https://[::1]/hook", false},
+		{"https://10.1.2.3/hook", false},
+		{"https://192.168.0.1/hook", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://[fe80::1]/hook", false},
+		{"https://[::ffff:127.0.0.1]/hook", false},
+		{"https://0.0.0.0/hook", false},
+	}
+	for _, c := range cases {
+		if err := u.checkWebhookUrl(c.url); (err == nil) != c.ok {
+			t.Errorf("checkWebhookUrl(%s) = %v", c.url, err)
+		}
+	}
+}
+
+func TestWebhookClientRejectsPrivateAddrs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a webhook on a loopback address was posted to")
+	}))
+	defer server.Close()
+	u := newTestManager(t)
+	client := newWebhookClient(u.cfg.Webhooks)
+	// a name resolved to a private address is caught too, as it is dialed
+	urls := []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)}
+	for _, host := range []string{
+		"0.1.2.3", "10.0.0.1", "100.64.0.1", "100.100.100.200", "127.0.0.2", "169.254.169.254",
+		"172.16.0.1", "192.0.0.170", "192.168.1.1", "198.18.0.1", "224.0.0.1", "255.255.255.255",
+		"[::1]", "[::]", "[::ffff:10.0.0.1]", "[::10.0.0.1]", "[64:ff9b::a9fe:a9fe]", "[64:ff9b:1::a00:1]",
+		"[2001:0:4136:e378:8000:63bf:3fff:fdd2]", "[2002:a00:1::1]", "[fc00::1]", "[fd00:ec2::254]",
+		"[fe80::1]", "[fec0::1]", "[ff02::1]",
+	} {
+		urls = append(urls, "http://"+host+":8080/hook")
+	}
+	for _, url := range urls {
+		_, err := client.Post(url, "application/json", nil)
+		if !errors.Is(err, errPrivateAddr) {
+			t.Errorf("posting to %s: %v", url, err)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "1.1.1.1", "100.128.0.1", "2606:4700:4700::1111", "2001:4860:4860::8888"} {
+		if !isPublicAddr(netip.MustParseAddr(addr)) {
+			t.Errorf("%s is not taken as a public address", addr)
+		}
+	}
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	u := newTestManager(t)
+	u.cfg.Webhooks.AllowHTTP = true
+	u.cfg.Webhooks.AllowPrivateAddrs = true
+	u.webhookClient = newWebhookClient(u.cfg.Webhooks)
+	now := time.Now()
+	retry := now.Add(u.cfg.Webhooks.RetryDelay)
+
+	var posts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the delivery is already scheduled for its retry while it is posted
+		n := posts.Add(1)
+		queued, err := types.GetDueWebhookDeliveries(u.DB, now.Add(time.Hour).UnixNano(), 10)
+		if err != nil || len(queued) != 1 || queued[0].Attempts != int(n) {
+			t.Errorf("queued while posted: %+v, %v", queued, err)
+		}
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	_, err := types.SetWebhookRule(u.DB, types.WebhookRuleInfo{Uid: 1, Url: server.URL, Events: types.NotifyLocked})
+	if err == nil {
+		err = types.AddWebhookDelivery(u.DB, types.WebhookDelivery{Id: 1, NextTime: now.UnixNano(), Uid: 1,
+			Url: server.URL, Payload: []byte("{}")})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.deliverWebhooks(now)
+	queued, err := types.GetDueWebhookDeliveries(u.DB, retry.UnixNano(), 10)
+	if err != nil || len(queued) != 1 || queued[0].Attempts != 1 {
+		t.Fatalf("queued after a failure: %+v, %v", queued, err)
+	}
+
+	// the retry succeeds and is removed from the queue
+	u.deliverWebhooks(retry)
+	queued, err = types.GetDueWebhookDeliveries(u.DB, retry.Add(time.Hour).UnixNano(), 10)
+	if err != nil || len(queued) != 0 || posts.Load() != 2 {
+		t.Errorf("queued after %d posts: %+v, %v", posts.Load(), queued, err)
+	}
+}
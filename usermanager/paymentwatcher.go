@@ -1,6 +1,7 @@
 package usermanager
 
 import (
+	"log"
 	"time"
 
 	"github.com/gcash/bchd/chaincfg/chainhash"
@@ -28,12 +29,19 @@ func (u *UserManager) StartPaymentWatcher() {
 				// pending tx is finalized, update db
 				err := types.UpdateAddPointRecord(u.DB, p.Uid, p.Timestamp, types.TxFinalized, p.Txid, p.Value)
 				if err != nil {
-					panic(err)
+					log.Printf("Error in UpdateAddPointRecord: %s\n", err.Error())
+					stillPendingTxInfos = append(stillPendingTxInfos, p)
+					continue
 				}
 				err = types.UpdatePoints(u.DB, p.Uid, p.Value)
 				if err != nil {
-					panic(err)
+					log.Printf("Error in crediting %d points to uid %d: %s\n", p.Value, p.Uid, err.Error())
+					continue
 				}
+				u.notify(p.Uid, types.NotifyPaymentConfirmed, func(payload *types.NotificationPayload) {
+					payload.Amount = p.Value
+					payload.Txid = hash.String()
+				})
 			} else if p.Timestamp > int64(now)+timeToMakeTxDead {
 				// pending tx is dead, update db
 				err := types.UpdateAddPointRecord(u.DB, p.Uid, p.Timestamp, types.TxDead, p.Txid, p.Value)
@@ -0,0 +1,50 @@
+package usermanager
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+func TestPaymentsDuringCharges(t *testing.T) {
+	u := newTestManager(t)
+	const uid = 1
+	err := types.RefundPoints(u.DB, uid, 100, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- types.UpdatePoints(u.DB, uid, 10)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- types.ConsumePoints(u.DB, uid, 1, "test")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance := balanceOf(t, u, uid); balance != 100+100*10-100 {
+		t.Errorf("balance %d after the concurrent changes", balance)
+	}
+
+	// a payment is credited to a user in debt, even if it does not cover the debt
+	err = types.ConsumePoints(u.DB, uid, 2000, "test")
+	if err == nil {
+		t.Fatal("consumed more points than the balance")
+	}
+	err = types.UpdatePoints(u.DB, uid, 10)
+	if err != nil || balanceOf(t, u, uid) != 1000-2000+10 {
+		t.Errorf("crediting a user in debt: %v with %d points", err, balanceOf(t, u, uid))
+	}
+}
@@ -0,0 +1,121 @@
+package usermanager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+)
+
+var (
+	errNoSubscription  = errors.New("no subscription")
+	errNotEnoughPoints = types.ErrNotEnoughPoints
+	errRenewed         = errors.New("the subscription is already renewed")
+)
+
+// chainHeight returns the height of the latest block, as seen by the disk service
+func (u *UserManager) chainHeight() (int64, error) {
+	height, err := types.GetChainHeight(u.DB)
+	if err != nil || height != 0 {
+		return height, err
+	}
+	height, err = u.bchClient.GetBlockCount()
+	if err != nil {
+		return 0, err
+	}
+	return height, types.SetChainHeight(u.DB, height)
+}
+
+// buyPlan makes uid pay for a period of plan starting at height. An active subscription
+// to the same plan is extended by the period instead, with the transfer of the period
+// added to what remains. Another plan can only be bought once the current one expires.
+// A renewal fails with errRenewed if the subscription is active again.
+func (u *UserManager) buyPlan(uid int64, plan config.Plan, height int64, autoRenew, renewal bool) (
+	info types.SubscriptionInfo, err error) {
+	err = types.BuySubscription(u.DB, uid, plan.Price, func(sub *types.SubscriptionInfo) (string, error) {
+		active := sub.ActiveAt(height)
+		if active && renewal {
+			return "", errRenewed
+		}
+		if active && sub.PlanId != plan.Id {
+			return "", fmt.Errorf("already subscribed to the plan %s until block %d", sub.PlanId, sub.EndHeight)
+		}
+		if active {
+			sub.EndHeight += plan.Blocks
+			sub.Transfer += plan.Transfer
+		} else {
+			*sub = types.SubscriptionInfo{
+				Uid:         uid,
+				PlanId:      plan.Id,
+				StartHeight: height,
+				EndHeight:   height + plan.Blocks,
+				Storage:     plan.Storage,
+				Transfer:    plan.Transfer,
+			}
+		}
+		sub.AutoRenew = autoRenew
+		info = *sub
+		return fmt.Sprintf("Subscribe to the plan %s until block %d", plan.Id, sub.EndHeight), nil
+	})
+	if errors.Is(err, errNotEnoughPoints) {
+		err = fmt.Errorf("%w: %d points are needed for the plan %s", errNotEnoughPoints, plan.Price, plan.Id)
+	}
+	return info, err
+}
+
+// renewSubscriptions renews the expired subscriptions which are renewed automatically,
+// from the points of their users. The automatic renewal is stopped if a user does not
+// have enough points.
+func (u *UserManager) renewSubscriptions(height int64) {
+	subs, err := types.GetSubscriptions(u.DB)
+	if err != nil {
+		log.Printf("Error in GetSubscriptions: %s\n", err.Error())
+		return
+	}
+	for _, sub := range subs {
+		if !sub.AutoRenew || height < sub.EndHeight {
+			continue
+		}
+		plan, ok := u.cfg.FindPlan(sub.PlanId)
+		if !ok {
+			log.Printf("The plan %s of uid %d is no longer sold\n", sub.PlanId, sub.Uid)
+			err = u.cancelSubscription(sub.Uid)
+		} else {
+			_, err = u.buyPlan(sub.Uid, plan, height, true, true)
+			if errors.Is(err, errNotEnoughPoints) {
+				log.Printf("The subscription of uid %d is not renewed: %s\n", sub.Uid, err.Error())
+				err = u.cancelSubscription(sub.Uid)
+			}
+		}
+		if err != nil && err != errRenewed {
+			log.Printf("Error in renewing the subscription of uid %d: %s\n", sub.Uid, err.Error())
+		}
+	}
+}
+
+// cancelSubscription stops the automatic renewal of the subscription of uid, which lasts
+// until its end
+func (u *UserManager) cancelSubscription(uid int64) error {
+	return types.UpdateSubscription(u.DB, uid, func(sub *types.SubscriptionInfo) error {
+		if sub.PlanId == "" {
+			return errNoSubscription
+		}
+		sub.AutoRenew = false
+		return nil
+	})
+}
+
+func toSubscriptionRes(sub types.SubscriptionInfo, height int64) types.SubscriptionRes {
+	return types.SubscriptionRes{
+		Plan:             sub.PlanId,
+		StartHeight:      sub.StartHeight,
+		EndHeight:        sub.EndHeight,
+		Storage:          sub.Storage,
+		Transfer:         sub.Transfer,
+		RemainedTransfer: sub.RemainedTransfer() * 1024,
+		AutoRenew:        sub.AutoRenew,
+		Active:           sub.ActiveAt(height),
+	}
+}
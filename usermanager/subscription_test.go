@@ -0,0 +1,105 @@
+package usermanager
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+)
+
+func newTestManager(t *testing.T) *UserManager {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	cfg := config.DefaultConfig()
+	return &UserManager{cfg: cfg, DB: db, addrLimiter: newRateLimiter(cfg.UserManagerConfig.AddressRateLimit)}
+}
+
+func balanceOf(t *testing.T, u *UserManager, uid int64) int64 {
+	_, balance, err := types.IsUserLock(u.DB, uid)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestBuyPlan(t *testing.T) {
+	u := newTestManager(t)
+	plan, _ := u.cfg.FindPlan("basic")
+	const uid = 1
+	err := types.RefundPoints(u.DB, uid, plan.Price+1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := u.buyPlan(uid, plan, 100, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.EndHeight != 100+plan.Blocks || balanceOf(t, u, uid) != 1 {
+		t.Errorf("bought until %d with %d points left", sub.EndHeight, balanceOf(t, u, uid))
+	}
+
+	// neither the subscription nor the balance change without enough points
+	_, err = u.buyPlan(uid, plan, 200, true, false)
+	if !errors.Is(err, errNotEnoughPoints) {
+		t.Fatalf("buying without enough points: %v", err)
+	}
+	sub, err = types.GetSubscription(u.DB, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.EndHeight != 100+plan.Blocks || sub.AutoRenew || balanceOf(t, u, uid) != 1 {
+		t.Errorf("the failed purchase changed the subscription to %+v with %d points left", sub, balanceOf(t, u, uid))
+	}
+
+	// nor do they when the subscription cannot be extended
+	pro, _ := u.cfg.FindPlan("pro")
+	err = types.RefundPoints(u.DB, uid, pro.Price, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = u.buyPlan(uid, pro, 200, false, false)
+	if err == nil || errors.Is(err, errNotEnoughPoints) || balanceOf(t, u, uid) != pro.Price+1 {
+		t.Errorf("buying another plan: %v with %d points left", err, balanceOf(t, u, uid))
+	}
+}
+
+func TestConcurrentBoosts(t *testing.T) {
+	u := newTestManager(t)
+	const uid, price, rate = 1, 100, Mega
+	err := types.RefundPoints(u.DB, uid, 3*price, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireTime := time.Now().Add(time.Hour).UnixNano()
+	var wg sync.WaitGroup
+	var bought atomic.Int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := types.BuyBandwidthBoost(u.DB, uid, rate, expireTime, price, "test")
+			if err == nil {
+				bought.Add(1)
+			} else if !errors.Is(err, errNotEnoughPoints) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	boost, err := types.GetBandwidthBoost(u.DB, uid, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bought.Load() != 3 || boost != 3*rate || balanceOf(t, u, uid) != 0 {
+		t.Errorf("%d boosts bought for a boost of %d, with %d points left", bought.Load(), boost, balanceOf(t, u, uid))
+	}
+}
@@ -3,20 +3,29 @@ package utils
 import (
 	"crypto/sha256"
 	"encoding/binary"
-	"sync"
 	"sync/atomic"
 )
 
+// BloomLimiter counts the events of requestors approximately in a count-min sketch per
+// time slot. The time slots are kept in a ring, so at most numTimeSlots sketches are
+// allocated, and the sketches older than numTimeSlots slots are reused for the new slots.
 type BloomLimiter struct {
-	countersMap  sync.Map
 	numCounters  int
 	numFuncs     int
 	numTimeSlots int
 	salt         [12]byte
+	slots        []atomic.Pointer[slotCounters]
+	latest       atomic.Int64 // the latest time slot counted in
+}
+
+type slotCounters struct {
+	slot     int64
+	counters []uint32
 }
 
 func NewBloomLimiter(numCounters, numFuncs, numTimeSlots int, salt [12]byte) *BloomLimiter {
-	if numFuncs > 16 {
+	// each function takes 4 bytes of a sha256 hash as the position of its counter
+	if numFuncs > sha256.Size/4 {
 		panic("numFuncs is too large")
 	}
 	return &BloomLimiter{
@@ -24,37 +33,71 @@ func NewBloomLimiter(numCounters, numFuncs, numTimeSlots int, salt [12]byte) *Bl
 		numFuncs:     numFuncs,
 		numTimeSlots: numTimeSlots,
 		salt:         salt,
+		slots:        make([]atomic.Pointer[slotCounters], numTimeSlots),
+	}
+}
+
+func (b *BloomLimiter) positions(requestor []byte) (pos [sha256.Size / 4]uint32) {
+	hash := sha256.Sum256(append(b.salt[:], requestor...))
+	for i := 0; i < b.numFuncs; i++ {
+		pos[i] = binary.LittleEndian.Uint32(hash[i*4:i*4+4]) % uint32(b.numCounters)
+	}
+	return
+}
+
+// the count of a requestor in a slot is the minimum of its counters
+func (b *BloomLimiter) count(counters []uint32, pos *[sha256.Size / 4]uint32) (n uint32) {
+	for i := 0; i < b.numFuncs; i++ {
+		c := atomic.LoadUint32(&counters[pos[i]])
+		if i == 0 || c < n {
+			n = c
+		}
 	}
+	return
 }
 
-// get the total count in all the timeslots
+// get the total count in all the timeslots up to the latest one counted in
 func (b *BloomLimiter) GetTotalCount(requestor []byte) (total uint32) {
-	b.countersMap.Range(func(_, value any) bool {
-		counters := value.([]uint32)
-		hash := sha256.Sum256(append(b.salt[:], requestor[:]...))
-		for i := 0; i < int(b.numFuncs); i++ {
-			slotNum := binary.LittleEndian.Uint32(hash[i*4:i*4+4]) % uint32(len(counters))
-			total += atomic.LoadUint32(&counters[slotNum])
+	return b.GetTotalCountAt(int(b.latest.Load()), requestor)
+}
+
+// get the total count in the numTimeSlots timeslots up to timeSlot
+func (b *BloomLimiter) GetTotalCountAt(timeSlot int, requestor []byte) (total uint32) {
+	pos := b.positions(requestor)
+	current := int64(timeSlot)
+	for i := range b.slots {
+		sc := b.slots[i].Load()
+		if sc != nil && sc.slot > current-int64(b.numTimeSlots) && sc.slot <= current {
+			total += b.count(sc.counters, &pos)
 		}
-		return true //don't stop iteration
-	})
+	}
 	return
 }
 
-// incr the count in the current timeslot
+// incr the count in timeSlot and return the total count in the timeslots up to it
 func (b *BloomLimiter) IncrCount(timeSlot int, requestor []byte) (total uint32) {
-	var counters []uint32
-	if value, ok := b.countersMap.Load(timeSlot); ok {
-		counters = value.([]uint32)
-	} else { // if the current entry has not been allocated
-		counters = make([]uint32, b.numCounters)
-		b.countersMap.Store(timeSlot, counters)
-	}
-	b.countersMap.Delete(timeSlot - b.numTimeSlots) // delete an outdated entry
-	hash := sha256.Sum256(append(b.salt[:], requestor[:]...))
-	for i := 0; i < int(b.numFuncs); i++ {
-		slotNum := binary.LittleEndian.Uint32(hash[i*4:i*4+4]) % uint32(len(counters))
-		total += atomic.AddUint32(&counters[slotNum], 1)
+	pos := b.positions(requestor)
+	current := int64(timeSlot)
+	entry := &b.slots[int(current%int64(b.numTimeSlots))]
+	sc := entry.Load()
+	for sc == nil || sc.slot < current {
+		// the entry is empty or outdated, replace it for the current slot
+		newSc := &slotCounters{slot: current, counters: make([]uint32, b.numCounters)}
+		if entry.CompareAndSwap(sc, newSc) {
+			sc = newSc
+		} else {
+			sc = entry.Load()
+		}
 	}
-	return
+	if sc.slot == current { // false if another caller has just moved to the next slot
+		for i := 0; i < b.numFuncs; i++ {
+			atomic.AddUint32(&sc.counters[pos[i]], 1)
+		}
+	}
+	for latest := b.latest.Load(); latest < current; latest = b.latest.Load() {
+		if b.latest.CompareAndSwap(latest, current) {
+			break
+		}
+	}
+	return b.GetTotalCountAt(timeSlot, requestor)
 }
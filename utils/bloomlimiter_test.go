@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestBloomLimiter(numTimeSlots int) *BloomLimiter {
+	return NewBloomLimiter(1<<16, 4, numTimeSlots, [12]byte{1, 2, 3})
+}
+
+func TestBloomLimiterCountsInTimeSlots(t *testing.T) {
+	b := newTestBloomLimiter(3)
+	alice, bob := []byte("alice"), []byte("bob")
+	for i := 0; i < 3; i++ {
+		b.IncrCount(10, alice)
+	}
+	if total := b.IncrCount(11, alice); total != 4 {
+		t.Fatalf("total count of alice is %d, want 4", total)
+	}
+	if total := b.GetTotalCount(bob); total != 0 {
+		t.Fatalf("total count of bob is %d, want 0", total)
+	}
+	for _, c := range []struct {
+		slot int
+		want uint32
+	}{
+		{10, 3},
+		{11, 4},
+		{12, 4},
+		{13, 1}, // slot 10 is out of the window
+		{14, 0},
+	} {
+		if total := b.GetTotalCountAt(c.slot, alice); total != c.want {
+			t.Errorf("total count of alice at slot %d is %d, want %d", c.slot, total, c.want)
+		}
+	}
+}
+
+func TestBloomLimiterReusesOutdatedSlots(t *testing.T) {
+	b := newTestBloomLimiter(2)
+	alice := []byte("alice")
+	b.IncrCount(0, alice)
+	b.IncrCount(1, alice)
+	// slot 2 takes the ring entry of slot 0
+	if total := b.IncrCount(2, alice); total != 2 {
+		t.Fatalf("total count at slot 2 is %d, want 2", total)
+	}
+	if total := b.GetTotalCountAt(1, alice); total != 1 {
+		t.Fatalf("total count at slot 1 is %d, want 1 after slot 0 is reused", total)
+	}
+	// a late event of an outdated slot is not counted in the newer one
+	b.IncrCount(0, alice)
+	if total := b.GetTotalCount(alice); total != 2 {
+		t.Fatalf("total count is %d, want 2", total)
+	}
+}
+
+func TestNewBloomLimiterTooManyFuncs(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("9 functions are accepted, but a sha256 hash only has 8 positions")
+		}
+	}()
+	NewBloomLimiter(1<<16, 9, 2, [12]byte{})
+}
+
+func BenchmarkBloomLimiterIncrCount(b *testing.B) {
+	l := newTestBloomLimiter(10)
+	var id atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		requestor := []byte(strconv.FormatInt(id.Add(1), 10))
+		for pb.Next() {
+			l.IncrCount(1, requestor)
+		}
+	})
+}
+
+func BenchmarkBloomLimiterIncrCountRotating(b *testing.B) {
+	l := newTestBloomLimiter(10)
+	var id atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		requestor := []byte(strconv.FormatInt(id.Add(1), 10))
+		for i := 0; pb.Next(); i++ {
+			l.IncrCount(i/1000, requestor)
+		}
+	})
+}
+
+func BenchmarkBloomLimiterGetTotalCount(b *testing.B) {
+	l := newTestBloomLimiter(10)
+	for slot := 0; slot < 10; slot++ {
+		l.IncrCount(slot, []byte("alice"))
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.GetTotalCount([]byte("alice"))
+		}
+	})
+}
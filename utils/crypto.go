@@ -6,6 +6,11 @@ import (
 )
 
 func GetAddressAndCheckSig(hash [32]byte, sig []byte) (common.Address, error) {
+	if len(sig) == crypto.SignatureLength && sig[crypto.RecoveryIDOffset] >= 27 {
+		// wallets produce the legacy recovery id 27/28
+		sig = append([]byte{}, sig...)
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
 	pubkey, err := crypto.SigToPub(hash[:], sig)
 	if err != nil {
 		return common.Address{}, err
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Clients never send plain passwords to the user manager, only their sha256 hashes, so
+// the stored password hash is derived from sha256(password) instead of the password.
+//
+// The encodings of a stored password hash:
+//
+//	legacy: 32-byte sha256(password)
+//	v1:     0x01 + 16-byte salt + 4-byte time + 4-byte memory in KiB + 1-byte threads + 32-byte argon2id key
+const (
+	PasswordHashV1 = byte(0x01)
+
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+	passwordV1Len   = 1 + passwordSaltLen + 4 + 4 + 1 + passwordKeyLen
+)
+
+var (
+	argon2Time    uint32 = 2
+	argon2Memory  uint32 = 19 * 1024
+	argon2Threads uint8  = 1
+)
+
+// HashPassword encodes sha256(password) with the latest version of the password hash
+func HashPassword(passwordSha256 [32]byte) []byte {
+	var salt [passwordSaltLen]byte
+	_, err := rand.Read(salt[:])
+	if err != nil {
+		panic(err)
+	}
+	return hashPasswordV1(passwordSha256, salt[:], argon2Time, argon2Memory, argon2Threads)
+}
+
+func hashPasswordV1(passwordSha256 [32]byte, salt []byte, time, memory uint32, threads uint8) []byte {
+	out := make([]byte, 0, passwordV1Len)
+	out = append(out, PasswordHashV1)
+	out = append(out, salt...)
+	out = binary.BigEndian.AppendUint32(out, time)
+	out = binary.BigEndian.AppendUint32(out, memory)
+	out = append(out, threads)
+	return append(out, argon2.IDKey(passwordSha256[:], salt, time, memory, threads, passwordKeyLen)...)
+}
+
+// CheckPassword compares sha256(password) with a stored password hash. needUpgrade is
+// true when the stored hash is correct but not encoded with the latest version and
+// parameters, and should be replaced by HashPassword.
+func CheckPassword(stored []byte, passwordSha256 [32]byte) (ok, needUpgrade bool) {
+	if len(stored) == 32 {
+		return subtle.ConstantTimeCompare(stored, passwordSha256[:]) == 1, true
+	}
+	if len(stored) != passwordV1Len || stored[0] != PasswordHashV1 {
+		return false, false
+	}
+	salt := stored[1 : 1+passwordSaltLen]
+	params := stored[1+passwordSaltLen:]
+	time := binary.BigEndian.Uint32(params[0:4])
+	memory := binary.BigEndian.Uint32(params[4:8])
+	threads := params[8]
+	expected := hashPasswordV1(passwordSha256, salt, time, memory, threads)
+	ok = subtle.ConstantTimeCompare(stored, expected) == 1
+	needUpgrade = time != argon2Time || memory != argon2Memory || threads != argon2Threads
+	return ok, ok && needUpgrade
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	password := sha256.Sum256([]byte("secret"))
+	wrong := sha256.Sum256([]byte("guess"))
+	legacy := password[:]
+	current := HashPassword(password)
+	if len(current) != passwordV1Len || current[0] != PasswordHashV1 {
+		t.Fatalf("hash of %d bytes with version %d", len(current), current[0])
+	}
+	if bytes.Equal(current, HashPassword(password)) {
+		t.Error("the same password is hashed with the same salt twice")
+	}
+	weaker := hashPasswordV1(password, bytes.Repeat([]byte{1}, passwordSaltLen), 1, argon2Memory, argon2Threads)
+	unknown := append([]byte{PasswordHashV1 + 1}, current[1:]...)
+
+	for _, c := range []struct {
+		name        string
+		stored      []byte
+		password    [32]byte
+		ok, upgrade bool
+	}{
+		{"current", current, password, true, false},
+		{"current, wrong password", current, wrong, false, false},
+		{"legacy sha256", legacy, password, true, true},
+		{"legacy sha256, wrong password", legacy, wrong, false, false},
+		{"older parameters", weaker, password, true, true},
+		{"older parameters, wrong password", weaker, wrong, false, false},
+		{"unknown version", unknown, password, false, false},
+		{"truncated", current[:len(current)-1], password, false, false},
+		{"empty", nil, password, false, false},
+	} {
+		// the upgrade of a wrong password does not matter, it is never stored
+		ok, upgrade := CheckPassword(c.stored, c.password)
+		if ok != c.ok || (ok && upgrade != c.upgrade) {
+			t.Errorf("%s: ok %v, upgrade %v", c.name, ok, upgrade)
+		}
+	}
+}
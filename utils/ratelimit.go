@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"crypto/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rateLimiterCounters = 1 << 16
+	rateLimiterFuncs    = 4
+)
+
+// RateLimiter allows at most maxCount events of each requestor in the last numTimeSlots
+// time slots, counted approximately by a BloomLimiter with a random salt. The time slots
+// are derived from its clock.
+type RateLimiter struct {
+	bloom        *BloomLimiter
+	slotDuration time.Duration
+	maxCount     uint32
+	now          func() time.Time
+}
+
+func NewRateLimiter(slotDuration time.Duration, numTimeSlots int, maxCount uint32) *RateLimiter {
+	var salt [12]byte
+	_, err := rand.Read(salt[:])
+	if err != nil {
+		panic(err)
+	}
+	return &RateLimiter{
+		bloom:        NewBloomLimiter(rateLimiterCounters, rateLimiterFuncs, numTimeSlots, salt),
+		slotDuration: slotDuration,
+		maxCount:     maxCount,
+		now:          time.Now,
+	}
+}
+
+// SetClock replaces time.Now, it must be called before the limiter is used
+func (l *RateLimiter) SetClock(now func() time.Time) {
+	l.now = now
+}
+
+func (l *RateLimiter) currentSlot() int {
+	return int(l.now().UnixNano() / int64(l.slotDuration))
+}
+
+// Incr counts an event of requestor
+func (l *RateLimiter) Incr(requestor []byte) {
+	l.bloom.IncrCount(l.currentSlot(), requestor)
+}
+
+// Allow counts an event of requestor and tells whether it is allowed
+func (l *RateLimiter) Allow(requestor []byte) bool {
+	return l.bloom.IncrCount(l.currentSlot(), requestor) <= l.maxCount
+}
+
+// Exceeded tells whether requestor has used up its events, without counting an event
+func (l *RateLimiter) Exceeded(requestor []byte) bool {
+	return l.bloom.GetTotalCountAt(l.currentSlot(), requestor) >= l.maxCount
+}
+
+// RetryAfter returns the time until the current slot ends, when the oldest slot is dropped
+func (l *RateLimiter) RetryAfter() time.Duration {
+	return l.slotDuration - time.Duration(l.now().UnixNano()%int64(l.slotDuration))
+}
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the CIDRs of the reverse proxies in front of the services, whose
+// X-Forwarded-For headers are used to find the client IPs
+func SetTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the key of the client of r for rate limiting. Behind trusted proxies
+// it is the nearest address in X-Forwarded-For which is not a trusted proxy. An IPv6
+// client is keyed by its /64 prefix, as a single host usually owns the whole prefix.
+func ClientIP(r *http.Request) []byte {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return []byte(host)
+	}
+	if isTrustedProxy(ip) {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return []byte(ip.String())
+}
+
+func WriteTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// LimitByIP rejects the requests from the client IPs which exceed the limit of l
+func LimitByIP(l *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow(ClientIP(r)) {
+			WriteTooManyRequests(w, l.RetryAfter())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSlotRotation(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewRateLimiter(time.Minute, 2, 3)
+	l.SetClock(func() time.Time { return now })
+	alice := []byte("alice")
+	for i := 0; i < 3; i++ {
+		if !l.Allow(alice) {
+			t.Fatalf("request %d is not allowed", i)
+		}
+	}
+	if l.Allow(alice) {
+		t.Fatal("the 4th request is allowed")
+	}
+	if !l.Exceeded(alice) || l.Exceeded([]byte("bob")) {
+		t.Fatal("only alice should exceed the limit")
+	}
+	if retry := l.RetryAfter(); retry <= 0 || retry > time.Minute {
+		t.Fatalf("retry after %s", retry)
+	}
+
+	// the events of the previous slot are still in the window
+	now = now.Add(time.Minute)
+	if !l.Exceeded(alice) {
+		t.Fatal("alice no longer exceeds the limit after one slot")
+	}
+	// and they are dropped once it leaves the window
+	now = now.Add(time.Minute)
+	if l.Exceeded(alice) || !l.Allow(alice) {
+		t.Fatal("alice still exceeds the limit after the window")
+	}
+
+	// a long pause drops all the slots
+	l.Incr(alice)
+	l.Incr(alice)
+	now = now.Add(time.Hour)
+	if l.Exceeded(alice) {
+		t.Fatal("alice exceeds the limit after an hour")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	err := SetTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+	for _, c := range []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"1.2.3.4:5678", "", "1.2.3.4"},
+		{"1.2.3.4:5678", "9.9.9.9", "1.2.3.4"}, // not from a trusted proxy
+		{"10.0.0.1:5678", "9.9.9.9", "9.9.9.9"},
+		{"10.0.0.1:5678", "8.8.8.8, 9.9.9.9, 10.0.0.2", "9.9.9.9"},
+		{"10.0.0.1:5678", "junk", "10.0.0.1"},
+		{"[2001:db8::1]:443", "", "2001:db8::"},
+		{"[2001:db8::2]:443", "", "2001:db8::"},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := string(ClientIP(r)); got != c.want {
+			t.Errorf("ClientIP of %s forwarded for %q is %s, want %s", c.remoteAddr, c.forwarded, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits a flow to rate tokens per second, allowing bursts of up to burst
+// tokens. A rate of zero means no limit. Taking more tokens than there are puts the
+// bucket into debt, which the taker waits out, so a single large take is not refused.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	tb := &TokenBucket{now: time.Now}
+	tb.SetRate(rate, burst)
+	tb.tokens = float64(tb.burst)
+	return tb
+}
+
+// SetClock replaces time.Now, it must be called before the bucket is used
+func (tb *TokenBucket) SetClock(now func() time.Time) {
+	tb.now = now
+	tb.last = now()
+}
+
+// SetRate changes the limits, keeping the tokens in the bucket
+func (tb *TokenBucket) SetRate(rate, burst int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	if burst < rate {
+		burst = rate
+	}
+	tb.rate, tb.burst = rate, burst
+	if tb.tokens > float64(burst) {
+		tb.tokens = float64(burst)
+	}
+}
+
+func (tb *TokenBucket) refill() {
+	now := tb.now()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * float64(tb.rate)
+		if tb.tokens > float64(tb.burst) {
+			tb.tokens = float64(tb.burst)
+		}
+	}
+	tb.last = now
+}
+
+// Take removes n tokens and returns how long the taker must wait for them
+func (tb *TokenBucket) Take(n int64) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate <= 0 {
+		return 0
+	}
+	tb.refill()
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / float64(tb.rate) * float64(time.Second))
+}
+
+// Wait takes n tokens and waits for them, unless ctx is done first
+func (tb *TokenBucket) Wait(ctx context.Context, n int64) error {
+	delay := tb.Take(n)
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
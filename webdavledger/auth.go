@@ -2,71 +2,149 @@ package webdavledger
 
 import (
 	"crypto/sha256"
-	"crypto/subtle"
-	"encoding/binary"
 	"net/http"
+	"time"
 
+	"github.com/ReneKroon/ttlcache"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/common"
 
+	"github.com/smartbch/cashdisk/config"
 	"github.com/smartbch/cashdisk/types"
 	"github.com/smartbch/cashdisk/utils"
 )
 
-func authFunc(db *badger.DB, w http.ResponseWriter, r *http.Request) (addr common.Address, errStr string) {
+// credential is the authenticated caller of a request, with the restrictions of the
+// app password it used
+type credential struct {
+	addr     common.Address
+	readOnly bool
+	scope    string // a directory under /home, empty for all
+}
+
+var (
+	appPasswordTouchInterval = time.Minute
+	verifiedPasswordTTL      = 5 * time.Minute
+)
+
+type passwordAuth struct {
+	db *badger.DB
+	// WebDAV clients send the password with every request, the results of the slow
+	// password hash are cached to keep it from dominating the cost of a request
+	verified *ttlcache.Cache // sha256(address + stored hash + sha256(password)) => true
+	// counts the failed logins of both client IPs and addresses
+	failedLogins *utils.RateLimiter
+}
+
+func newPasswordAuth(db *badger.DB, failedLogins *utils.RateLimiter) *passwordAuth {
+	verified := ttlcache.NewCache()
+	verified.SetTTL(verifiedPasswordTTL)
+	verified.SkipTtlExtensionOnHit(true)
+	return &passwordAuth{db: db, verified: verified, failedLogins: failedLogins}
+}
+
+// tooManyFailedLogins must be checked before authFunc, which does not check it by itself
+func (p *passwordAuth) tooManyFailedLogins(r *http.Request) bool {
+	if p.failedLogins.Exceeded(utils.ClientIP(r)) {
+		return true
+	}
+	username, _, _ := r.BasicAuth()
+	if !common.IsHexAddress(username) {
+		return false
+	}
+	addr := common.HexToAddress(username)
+	return p.failedLogins.Exceeded(addr[:])
+}
+
+func (p *passwordAuth) authFunc(w http.ResponseWriter, r *http.Request) (cred credential, errStr string) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return addr, "Unauthorized"
+		return cred, "Unauthorized"
 	}
 
 	if !common.IsHexAddress(username) {
-		return addr, "Invalid username format"
+		return cred, "Invalid username format"
 	}
 
-	addr = common.HexToAddress(username)
-	expectedPasswordHash := make([]byte, 32)
-	key := append([]byte{types.PasswordHash}, addr[:]...)
-	err := db.View(func(txn *badger.Txn) (err error) {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
+	addr := common.HexToAddress(username)
+	cred.addr = addr
+	passwordHash := sha256.Sum256([]byte(password))
+	appPassword, err := types.GetAppPassword(p.db, addr, passwordHash)
+	if err == nil {
+		now := time.Now().UnixNano()
+		if appPassword.LastUsedTime+int64(appPasswordTouchInterval) < now {
+			_ = types.TouchAppPassword(p.db, addr, passwordHash, now)
 		}
-		return item.Value(func(val []byte) error {
-			copy(expectedPasswordHash, val)
-			return nil
-		})
-	})
-
+		cred.readOnly = appPassword.ReadOnly
+		cred.scope = appPassword.Scope
+		return cred, ""
+	}
+	storedHash, err := types.GetPasswordHash(p.db, addr)
 	if err != nil {
-		return addr, "No such user: " + username
+		return cred, "No such user: " + username
 	}
 
+	cacheKey := sha256.Sum256(append(append(addr.Bytes(), storedHash...), passwordHash[:]...))
+	if _, ok := p.verified.Get(string(cacheKey[:])); ok {
+		return cred, ""
+	}
+	ok, needUpgrade := utils.CheckPassword(storedHash, passwordHash)
+	if !ok {
+		p.failedLogins.Incr(utils.ClientIP(r))
+		p.failedLogins.Incr(addr[:])
+		return cred, "Incorrect password"
+	}
+	if needUpgrade {
+		// an upgrade failure only means the old hash is kept until the next login
+		_ = types.UpgradePasswordHash(p.db, addr, storedHash, passwordHash)
+	} else {
+		p.verified.Set(string(cacheKey[:]), true)
+	}
+	return cred, ""
+}
+
+// checkShareLinkPassword verifies the password of a request to the share link token,
+// protected with storedHash. Like the logins, the failures are limited, per client IP and
+// link, and the verified passwords are cached.
+func (p *passwordAuth) checkShareLinkPassword(r *http.Request, token string, storedHash []byte) (status int, errStr string) {
+	tokenHash := sha256.Sum256([]byte(token))
+	requestor := append(tokenHash[:], utils.ClientIP(r)...)
+	if p.failedLogins.Exceeded(requestor) {
+		return http.StatusTooManyRequests, "Too many failed logins"
+	}
+	_, password, _ := r.BasicAuth()
 	passwordHash := sha256.Sum256([]byte(password))
-	if subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 0 {
-		return addr, "Incorrect password"
+	cacheKey := sha256.Sum256(append(append(append([]byte(shareLinkPrefix), tokenHash[:]...), storedHash...), passwordHash[:]...))
+	if _, ok := p.verified.Get(string(cacheKey[:])); ok {
+		return 0, ""
+	}
+	if ok, _ := utils.CheckPassword(storedHash, passwordHash); !ok {
+		p.failedLogins.Incr(requestor)
+		return http.StatusUnauthorized, "Incorrect password"
 	}
-	return addr, ""
+	p.verified.Set(string(cacheKey[:]), true)
+	return 0, ""
 }
 
-func getExpireTime(db *badger.DB, fromUid, toUid int64, dir string) (expireTime int64) {
-	key := make([]byte, 1+8+8+32)
-	key[0] = types.SharedDir
-	binary.BigEndian.PutUint64(key[1:9], uint64(fromUid))
-	binary.BigEndian.PutUint64(key[9:17], uint64(toUid))
-	dirHash := sha256.Sum256([]byte(dir))
-	copy(key[17:], dirHash[:])
-	err := db.View(func(txn *badger.Txn) (err error) {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
-		}
-		return item.Value(func(val []byte) error {
-			expireTime = utils.BytesToInt64(val[:8])
-			return nil
-		})
-	})
-	if err != nil {
-		return -1
+// PasswordAuth lets the other services accept the WebDAV credentials of the users, with
+// the failed logins limited like on the disk service
+type PasswordAuth struct {
+	p *passwordAuth
+}
+
+func NewPasswordAuth(db *badger.DB, failedLogins config.RateLimitConfig) *PasswordAuth {
+	return &PasswordAuth{p: newPasswordAuth(db, newRateLimiter(failedLogins))}
+}
+
+// Authenticate returns the address of the user of the basic auth credentials of r, or the
+// HTTP status and the reason they are rejected for
+func (a *PasswordAuth) Authenticate(r *http.Request) (addr common.Address, status int, errStr string) {
+	if a.p.tooManyFailedLogins(r) {
+		return addr, http.StatusTooManyRequests, "Too many failed logins"
+	}
+	cred, errStr := a.p.authFunc(nil, r)
+	if len(errStr) != 0 {
+		return addr, http.StatusUnauthorized, errStr
 	}
-	return
+	return cred.addr, 0, ""
 }
@@ -0,0 +1,105 @@
+package webdavledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// serveWithPassword serves a WebDAV request of u authenticated with password
+func (td *testDisk) serveWithPassword(u testUser, password, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.SetBasicAuth(u.addr.Hex(), password)
+	w := httptest.NewRecorder()
+	td.d.ServeHTTP(w, r)
+	return w
+}
+
+func (td *testDisk) storedPasswordHash(u testUser) []byte {
+	stored, err := types.GetPasswordHash(td.db, u.addr)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	return stored
+}
+
+func TestLegacyPasswordUpgrade(t *testing.T) {
+	td := newTestDisk(t)
+	td.writeFile(td.owner, "a.txt", "a")
+	password := sha256.Sum256([]byte("secret"))
+	err := td.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{types.PasswordHash}, td.owner.addr[:]...), password[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := td.serveWithPassword(td.owner, "guess", "GET", "/home/a.txt"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d with a wrong password", w.Code)
+	}
+	if stored := td.storedPasswordHash(td.owner); !bytes.Equal(stored, password[:]) {
+		t.Fatalf("a wrong password replaced the legacy hash with %x", stored)
+	}
+	// the legacy hash is replaced at the first login, and is not cached
+	if w := td.serveWithPassword(td.owner, "secret", "GET", "/home/a.txt"); w.Code != http.StatusOK {
+		t.Fatalf("status %d with the legacy password", w.Code)
+	}
+	upgraded := td.storedPasswordHash(td.owner)
+	if ok, needUpgrade := utils.CheckPassword(upgraded, password); len(upgraded) == len(password) || !ok || needUpgrade {
+		t.Fatalf("the legacy hash is upgraded to %x", upgraded)
+	}
+	if td.d.pwAuth.verified.Count() != 0 {
+		t.Error("the legacy hash is cached")
+	}
+	// the upgraded hash is kept and cached
+	for i := 0; i < 2; i++ {
+		if w := td.serveWithPassword(td.owner, "secret", "GET", "/home/a.txt"); w.Code != http.StatusOK {
+			t.Fatalf("status %d with the upgraded password", w.Code)
+		}
+	}
+	if !bytes.Equal(td.storedPasswordHash(td.owner), upgraded) || td.d.pwAuth.verified.Count() != 1 {
+		t.Errorf("%d verified passwords cached after upgrading to %x", td.d.pwAuth.verified.Count(), td.storedPasswordHash(td.owner))
+	}
+
+	// an upgrade does not overwrite a password changed since the legacy hash was read
+	err = types.UpdateUserPasswordHash(td.db, td.other.addr, sha256.Sum256([]byte("changed")))
+	if err == nil {
+		err = types.UpgradePasswordHash(td.db, td.other.addr, password[:], password)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := utils.CheckPassword(td.storedPasswordHash(td.other), sha256.Sum256([]byte("changed"))); !ok {
+		t.Error("the upgrade overwrote the changed password")
+	}
+}
+
+func TestRevokedAppPassword(t *testing.T) {
+	td := newTestDisk(t)
+	td.writeFile(td.owner, "a.txt", "a")
+	td.addAppPassword(td.owner, "app", types.AppPasswordInfo{Label: "app"})
+	td.addAppPassword(td.owner, "other app", types.AppPasswordInfo{Label: "other app"})
+	for i := 0; i < 2; i++ {
+		if w := td.serveWithPassword(td.owner, "app", "GET", "/home/a.txt"); w.Code != http.StatusOK {
+			t.Fatalf("status %d with the app password", w.Code)
+		}
+	}
+	err := types.DeleteAppPassword(td.db, td.owner.addr, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the revoked password is refused at once, the other one still works
+	if w := td.serveWithPassword(td.owner, "app", "GET", "/home/a.txt"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d with the revoked app password", w.Code)
+	}
+	if w := td.serveWithPassword(td.owner, "other app", "GET", "/home/a.txt"); w.Code != http.StatusOK {
+		t.Errorf("status %d with the other app password", w.Code)
+	}
+}
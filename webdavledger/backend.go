@@ -0,0 +1,154 @@
+package webdavledger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+)
+
+// NewBackend returns the file system which holds the files of all the users, as selected
+// by c. The home of each user is /<address> in it, besides which there are the version
+// store and the trash bin. With deduplication, the blocks of the files are kept in the
+// same backend and counted in db.
+func NewBackend(c config.BackendConfig, workDir string, db *badger.DB) (webdav.FileSystem, error) {
+	var fs webdav.FileSystem
+	switch c.Type {
+	case config.BackendLocal, "":
+		fs = webdav.Dir(workDir)
+	case config.BackendS3:
+		s3, err := newS3FS(c.S3)
+		if err != nil {
+			return nil, err
+		}
+		fs = s3
+	case config.BackendMemory:
+		fs = webdav.NewMemFS()
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", c.Type)
+	}
+	if c.Dedup {
+		fs = newDedupFS(db, fs)
+	}
+	return fs, nil
+}
+
+// StorageSizer is implemented by the backends in which a file may take less space than its
+// size, so that the storage scan charges for the space actually taken
+type StorageSizer interface {
+	StorageSize(ctx context.Context, name string) (int64, error)
+}
+
+// subFS is the part of a file system under root. Like webdav.Dir, nothing outside of
+// root can be reached through it.
+type subFS struct {
+	fs   webdav.FileSystem
+	root string
+}
+
+var _ webdav.FileSystem = (*subFS)(nil)
+
+func newSubFS(fs webdav.FileSystem, root string) *subFS {
+	return &subFS{fs: fs, root: path.Clean("/" + root)}
+}
+
+func (s *subFS) resolve(name string) string {
+	return path.Join(s.root, path.Clean("/"+name))
+}
+
+func (s *subFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return s.fs.Mkdir(ctx, s.resolve(name), perm)
+}
+
+func (s *subFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return s.fs.OpenFile(ctx, s.resolve(name), flag, perm)
+}
+
+func (s *subFS) RemoveAll(ctx context.Context, name string) error {
+	if path.Clean("/"+name) == "/" {
+		return os.ErrInvalid
+	}
+	return s.fs.RemoveAll(ctx, s.resolve(name))
+}
+
+func (s *subFS) Rename(ctx context.Context, oldName, newName string) error {
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" {
+		return os.ErrInvalid
+	}
+	return s.fs.Rename(ctx, s.resolve(oldName), s.resolve(newName))
+}
+
+func (s *subFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return s.fs.Stat(ctx, s.resolve(name))
+}
+
+func mkdirAll(ctx context.Context, fs webdav.FileSystem, dir string) error {
+	p := ""
+	for _, name := range splitPath(dir) {
+		p += "/" + name
+		if _, err := fs.Stat(ctx, p); err == nil {
+			continue
+		}
+		err := fs.Mkdir(ctx, p, 0755)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	var names []string
+	for p != "/" {
+		names = append([]string{path.Base(p)}, names...)
+		p = path.Dir(p)
+	}
+	return names
+}
+
+// Walk calls fn for name and everything under it in lexical order, like filepath.Walk.
+// The entries of a directory are read before fn is called for them, so fn may move them
+// away.
+func Walk(ctx context.Context, fs webdav.FileSystem, name string,
+	fn func(name string, fi os.FileInfo, err error) error) error {
+	fi, err := fs.Stat(ctx, name)
+	if err != nil {
+		return fn(name, nil, err)
+	}
+	return walk(ctx, fs, name, fi, fn)
+}
+
+func walk(ctx context.Context, fs webdav.FileSystem, name string, fi os.FileInfo,
+	fn func(name string, fi os.FileInfo, err error) error) error {
+	err := fn(name, fi, nil)
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return fn(name, fi, err)
+	}
+	entries, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return fn(name, fi, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		err = walk(ctx, fs, path.Join(name, entry.Name()), entry, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
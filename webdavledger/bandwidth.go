@@ -0,0 +1,99 @@
+package webdavledger
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// throttle limits the bytes read and written through the disk service, by a global
+// token bucket and one for each user. The limit of a user follows its tier, which is
+// decided by its points, plus the boosts it has bought.
+type throttle struct {
+	db     *badger.DB
+	cfg    config.BandwidthConfig
+	global *utils.TokenBucket
+	users  sync.Map // uid -> *userBucket
+}
+
+type userBucket struct {
+	*utils.TokenBucket
+	mu      sync.Mutex
+	checked time.Time
+}
+
+func newThrottle(db *badger.DB, cfg config.BandwidthConfig) *throttle {
+	return &throttle{
+		db:     db,
+		cfg:    cfg,
+		global: utils.NewTokenBucket(cfg.Global.Rate, cfg.Global.Burst),
+	}
+}
+
+func (t *throttle) userLimit(uid int64) config.BandwidthLimit {
+	_, points, err := types.IsUserLock(t.db, uid)
+	if err != nil {
+		points = 0
+	}
+	boost, err := types.GetBandwidthBoost(t.db, uid, time.Now().UnixNano())
+	if err != nil {
+		boost = 0
+	}
+	return t.cfg.Limit(points, boost)
+}
+
+func (t *throttle) bucket(uid int64) *userBucket {
+	if b, ok := t.users.Load(uid); ok {
+		ub := b.(*userBucket)
+		ub.mu.Lock()
+		defer ub.mu.Unlock()
+		if time.Since(ub.checked) > t.cfg.TierRefresh {
+			limit := t.userLimit(uid)
+			ub.SetRate(limit.Rate, limit.Burst)
+			ub.checked = time.Now()
+		}
+		return ub
+	}
+	limit := t.userLimit(uid)
+	b, _ := t.users.LoadOrStore(uid, &userBucket{
+		TokenBucket: utils.NewTokenBucket(limit.Rate, limit.Burst),
+		checked:     time.Now(),
+	})
+	return b.(*userBucket)
+}
+
+// wait blocks until uid may transfer n more bytes, or ctx is done
+func (t *throttle) wait(ctx context.Context, uid int64, n int) error {
+	if t == nil || n == 0 {
+		return nil
+	}
+	err := t.bucket(uid).Wait(ctx, int64(n))
+	if err != nil {
+		return err
+	}
+	return t.global.Wait(ctx, int64(n))
+}
+
+// throttledReader limits the bytes read from r like WatchedFile.Read
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	throttle *throttle
+	uid      int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.ReadCloser.Read(p)
+	waitErr := tr.throttle.wait(tr.ctx, tr.uid, n)
+	if waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -2,114 +2,573 @@ package webdavledger
 
 import (
 	"context"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"hash"
 	"io/fs"
+	"log"
+	"net/http"
 	"os"
+	"path"
 
 	badger "github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/common"
 	"golang.org/x/net/webdav"
 
+	"github.com/smartbch/cashdisk/config"
 	"github.com/smartbch/cashdisk/types"
 )
 
+// WatchedDir charges readers for reading and listing, and writerUid for the operations
+// which modify the directory. When the owner accesses the directory, both are the owner.
+// When a friend accesses a shared directory, the readers are chosen by the payer setting
+// of the share, while the friend always pays for the modifications, since the owner has
+// no control over them.
+//
+// The bytes read and written through WatchedDir are limited by throttle as transferred by
+// writerUid, the user making the requests.
+//
+// If versions is not nil, the files overwritten through WatchedDir are saved into it, and
+// if trash is not nil, the removed ones are moved into it. base is the path of the root of
+// WatchedDir in the home of owner. FileSystem is a webdav.Dir rooted there, which may be
+// wrapped by a cryptFS.
 type WatchedDir struct {
-	webdav.Dir
-	db  *badger.DB
-	uid int64
-	ro  bool
+	webdav.FileSystem
+	db        *badger.DB
+	readers   payers
+	writerUid int64
+	perm      byte
+	prices    config.PriceTable
+	throttle  *throttle
+
+	versions *VersionStore
+	trash    *TrashBin
+	owner    common.Address
+	ownerUid int64
+	base     string
 }
 
 var _ webdav.FileSystem = (*WatchedDir)(nil)
 
-func (wd *WatchedDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
-	if wd.ro {
+// payers share the cost of an operation evenly, the first one pays the remainder
+type payers []int64
+
+type payment struct {
+	uid    int64
+	points int64
+}
+
+// refund gives back the points of the payments made before a payer failed to pay its
+// share, so a payer is never left paying for an operation which was not carried out
+func refund(db *badger.DB, payments []payment, operation string) {
+	for _, pay := range payments {
+		err := types.RefundPoints(db, pay.uid, pay.points, operation)
+		if err != nil {
+			log.Printf("Error in refunding %d points to uid %d: %s\n", pay.points, pay.uid, err.Error())
+		}
+	}
+}
+
+// pay shares points among the payers and appends the payments made to payments
+func (p payers) pay(db *badger.DB, points int64, operation string, payments *[]payment) error {
+	share := points / int64(len(p))
+	for i, uid := range p {
+		amount := share
+		if i == 0 {
+			amount += points % int64(len(p))
+		}
+		if amount == 0 {
+			continue
+		}
+		err := types.ConsumePoints(db, uid, amount, operation)
+		if err != nil {
+			return err
+		}
+		*payments = append(*payments, payment{uid, amount})
+	}
+	return nil
+}
+
+// charge makes the payers pay for op, which processes the given units. The KB transferred
+// are shared among the payers like the points, and each payer uses the transfer included
+// in its subscription for its share before paying points for the rest. If one of the
+// payers cannot pay, the others are refunded.
+func (p payers) charge(db *badger.DB, prices config.PriceTable, op config.Operation, units int64,
+	operation string) error {
+	_, err := p.chargePayments(db, prices, op, units, operation)
+	return err
+}
+
+// chargePayments is charge returning the payments made, which the caller refunds if the
+// operation paid for fails afterwards
+func (p payers) chargePayments(db *badger.DB, prices config.PriceTable, op config.Operation, units int64,
+	operation string) ([]payment, error) {
+	var payments []payment
+	if !op.IsTransfer() || units == 0 {
+		err := p.pay(db, prices.Cost(op, units), operation, &payments)
+		if err != nil {
+			refund(db, payments, operation)
+			return nil, err
+		}
+		return payments, nil
+	}
+	err := p.pay(db, prices.Cost(op, 0), operation, &payments)
+	share := units / int64(len(p))
+	for i, uid := range p {
+		if err != nil {
+			break
+		}
+		amount := share
+		if i == 0 {
+			amount += units % int64(len(p))
+		}
+		if amount == 0 {
+			continue
+		}
+		var covered int64
+		covered, err = types.UseSubscriptionTransfer(db, uid, amount)
+		if err != nil {
+			break
+		}
+		points := prices.Cost(op, amount-covered) - prices.Cost(op, 0)
+		if points == 0 {
+			continue
+		}
+		err = types.ConsumePoints(db, uid, points, operation)
+		if err == nil {
+			payments = append(payments, payment{uid, points})
+		}
+	}
+	if err != nil {
+		refund(db, payments, operation)
+		return nil, err
+	}
+	return payments, nil
+}
+
+func checkPerm(perm, need byte) error {
+	if perm&need == need {
+		return nil
+	}
+	if perm&types.PermModify == 0 {
 		return types.ErrReadOnly
 	}
-	if common.IsHexAddress(name) || name[0] == '/' && common.IsHexAddress(name[1:]) {
-		return errors.New("in the root directory, EVM address cannot be used as directory name")
+	return types.ErrNoPermission
+}
+
+// pathOf returns the path of name in the home of owner, which keys its dead properties
+// and its checksum
+func (wd *WatchedDir) pathOf(name string) string {
+	return types.CleanPath(path.Join(wd.base, name))
+}
+
+// saveVersion moves the file or directory at name into the version store, if versioning
+// is enabled for it
+func (wd *WatchedDir) saveVersion(name string) error {
+	if wd.versions == nil {
+		return nil
+	}
+	return wd.versions.Save(wd.owner, wd.ownerUid, path.Join(wd.base, name))
+}
+
+func (wd *WatchedDir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	err := checkPerm(wd.perm, types.PermCreate)
+	if err != nil {
+		return err
 	}
 	operation := fmt.Sprintf("Mkdir '%s'", name)
-	err := types.ConsumePoints(wd.db, wd.uid, types.PointsOfMkdir, operation)
+	err = payers{wd.writerUid}.charge(wd.db, wd.prices, config.OpMkdir, 0, operation)
 	if err != nil {
 		return err
 	}
-	return wd.Dir.Mkdir(ctx, name, perm)
+	return wd.FileSystem.Mkdir(ctx, name, perm)
 }
 
 func (wd *WatchedDir) OpenFile(ctx context.Context, name string, flag int,
 	perm os.FileMode) (webdav.File, error) {
-	f, err := wd.Dir.OpenFile(ctx, name, flag, perm)
-	return &WatchedFile{File: f, db: wd.db, name: name, uid: wd.uid, ro: wd.ro}, err
+	var need byte
+	filePerm := wd.perm
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		need |= types.PermRead
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0 {
+		need |= types.PermWrite
+	}
+	fi, statErr := wd.FileSystem.Stat(ctx, name)
+	if flag&os.O_CREATE != 0 && os.IsNotExist(statErr) {
+		// the content of a newly created file can always be written
+		need = types.PermCreate
+		filePerm |= types.PermWrite
+	}
+	err := checkPerm(wd.perm, need)
+	if err != nil {
+		return nil, err
+	}
+	payer := wd.readers
+	if need&types.PermRead == 0 {
+		payer = payers{wd.writerUid}
+	}
+	operation := fmt.Sprintf("Open '%s'", name)
+	err = payer.charge(wd.db, wd.prices, config.OpOpenFile, 0, operation)
+	if err != nil {
+		return nil, err
+	}
+	created := flag&os.O_CREATE != 0 && os.IsNotExist(statErr)
+	if flag&os.O_TRUNC != 0 && statErr == nil && !fi.IsDir() {
+		// the old content is kept as a version, the file is created again in its place
+		err = wd.saveVersion(name)
+		if err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := wd.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	wf := &WatchedFile{
+		File:      f,
+		db:        wd.db,
+		prices:    wd.prices,
+		name:      name,
+		readers:   wd.readers,
+		writerUid: wd.writerUid,
+		opener:    payer,
+		perm:      filePerm,
+		ownerUid:  wd.ownerUid,
+		path:      wd.pathOf(name),
+		fs:        wd.FileSystem,
+		ctx:       ctx,
+		throttle:  wd.throttle,
+	}
+	if !responseMetered(ctx) {
+		wf.reads = newByteMeter(wd.db, wd.prices, wd.readers, config.OpRead, fmt.Sprintf("Read '%s'", name))
+	}
+	if created || flag&os.O_TRUNC != 0 {
+		// the content is hashed as it is written, until it is written out of order
+		wf.hash, wf.written = sha256.New(), true
+	}
+	return wf, nil
+}
+
+func (wd *WatchedDir) RemoveAll(ctx context.Context, name string) error {
+	err := checkPerm(wd.perm, types.PermDelete)
+	if err != nil {
+		return err
+	}
+	operation := fmt.Sprintf("Remove '%s'", name)
+	err = payers{wd.writerUid}.charge(wd.db, wd.prices, config.OpRemoveAll, 0, operation)
+	if err != nil {
+		return err
+	}
+	if wd.trash != nil && path.Clean("/"+name) == "/" {
+		// like webdav.Dir, never remove the root
+		return os.ErrInvalid
+	}
+	// the versioned files are kept as versions, the rest goes to the trash, if any,
+	// together with its checksums and dead properties
+	err = wd.saveVersion(name)
+	if err != nil {
+		return err
+	}
+	if wd.trash == nil {
+		err = wd.FileSystem.RemoveAll(ctx, name)
+	} else {
+		err = wd.trash.Trash(wd.owner, wd.ownerUid, path.Join(wd.base, name))
+	}
+	if err != nil {
+		return err
+	}
+	return deleteMetadata(wd.db, wd.ownerUid, wd.pathOf(name))
 }
 
 func (wd *WatchedDir) Rename(ctx context.Context, oldName, newName string) error {
-	if wd.ro {
-		return types.ErrReadOnly
+	err := checkPerm(wd.perm, types.PermRename)
+	if err != nil {
+		return err
 	}
 	operation := fmt.Sprintf("Rename '%s' to '%s'", oldName, newName)
-	err := types.ConsumePoints(wd.db, wd.uid, types.PointsOfRename, operation)
+	err = payers{wd.writerUid}.charge(wd.db, wd.prices, config.OpRename, 0, operation)
+	if err != nil {
+		return err
+	}
+	err = wd.FileSystem.Rename(ctx, oldName, newName)
 	if err != nil {
 		return err
 	}
-	return wd.Dir.Rename(ctx, oldName, newName)
+	// the checksums and the dead properties follow the renamed file
+	return moveMetadata(wd.db, wd.ownerUid, wd.pathOf(oldName), wd.pathOf(newName))
+}
+
+// moveMetadata moves the checksums of p and everything under it, and the dead properties
+// of p, to newPath
+func moveMetadata(db *badger.DB, uid int64, p, newPath string) error {
+	err := types.MoveChecksums(db, uid, p, newPath)
+	if err != nil {
+		return err
+	}
+	props, err := types.GetDeadProps(db, uid, p)
+	if err != nil || props == nil {
+		return err
+	}
+	err = types.SetDeadProps(db, uid, newPath, props)
+	if err != nil {
+		return err
+	}
+	return types.SetDeadProps(db, uid, p, nil)
+}
+
+// deleteMetadata deletes the checksums of p and everything under it, and the dead
+// properties of p
+func deleteMetadata(db *badger.DB, uid int64, p string) error {
+	err := types.SetDeadProps(db, uid, p, nil)
+	if err != nil {
+		return err
+	}
+	return types.DeleteChecksums(db, uid, p)
 }
 
 func (wd *WatchedDir) Stat(ctx context.Context, name string) (fi os.FileInfo, err error) {
 	operation := fmt.Sprintf("Stat '%s'", name)
-	err = types.ConsumePoints(wd.db, wd.uid, types.PointsPerFileInfo, operation)
+	err = wd.readers.charge(wd.db, wd.prices, config.OpStat, 0, operation)
 	if err != nil {
 		return
 	}
-	return wd.Dir.Stat(ctx, name)
+	fi, err = wd.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumInfo{FileInfo: fi, db: wd.db, uid: wd.ownerUid, path: wd.pathOf(name)}, nil
 }
 
 var _ webdav.File = (*WatchedFile)(nil)
+var _ webdav.DeadPropsHolder = (*WatchedFile)(nil)
 
+// WatchedFile charges for the methods of an opened file like WatchedDir. Its dead
+// properties and checksum are kept in the database, under path in the home of ownerUid.
 type WatchedFile struct {
 	webdav.File
-	db   *badger.DB
-	uid  int64
-	name string
-	ro   bool
+	db        *badger.DB
+	prices    config.PriceTable
+	readers   payers
+	writerUid int64
+	opener    payers // pay for the calls on the file like they paid for opening it
+	name      string
+	perm      byte
+	ownerUid  int64
+	path      string
+	reads     *byteMeter // nil if the content read is charged as it is sent
+	ctx       context.Context
+	throttle  *throttle
+
+	fs      webdav.FileSystem // to read the content back if it cannot be hashed as written
+	hash    hash.Hash         // nil once the content is written out of order
+	hashed  int64
+	written bool
+}
+
+func (wf *WatchedFile) Close() error {
+	operation := fmt.Sprintf("Close '%s'", wf.name)
+	err := wf.opener.charge(wf.db, wf.prices, config.OpClose, 0, operation)
+	if err != nil {
+		wf.File.Close()
+		return err
+	}
+	err = wf.File.Close()
+	if err != nil || !wf.written {
+		return err
+	}
+	return wf.saveChecksum()
+}
+
+// saveChecksum records the checksum of the content, reading it back if it was not hashed
+// as it was written
+func (wf *WatchedFile) saveChecksum() error {
+	if wf.hash == nil {
+		var err error
+		wf.hash, err = hashFile(wf.fs, wf.name)
+		if err != nil {
+			return err
+		}
+	}
+	return types.SetChecksum(wf.db, wf.ownerUid, wf.path, wf.hash.Sum(nil))
+}
+
+func (wf *WatchedFile) Seek(offset int64, whence int) (int64, error) {
+	operation := fmt.Sprintf("Seek '%s'", wf.name)
+	err := wf.opener.charge(wf.db, wf.prices, config.OpSeek, 0, operation)
+	if err != nil {
+		return 0, err
+	}
+	off, err := wf.File.Seek(offset, whence)
+	if err == nil && off != wf.hashed {
+		wf.hash = nil
+	}
+	return off, err
 }
 
 func (wf *WatchedFile) Write(p []byte) (n int, err error) {
-	if wf.ro {
-		return 0, types.ErrReadOnly
+	err = checkPerm(wf.perm, types.PermWrite)
+	if err != nil {
+		return 0, err
+	}
+	err = wf.throttle.wait(wf.ctx, wf.writerUid, len(p))
+	if err != nil {
+		return 0, err
 	}
 	operation := fmt.Sprintf("Write to '%s' for %d bytes", wf.name, len(p))
-	err = types.ConsumePoints(wf.db, wf.uid, int64((len(p)+1023)/1024), operation)
+	err = payers{wf.writerUid}.charge(wf.db, wf.prices, config.OpWrite, int64((len(p)+1023)/1024), operation)
 	if err != nil {
 		return 0, err
 	}
-	return wf.File.Write(p)
+	n, err = wf.File.Write(p)
+	wf.written = true
+	if wf.hash != nil {
+		wf.hash.Write(p[:n])
+		wf.hashed += int64(n)
+	}
+	return n, err
 }
 
 func (wf *WatchedFile) Readdir(count int) ([]fs.FileInfo, error) {
+	err := checkPerm(wf.perm, types.PermRead)
+	if err != nil {
+		return nil, err
+	}
 	res, err := wf.File.Readdir(count)
 	if err == nil {
 		operation := fmt.Sprintf("Read dir '%s' for %d entries", wf.name, len(res))
-		err = types.ConsumePoints(wf.db, wf.uid, int64(len(res))*types.PointsPerFileInfo, operation)
+		err = wf.readers.charge(wf.db, wf.prices, config.OpReaddir, int64(len(res)), operation)
 	}
 	return res, err
 }
 
 func (wf *WatchedFile) Stat() (fs.FileInfo, error) {
 	res, err := wf.File.Stat()
-	if err == nil {
-		operation := fmt.Sprintf("Stat '%s'", wf.name)
-		err = types.ConsumePoints(wf.db, wf.uid, types.PointsPerFileInfo, operation)
+	if err != nil {
+		return nil, err
 	}
-	return res, err
+	operation := fmt.Sprintf("Stat '%s'", wf.name)
+	err = wf.opener.charge(wf.db, wf.prices, config.OpStat, 0, operation)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumInfo{FileInfo: res, db: wf.db, uid: wf.ownerUid, path: wf.path}, nil
 }
 
 func (wf *WatchedFile) Read(p []byte) (n int, err error) {
+	err = checkPerm(wf.perm, types.PermRead)
+	if err != nil {
+		return 0, err
+	}
 	n, err = wf.File.Read(p)
-	if err == nil {
-		operation := fmt.Sprintf("Read '%s' for %d bytes", wf.name, n)
-		err = types.ConsumePoints(wf.db, wf.uid, int64((n+1023)/1024), operation)
+	if n != 0 {
+		// the offset is moved away from the end of the hashed content
+		wf.hash = nil
+	}
+	waitErr := wf.throttle.wait(wf.ctx, wf.writerUid, n)
+	if waitErr != nil {
+		return 0, waitErr
+	}
+	if n != 0 && wf.reads != nil {
+		// the bytes returned together with io.EOF are charged too
+		chargeErr := wf.reads.add(n)
+		if chargeErr != nil {
+			return 0, chargeErr
+		}
 	}
 	return n, err
 }
+
+func (wf *WatchedFile) loadDeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	value, err := types.GetDeadProps(wf.db, wf.ownerUid, wf.path)
+	if err != nil || value == nil {
+		return props, err
+	}
+	var list []webdav.Property
+	err = json.Unmarshal(value, &list)
+	for _, prop := range list {
+		props[prop.XMLName] = prop
+	}
+	return props, err
+}
+
+func (wf *WatchedFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props, err := wf.loadDeadProps()
+	if err != nil {
+		return nil, err
+	}
+	sum, err := types.GetChecksum(wf.db, wf.ownerUid, wf.path)
+	if err != nil {
+		return nil, err
+	}
+	if sum != nil {
+		props[checksumPropName] = webdav.Property{
+			XMLName:  checksumPropName,
+			InnerXML: []byte(hex.EncodeToString(sum)),
+		}
+	}
+	operation := fmt.Sprintf("Read dead properties of '%s'", wf.name)
+	err = wf.readers.charge(wf.db, wf.prices, config.OpDeadProps, int64(len(props)), operation)
+	if err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func (wf *WatchedFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	err := checkPerm(wf.perm, types.PermWrite)
+	if err != nil {
+		return nil, err
+	}
+	props, err := wf.loadDeadProps()
+	if err != nil {
+		return nil, err
+	}
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	protected := webdav.Propstat{Status: http.StatusForbidden, XMLError: "<D:cannot-modify-protected-property xmlns:D=\"DAV:\"/>"}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			if prop.XMLName == checksumPropName {
+				protected.Props = append(protected.Props, webdav.Property{XMLName: prop.XMLName})
+				continue
+			}
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: prop.XMLName})
+			if patch.Remove {
+				delete(props, prop.XMLName)
+			} else {
+				props[prop.XMLName] = prop
+			}
+		}
+	}
+	if len(protected.Props) != 0 {
+		// the patch is applied as a whole or not at all
+		pstat.Status = http.StatusFailedDependency
+		return []webdav.Propstat{protected, pstat}, nil
+	}
+	operation := fmt.Sprintf("Patch %d dead properties of '%s'", len(pstat.Props), wf.name)
+	err = payers{wf.writerUid}.charge(wf.db, wf.prices, config.OpPatch, int64(len(pstat.Props)), operation)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]webdav.Property, 0, len(props))
+	for _, prop := range props {
+		list = append(list, prop)
+	}
+	var value []byte
+	if len(list) != 0 {
+		value, err = json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = types.SetDeadProps(wf.db, wf.ownerUid, wf.path, value)
+	if err != nil {
+		return nil, err
+	}
+	return []webdav.Propstat{pstat}, nil
+}
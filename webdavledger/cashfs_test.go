@@ -0,0 +1,99 @@
+package webdavledger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+const propSet = `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:test"><D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`
+
+// The prices of testPrices are summed in the order of the calls the webdav handler makes.
+func TestHandlerCharges(t *testing.T) {
+	content := strings.Repeat("z", 5000) // read for 5 KB
+	cases := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header map[string]string
+		code   int
+		want   int64
+	}{
+		{"mkcol", "MKCOL", "/home/d", "", nil, 201, 200},
+		// open, file stat for the etag, close and 3 KB written
+		{"put new", "PUT", "/home/n.txt", strings.Repeat("x", 3000), nil, 201, 7 + 30 + 5 + 3*2},
+		{"put over", "PUT", "/home/f.txt", strings.Repeat("x", 3000), nil, 201, 7 + 30 + 5 + 3*2},
+		// ServeContent seeks to the end and back to find the size
+		{"get", "GET", "/home/f.txt", "", nil, 200, 7 + 30 + 3 + 3 + 5 + 5},
+		{"head", "HEAD", "/home/f.txt", "", nil, 200, 7 + 30 + 3 + 3 + 5},
+		// the root is stated, opened twice for its properties and listed, then each of
+		// the 2 files is stated, opened for its properties and opened again for the etag
+		{"propfind", "PROPFIND", "/home/", "", map[string]string{"Depth": "1"}, 207,
+			30 + 2*(7+30+5) + 7 + 2*20 + 5 + 2*(30+7+30+5+7+30+7+5+5)},
+		{"proppatch", "PROPPATCH", "/home/f.txt", propSet, nil, 207, 30 + 7 + (40 + 10) + 5},
+		// both files are opened and stated, the properties are copied over, and 5 KB are
+		// read and written
+		{"copy", "COPY", "/home/f.txt", "", map[string]string{"Destination": "/home/c.txt"}, 201,
+			7 + 30 + 30 + 7 + 40 + 5 + 5 + 5 + 5*2},
+		{"move", "MOVE", "/home/f.txt", "", map[string]string{"Destination": "/home/m.txt"}, 201, 30 + 150},
+		{"delete", "DELETE", "/home/g.txt", "", nil, 204, 30 + 100},
+		{"options", "OPTIONS", "/home/f.txt", "", nil, 200, 30},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			td := newTestDisk(t)
+			td.writeFile(td.owner, "f.txt", content)
+			td.writeFile(td.owner, "g.txt", "g")
+			w := td.serve(td.owner, c.method, c.target, c.body, c.header)
+			if w.Code != c.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.code, w.Body.String())
+			}
+			if got := testBalance - td.balance(td.owner); got != c.want {
+				t.Errorf("charged %d, want %d", got, c.want)
+			}
+			if got := testBalance - td.balance(td.other); got != 0 {
+				t.Errorf("charged %d to another user", got)
+			}
+		})
+	}
+}
+
+func TestSharedDirCharges(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		payer     byte
+		code      int
+		wantOwner int64
+		wantOther int64
+	}{
+		// the writer pays for the whole write-only handle, whoever pays for reading
+		{"put owner pays", "PUT", types.PayerOwner, 201, 0, 7 + 30 + 5 + 3*2},
+		{"put reader pays", "PUT", types.PayerReader, 201, 0, 7 + 30 + 5 + 3*2},
+		{"get owner pays", "GET", types.PayerOwner, 200, 7 + 30 + 3 + 3 + 5 + 5, 0},
+		{"get reader pays", "GET", types.PayerReader, 200, 0, 7 + 30 + 3 + 3 + 5 + 5},
+		// the owner pays the odd points
+		{"get split", "GET", types.PayerSplit, 200, 4 + 15 + 2 + 2 + 3 + 3, 3 + 15 + 1 + 1 + 2 + 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			td := newTestDisk(t)
+			td.writeFile(td.owner, "pub/f.txt", strings.Repeat("z", 5000))
+			td.share("pub", types.PermAll, c.payer)
+			target := "/shared/" + td.owner.addr.Hex() + "/pub/f.txt"
+			w := td.serve(td.other, c.method, target, strings.Repeat("x", 3000), nil)
+			if w.Code != c.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.code, w.Body.String())
+			}
+			if got := testBalance - td.balance(td.owner); got != c.wantOwner {
+				t.Errorf("owner charged %d, want %d", got, c.wantOwner)
+			}
+			if got := testBalance - td.balance(td.other); got != c.wantOther {
+				t.Errorf("reader charged %d, want %d", got, c.wantOther)
+			}
+		})
+	}
+}
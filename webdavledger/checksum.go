@@ -0,0 +1,178 @@
+package webdavledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+// The SHA-256 of the content of a file is recorded when it is written through WatchedFile.
+// It is served as the strong ETag of the file and as a protected dead property, and the
+// scrub job compares it with the stored content to detect corruption.
+var checksumPropName = xml.Name{Space: "https://github.com/smartbch/cashdisk", Local: "sha256"}
+
+// checksumInfo makes the recorded checksum of a file its ETag
+type checksumInfo struct {
+	os.FileInfo
+	db   *badger.DB
+	uid  int64
+	path string
+}
+
+var _ webdav.ETager = (*checksumInfo)(nil)
+
+func (fi *checksumInfo) ETag(ctx context.Context) (string, error) {
+	if fi.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	sum, err := types.GetChecksum(fi.db, fi.uid, fi.path)
+	if err != nil {
+		return "", err
+	}
+	if sum == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + hex.EncodeToString(sum) + `"`, nil
+}
+
+// etagOf returns the ETag webdav.Handler serves for fi
+func etagOf(ctx context.Context, fi os.FileInfo) (string, error) {
+	if e, ok := fi.(webdav.ETager); ok {
+		etag, err := e.ETag(ctx)
+		if err != webdav.ErrNotImplemented {
+			return etag, err
+		}
+	}
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+func hashFile(fs webdav.FileSystem, name string) (hash.Hash, error) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	return h, err
+}
+
+// etagMatches reports whether etag is in the list of an If-Match header, with the strong
+// comparison, so weak ETags never match
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch fails a PUT with 412 Precondition Failed unless the current ETag of its
+// target matches If-Match, which webdav.Handler does not check. The target is stated
+// without charging, as the PUT itself is charged.
+func (wd *WatchedDir) checkIfMatch(w http.ResponseWriter, r *http.Request, prefix string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if r.Method != http.MethodPut || ifMatch == "" {
+		return true
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	fi, err := wd.FileSystem.Stat(r.Context(), name)
+	if err == nil {
+		fi = &checksumInfo{FileInfo: fi, db: wd.db, uid: wd.ownerUid, path: wd.pathOf(name)}
+		var etag string
+		etag, err = etagOf(r.Context(), fi)
+		if err == nil && etagMatches(ifMatch, etag) {
+			return true
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+	return false
+}
+
+// serveWatched serves wd with webdav.Handler under prefix, with the locks of the owner
+// of wd
+func (d *DiskService) serveWatched(w http.ResponseWriter, r *http.Request, prefix string, wd *WatchedDir) {
+	if !wd.checkIfMatch(w, r, prefix) {
+		return
+	}
+	handler := &webdav.Handler{Prefix: prefix, FileSystem: wd, LockSystem: newOwnerLockSystem(d.locks, wd)}
+	serveMetered(w, r, handler, wd.db, wd.prices, wd.readers)
+}
+
+// Scrub hashes all the files with recorded checksums again, and returns those whose
+// content no longer matches. The checksums of the files which are gone are deleted, the
+// files in the trash are not scrubbed.
+func (d *DiskService) Scrub() ([]types.FileChecksumInfo, error) {
+	infos, err := types.GetChecksums(d.db, -1)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []types.FileChecksumInfo
+	for _, info := range infos {
+		if isTrashedMetadataPath(info.Path) {
+			continue
+		}
+		owner, err := types.GetAddressByUID(d.db, info.Uid)
+		if err != nil {
+			return mismatches, err
+		}
+		fs, err := d.newFS(owner, "")
+		if err != nil {
+			return mismatches, err
+		}
+		h, err := hashFile(fs, info.Path)
+		if os.IsNotExist(err) {
+			err = types.SetChecksum(d.db, info.Uid, info.Path, nil)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("Error in scrubbing '%s' of %s: %s\n", info.Path, owner, err.Error())
+			continue
+		}
+		if bytes.Equal(h.Sum(nil), info.Sum) {
+			continue
+		}
+		// the file may have been written since the checksums were read
+		sum, err := types.GetChecksum(d.db, info.Uid, info.Path)
+		if err != nil || !bytes.Equal(sum, info.Sum) {
+			continue
+		}
+		log.Printf("Checksum mismatch of '%s' of %s\n", info.Path, owner)
+		mismatches = append(mismatches, info)
+	}
+	return mismatches, nil
+}
+
+func (d *DiskService) StartScrubRoutine() {
+	for {
+		time.Sleep(d.cfg.ScrubInterval)
+		mismatches, err := d.Scrub()
+		if err != nil {
+			log.Printf("Error in Scrub: %s\n", err.Error())
+		}
+		log.Printf("Scrub done, %d files corrupted\n", len(mismatches))
+	}
+}
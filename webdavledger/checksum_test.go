@@ -0,0 +1,160 @@
+package webdavledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+func etagOfContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestChecksumETag(t *testing.T) {
+	td := newTestDisk(t)
+	w := td.serve(td.owner, "PUT", "/home/f.txt", "hello", nil)
+	if w.Code != 201 || w.Header().Get("ETag") != etagOfContent("hello") {
+		t.Fatalf("put: status %d, etag %s", w.Code, w.Header().Get("ETag"))
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		w = td.serve(td.owner, method, "/home/f.txt", "", nil)
+		if w.Code != 200 || w.Header().Get("ETag") != etagOfContent("hello") {
+			t.Errorf("%s: status %d, etag %s", method, w.Code, w.Header().Get("ETag"))
+		}
+	}
+	// the files written without WatchedFile have no checksum, their ETag is not a sha256
+	td.writeFile(td.owner, "g.txt", "hello")
+	w = td.serve(td.owner, "HEAD", "/home/g.txt", "", nil)
+	if w.Code != 200 || w.Header().Get("ETag") == "" || w.Header().Get("ETag") == etagOfContent("hello") {
+		t.Errorf("head of a file without checksum: status %d, etag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	td := newTestDisk(t)
+	td.serve(td.owner, "PUT", "/home/f.txt", "first", nil)
+	cases := []struct {
+		name    string
+		target  string
+		ifMatch string
+		code    int
+		content string
+	}{
+		{"stale etag", "/home/f.txt", etagOfContent("other"), 412, "first"},
+		{"weak etag", "/home/f.txt", "W/" + etagOfContent("first"), 412, "first"},
+		{"missing file", "/home/n.txt", "*", 412, ""},
+		{"current etag", "/home/f.txt", `"x", ` + etagOfContent("first"), 201, "second"},
+		{"any etag", "/home/f.txt", "*", 201, "third"},
+	}
+	for _, c := range cases {
+		w := td.serve(td.owner, "PUT", c.target, c.name, map[string]string{"If-Match": c.ifMatch})
+		if c.code == 201 {
+			c.content = c.name
+		}
+		content, _ := td.readFile(td.owner, c.target[len("/home/"):])
+		if w.Code != c.code || content != c.content {
+			t.Errorf("%s: status %d, want %d, content %q", c.name, w.Code, c.code, content)
+		}
+	}
+}
+
+func TestChecksumsFollowTheFiles(t *testing.T) {
+	td := newTestDisk(t)
+	for _, dir := range []string{"d", "d/sub", "d2"} {
+		if w := td.serve(td.owner, "MKCOL", "/home/"+dir, "", nil); w.Code != 201 {
+			t.Fatalf("mkcol %s: status %d", dir, w.Code)
+		}
+	}
+	for _, p := range []string{"d/a.txt", "d/sub/b.txt", "d2/c.txt", "d.txt"} {
+		w := td.serve(td.owner, "PUT", "/home/"+p, p, nil)
+		if w.Code != 201 {
+			t.Fatalf("put %s: status %d", p, w.Code)
+		}
+	}
+	check := func(step string, wantTrashed int, paths ...string) {
+		infos, err := types.GetChecksums(td.db, td.owner.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the checksums of the deleted files follow them into the trash
+		sums := make(map[string]string)
+		trashed := 0
+		for _, info := range infos {
+			if isTrashedMetadataPath(info.Path) {
+				trashed++
+				continue
+			}
+			sums[info.Path] = `"` + hex.EncodeToString(info.Sum) + `"`
+		}
+		if len(sums) != len(paths)/2 || trashed != wantTrashed {
+			t.Errorf("%s: checksums of %v", step, infos)
+		}
+		// the checksums keep the content they were computed from
+		for i := 0; i < len(paths); i += 2 {
+			if sums[paths[i]] != etagOfContent(paths[i+1]) {
+				t.Errorf("%s: checksum of %s is %s", step, paths[i], sums[paths[i]])
+			}
+		}
+	}
+	check("put", 0, "d/a.txt", "d/a.txt", "d/sub/b.txt", "d/sub/b.txt", "d2/c.txt", "d2/c.txt", "d.txt", "d.txt")
+
+	// only the files under d move, not those of d2 nor d.txt
+	w := td.serve(td.owner, "MOVE", "/home/d", "", map[string]string{"Destination": "/home/e"})
+	if w.Code != 201 {
+		t.Fatalf("move: status %d", w.Code)
+	}
+	check("move", 0, "e/a.txt", "d/a.txt", "e/sub/b.txt", "d/sub/b.txt", "d2/c.txt", "d2/c.txt", "d.txt", "d.txt")
+
+	w = td.serve(td.owner, "DELETE", "/home/e", "", nil)
+	if w.Code != 204 {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	check("delete", 2, "d2/c.txt", "d2/c.txt", "d.txt", "d.txt")
+}
+
+func TestScrub(t *testing.T) {
+	td := newTestDisk(t)
+	for _, u := range []testUser{td.owner, td.other} {
+		for _, p := range []string{"intact.txt", "corrupted.txt", "gone.txt"} {
+			w := td.serve(u, "PUT", "/home/"+p, p, nil)
+			if w.Code != 201 {
+				t.Fatalf("put %s: status %d", p, w.Code)
+			}
+		}
+	}
+	// the backend changes behind the disk service
+	td.writeFile(td.owner, "corrupted.txt", "bit rot")
+	err := td.root.RemoveAll(context.Background(), homePath(td.owner.addr, "gone.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := td.d.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Uid != td.owner.uid || mismatches[0].Path != "corrupted.txt" {
+		t.Errorf("mismatches: %+v", mismatches)
+	}
+	for _, c := range []struct {
+		u      testUser
+		exists bool
+	}{{td.owner, false}, {td.other, true}} {
+		sum, err := types.GetChecksum(td.db, c.u.uid, "gone.txt")
+		if err != nil || (sum != nil) != c.exists {
+			t.Errorf("checksum of the removed file of uid %d: %x, %v", c.u.uid, sum, err)
+		}
+	}
+	// scrubbing does not charge the users
+	for _, u := range []testUser{td.owner, td.other} {
+		before := td.balance(u)
+		_, err = td.d.Scrub()
+		if err != nil || td.balance(u) != before {
+			t.Errorf("scrubbing charged %d to uid %d: %v", before-td.balance(u), u.uid, err)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package webdavledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// An encrypted file starts with a header of cryptMagic and a random file id, followed by
+// the chunks of its content. Each chunk holds up to cryptChunkSize bytes of plaintext,
+// sealed with AES-GCM under a random nonce, the file id, the chunk index and whether it
+// is the last chunk being the additional data, so that chunks cannot be moved around and
+// the file cannot be truncated. Any chunk can be decrypted alone, which allows Seek and
+// partial writes. An empty file has an empty last chunk.
+const (
+	cryptMagic      = "CDE1"
+	cryptFileIdSize = 16
+	cryptHeaderSize = len(cryptMagic) + cryptFileIdSize
+	cryptChunkSize  = 64 * 1024
+	cryptNonceSize  = 12
+	cryptChunkExtra = cryptNonceSize + 16 // the nonce and the GCM tag
+)
+
+var ErrCorruptedFile = errors.New("the encrypted file is corrupted")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyring keeps a random data key for each user, wrapped by the master key in the
+// database, so that the files of a user can be re-keyed without touching the others
+type keyring struct {
+	db     *badger.DB
+	master cipher.AEAD
+	keys   sync.Map // common.Address -> *userKey
+}
+
+// userKey is the data key of a user, with the time it was created. All the files the user
+// writes after it are encrypted, so only the files last written before it can be read
+// as plaintext. A file stripped of its header is thus not taken for a plaintext file.
+type userKey struct {
+	aead  cipher.AEAD
+	since time.Time
+}
+
+// cryptClockSkew is the uncertainty of the modification times reported by the backend,
+// whose clock may differ from ours
+const cryptClockSkew = time.Minute
+
+// mayBePlaintext tells whether fi, stated on the underlying file system, may be a file
+// stored before the data key was created
+func (k *userKey) mayBePlaintext(fi os.FileInfo) bool {
+	return fi.ModTime().Before(k.since.Add(cryptClockSkew))
+}
+
+func newKeyring(db *badger.DB, masterKey []byte) (*keyring, error) {
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{db: db, master: master}, nil
+}
+
+func (kr *keyring) dataKey(addr common.Address) (*userKey, error) {
+	if key, ok := kr.keys.Load(addr); ok {
+		return key.(*userKey), nil
+	}
+	stored, err := types.GetDataKey(kr.db, addr)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		key := make([]byte, 32)
+		nonce := make([]byte, cryptNonceSize)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if _, err = rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		since := utils.Int64ToBytes(time.Now().UnixNano())
+		value := kr.master.Seal(append(since, nonce...), nonce, key, append(addr.Bytes(), since...))
+		stored, err = types.SetDataKeyIfAbsent(kr.db, addr, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) < 8+cryptNonceSize {
+		return nil, ErrCorruptedFile
+	}
+	// the creation time is authenticated together with the address
+	since, wrapped := stored[:8], stored[8:]
+	key, err := kr.master.Open(nil, wrapped[:cryptNonceSize], wrapped[cryptNonceSize:], append(addr.Bytes(), since...))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	uk := &userKey{aead: aead, since: time.Unix(0, utils.BytesToInt64(since))}
+	kr.keys.Store(addr, uk)
+	return uk, nil
+}
+
+// cryptFS encrypts the files of the underlying file system, and reports their plaintext
+// sizes. The files without the header which were stored before encryption was enabled
+// are taken as plaintext, so they are still readable, but they can only be replaced as a
+// whole.
+type cryptFS struct {
+	webdav.FileSystem
+	key *userKey
+}
+
+var _ webdav.FileSystem = (*cryptFS)(nil)
+
+func (c *cryptFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	underFlag := flag &^ os.O_APPEND
+	if writable {
+		// the chunks around the written bytes must be read back
+		underFlag = underFlag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := c.FileSystem.OpenFile(ctx, name, underFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &cryptDir{File: f, fs: c, name: name}, nil
+	}
+	cf, err := newCryptFile(f, c.key, fi, writable)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if flag&os.O_APPEND != 0 {
+		_, err = cf.Seek(0, io.SeekEnd)
+	}
+	return cf, err
+}
+
+func (c *cryptFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := c.FileSystem.Stat(ctx, name)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	return c.plaintextInfo(ctx, name, fi)
+}
+
+// plaintextInfo returns fi with the size of the plaintext. The file is opened only if its
+// modification time is too close to the creation of the data key to tell whether it is
+// encrypted, otherwise the size is derived from the size on disk.
+func (c *cryptFS) plaintextInfo(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, error) {
+	if fi.Size() == 0 || fi.ModTime().Before(c.key.since.Add(-cryptClockSkew)) {
+		return fi, nil
+	}
+	if !c.key.mayBePlaintext(fi) {
+		return &sizedFileInfo{FileInfo: fi, size: plaintextSize(fi.Size())}, nil
+	}
+	f, err := c.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cf, err := newCryptFile(f, c.key, fi, false)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: fi, size: cf.size}, nil
+}
+
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *sizedFileInfo) Size() int64 { return fi.size }
+
+// cryptDir is an opened directory of cryptFS
+type cryptDir struct {
+	webdav.File
+	fs   *cryptFS
+	name string
+}
+
+func (d *cryptDir) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+		info, err := d.fs.plaintextInfo(context.Background(), d.name+"/"+fi.Name(), fi)
+		if err == nil {
+			infos[i] = info
+		}
+	}
+	return infos, err
+}
+
+// cryptFile is an opened regular file of cryptFS. It buffers the plaintext of one chunk,
+// which is sealed again when another chunk is accessed or the file is closed.
+type cryptFile struct {
+	webdav.File
+	aead   cipher.AEAD
+	fileId []byte // nil for a plaintext file
+	size   int64  // the size of the plaintext
+	off    int64
+	chunks int64 // the number of chunks on disk
+	// the end of the write in progress, the size the chunks are sealed for
+	writeEnd int64
+
+	chunk    []byte
+	chunkIdx int64
+	dirty    bool
+}
+
+var _ webdav.File = (*cryptFile)(nil)
+
+var (
+	// ErrPlaintextFile is returned for the plaintext files stored before encryption was
+	// enabled, when they are opened to be modified in place
+	ErrPlaintextFile = errors.New("the unencrypted file can only be replaced as a whole")
+	// ErrUnencryptedFile is returned for the files without the header written after
+	// encryption was enabled, whose content was not written by the service
+	ErrUnencryptedFile = errors.New("the file should be encrypted")
+)
+
+// newCryptFile reads the header of f, stated as fi on the underlying file system. An
+// empty file opened for writing is given a header.
+func newCryptFile(f webdav.File, key *userKey, fi os.FileInfo, writable bool) (*cryptFile, error) {
+	cf := &cryptFile{File: f, aead: key.aead, chunkIdx: -1}
+	diskSize := fi.Size()
+	if diskSize == 0 && writable {
+		cf.fileId = make([]byte, cryptFileIdSize)
+		_, err := rand.Read(cf.fileId)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(append([]byte(cryptMagic), cf.fileId...))
+		// the empty last chunk
+		cf.chunkIdx, cf.chunk, cf.dirty = 0, []byte{}, true
+		return cf, err
+	}
+	header := make([]byte, cryptHeaderSize)
+	_, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if err != nil || !bytes.Equal(header[:len(cryptMagic)], []byte(cryptMagic)) {
+		if diskSize != 0 && !key.mayBePlaintext(fi) {
+			return nil, ErrUnencryptedFile
+		}
+		if diskSize != 0 && writable {
+			// the file would be written after the data key was created
+			return nil, ErrPlaintextFile
+		}
+		cf.size = diskSize
+		_, err = f.Seek(0, io.SeekStart)
+		return cf, err
+	}
+	cf.fileId = header[len(cryptMagic):]
+	cf.size = plaintextSize(diskSize)
+	body := diskSize - int64(cryptHeaderSize)
+	cf.chunks = (body + cryptChunkSize + cryptChunkExtra - 1) / (cryptChunkSize + cryptChunkExtra)
+	return cf, nil
+}
+
+// plaintextSize returns the size of the plaintext of an encrypted file of diskSize bytes
+func plaintextSize(diskSize int64) int64 {
+	body := diskSize - int64(cryptHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	full, rest := body/(cryptChunkSize+cryptChunkExtra), body%(cryptChunkSize+cryptChunkExtra)
+	size := full * cryptChunkSize
+	if rest > cryptChunkExtra {
+		size += rest - cryptChunkExtra
+	}
+	return size
+}
+
+// lastChunk returns the index of the last chunk of a file of size bytes of plaintext
+func lastChunk(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / cryptChunkSize
+}
+
+func (cf *cryptFile) chunkOffset(idx int64) int64 {
+	return int64(cryptHeaderSize) + idx*(cryptChunkSize+cryptChunkExtra)
+}
+
+// additionalData returns the additional data of the chunk idx of a file of size bytes
+func (cf *cryptFile) additionalData(idx, size int64) []byte {
+	ad := binary.BigEndian.AppendUint64(append([]byte{}, cf.fileId...), uint64(idx))
+	if idx == lastChunk(size) {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// loadChunk makes the chunk idx the buffered one
+func (cf *cryptFile) loadChunk(idx int64) error {
+	if cf.chunkIdx == idx {
+		return nil
+	}
+	err := cf.flush()
+	if err != nil {
+		return err
+	}
+	cf.chunkIdx, cf.chunk = idx, nil
+	if idx >= cf.chunks {
+		return nil
+	}
+	_, err = cf.File.Seek(cf.chunkOffset(idx), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, cryptChunkSize+cryptChunkExtra)
+	n, err := io.ReadFull(cf.File, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < cryptChunkExtra {
+		return ErrCorruptedFile
+	}
+	cf.chunk, err = cf.aead.Open(nil, sealed[:cryptNonceSize], sealed[cryptNonceSize:n], cf.additionalData(idx, cf.size))
+	if err != nil {
+		cf.chunkIdx = -1
+		return ErrCorruptedFile
+	}
+	return nil
+}
+
+func (cf *cryptFile) flush() error {
+	if !cf.dirty {
+		return nil
+	}
+	nonce := make([]byte, cryptNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	_, err = cf.File.Seek(cf.chunkOffset(cf.chunkIdx), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	size := cf.size
+	if cf.writeEnd > size {
+		size = cf.writeEnd
+	}
+	_, err = cf.File.Write(cf.aead.Seal(nonce, nonce, cf.chunk, cf.additionalData(cf.chunkIdx, size)))
+	if err != nil {
+		return err
+	}
+	if cf.chunkIdx >= cf.chunks {
+		cf.chunks = cf.chunkIdx + 1
+	}
+	cf.dirty = false
+	return nil
+}
+
+func (cf *cryptFile) Read(p []byte) (int, error) {
+	if cf.fileId == nil {
+		return cf.File.Read(p)
+	}
+	if cf.off >= cf.size {
+		// the last chunk is authenticated as such before the end of the file is reported
+		last := lastChunk(cf.size)
+		if cf.chunkIdx != last && last >= cf.chunks {
+			return 0, ErrCorruptedFile
+		}
+		err := cf.loadChunk(last)
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	err := cf.loadChunk(cf.off / cryptChunkSize)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, cf.chunk[cf.off%cryptChunkSize:])
+	cf.off += int64(n)
+	return n, nil
+}
+
+func (cf *cryptFile) Write(p []byte) (int, error) {
+	if cf.fileId == nil {
+		return cf.File.Write(p)
+	}
+	if cf.off > cf.size {
+		// fill the hole with zeros, chunk by chunk
+		off := cf.off
+		cf.off = cf.size
+		_, err := cf.Write(make([]byte, off-cf.size))
+		if err != nil {
+			return 0, err
+		}
+	}
+	end := cf.off + int64(len(p))
+	cf.writeEnd = end
+	defer func() { cf.writeEnd = 0 }()
+	if last := lastChunk(cf.size); lastChunk(end) > last {
+		// the current last chunk is sealed again as an inner chunk
+		err := cf.loadChunk(last)
+		if err != nil {
+			return 0, err
+		}
+		cf.dirty = true
+	}
+	written := 0
+	for written < len(p) {
+		err := cf.loadChunk(cf.off / cryptChunkSize)
+		if err != nil {
+			return written, err
+		}
+		pos := int(cf.off % cryptChunkSize)
+		n := len(p) - written
+		if n > cryptChunkSize-pos {
+			n = cryptChunkSize - pos
+		}
+		if pos+n > len(cf.chunk) {
+			cf.chunk = append(cf.chunk, make([]byte, pos+n-len(cf.chunk))...)
+		}
+		copy(cf.chunk[pos:], p[written:written+n])
+		cf.dirty = true
+		written += n
+		cf.off += int64(n)
+		if cf.off > cf.size {
+			cf.size = cf.off
+		}
+	}
+	return written, nil
+}
+
+func (cf *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	if cf.fileId == nil {
+		return cf.File.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += cf.off
+	case io.SeekEnd:
+		offset += cf.size
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	cf.off = offset
+	return offset, nil
+}
+
+func (cf *cryptFile) Stat() (fs.FileInfo, error) {
+	fi, err := cf.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: fi, size: cf.size}, nil
+}
+
+func (cf *cryptFile) Close() error {
+	err := cf.flush()
+	closeErr := cf.File.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
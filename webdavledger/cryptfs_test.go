@@ -0,0 +1,320 @@
+package webdavledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+// newTestCryptFS returns a cryptFS over a MemFS, with a data key created at since
+func newTestCryptFS(t *testing.T, since time.Time) (*cryptFS, webdav.FileSystem) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := webdav.NewMemFS()
+	return &cryptFS{FileSystem: mem, key: &userKey{aead: aead, since: since}}, mem
+}
+
+func randomContent(size int) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content
+}
+
+func writeTestFile(t *testing.T, fs webdav.FileSystem, name string, content []byte, piece int) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(content) > 0 {
+		n := piece
+		if n > len(content) {
+			n = len(content)
+		}
+		_, err = f.Write(content[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(fs webdav.FileSystem, name string) ([]byte, error) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	c, mem := newTestCryptFS(t, time.Now().Add(-time.Hour))
+	ctx := context.Background()
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3*cryptChunkSize + 100} {
+		content := randomContent(size)
+		writeTestFile(t, c, "/f", content, 1000)
+		read, err := readTestFile(c, "/f")
+		if err != nil || !bytes.Equal(read, content) {
+			t.Fatalf("reading %d bytes back: %v", size, err)
+		}
+
+		chunks := (size + cryptChunkSize - 1) / cryptChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		disk, err := mem.Stat(ctx, "/f")
+		if err != nil || disk.Size() != int64(cryptHeaderSize+chunks*cryptChunkExtra+size) {
+			t.Fatalf("%d bytes stored as %d bytes: %v", size, disk.Size(), err)
+		}
+		fi, err := c.Stat(ctx, "/f")
+		if err != nil || fi.Size() != int64(size) {
+			t.Errorf("stat of %d bytes: size %d, %v", size, fi.Size(), err)
+		}
+		dir, err := c.OpenFile(ctx, "/", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := dir.Readdir(0)
+		dir.Close()
+		if err != nil || len(infos) != 1 || infos[0].Size() != int64(size) {
+			t.Errorf("listing of %d bytes: %v, %v", size, infos, err)
+		}
+	}
+}
+
+func TestCryptSeekAndPartialWrites(t *testing.T) {
+	c, _ := newTestCryptFS(t, time.Now().Add(-time.Hour))
+	ctx := context.Background()
+	expected := randomContent(2*cryptChunkSize + 500)
+	writeTestFile(t, c, "/f", expected, cryptChunkSize)
+
+	f, err := c.OpenFile(ctx, "/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt := func(off int64, whence int, p []byte) {
+		pos, err := f.Seek(off, whence)
+		if err == nil {
+			_, err = f.Write(p)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end := int(pos) + len(p); end > len(expected) {
+			expected = append(expected, make([]byte, end-len(expected))...)
+		}
+		copy(expected[pos:], p)
+	}
+	// across the boundary of two chunks
+	writeAt(cryptChunkSize-10, io.SeekStart, bytes.Repeat([]byte("a"), 20))
+	// over the end of the file
+	writeAt(-5, io.SeekEnd, bytes.Repeat([]byte("b"), 10))
+	// after a hole of more than a chunk
+	writeAt(4*cryptChunkSize+7, io.SeekStart, []byte("c"))
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = c.OpenFile(ctx, "/f", os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		_, err = f.Write([]byte("appended"))
+		expected = append(expected, "appended"...)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTestFile(c, "/f")
+	if err != nil || !bytes.Equal(read, expected) {
+		t.Fatalf("reading %d bytes back, %d expected: %v", len(read), len(expected), err)
+	}
+
+	f, err = c.OpenFile(ctx, "/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, seek := range []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{cryptChunkSize - 3, io.SeekStart, cryptChunkSize - 3},
+		{cryptChunkSize, io.SeekCurrent, 2*cryptChunkSize + 1},
+		{-4, io.SeekEnd, int64(len(expected) - 4)},
+	} {
+		pos, err := f.Seek(seek.offset, seek.whence)
+		if err != nil || pos != seek.pos {
+			t.Fatalf("seeked to %d instead of %d: %v", pos, seek.pos, err)
+		}
+		p := make([]byte, 4)
+		_, err = io.ReadFull(f, p)
+		if err != nil || !bytes.Equal(p, expected[pos:pos+4]) {
+			t.Errorf("reading at %d: %v", pos, err)
+		}
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read %d bytes at the end: %v", n, err)
+	}
+	if _, err = f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeked before the start")
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != int64(len(expected)) {
+		t.Errorf("stat of %d bytes: size %d, %v", len(expected), fi.Size(), err)
+	}
+}
+
+func TestCryptTampering(t *testing.T) {
+	c, mem := newTestCryptFS(t, time.Now().Add(-time.Hour))
+	writeTestFile(t, c, "/f", randomContent(3*cryptChunkSize+10), cryptChunkSize)
+	stored, err := readTestFile(mem, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(idx int) []byte {
+		start := cryptHeaderSize + idx*(cryptChunkSize+cryptChunkExtra)
+		end := start + cryptChunkSize + cryptChunkExtra
+		if end > len(stored) {
+			end = len(stored)
+		}
+		return stored[start:end]
+	}
+	header := stored[:cryptHeaderSize]
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		err     error
+	}{
+		{"swapped chunks", join(header, chunk(1), chunk(0), chunk(2), chunk(3)), ErrCorruptedFile},
+		{"truncated last chunk", stored[:len(stored)-5], ErrCorruptedFile},
+		{"dropped last chunk", join(header, chunk(0), chunk(1), chunk(2)), ErrCorruptedFile},
+		{"only the header", header, ErrCorruptedFile},
+		{"stripped header", stored[cryptHeaderSize:], ErrUnencryptedFile},
+	} {
+		writeTestFile(t, mem, "/g", tc.content, len(tc.content)+1)
+		_, err = readTestFile(c, "/g")
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	// a chunk sealed for another file is rejected, even at the same index
+	writeTestFile(t, c, "/h", randomContent(3*cryptChunkSize+10), cryptChunkSize)
+	other, err := readTestFile(mem, "/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, mem, "/g", join(header, chunk(0), other[len(header)+len(chunk(0)):]), len(stored))
+	_, err = readTestFile(c, "/g")
+	if !errors.Is(err, ErrCorruptedFile) {
+		t.Errorf("chunks of another file: %v", err)
+	}
+}
+
+func TestCryptPlaintextFiles(t *testing.T) {
+	// the files of the MemFS are all written before the data key is created
+	c, mem := newTestCryptFS(t, time.Now().Add(time.Hour))
+	ctx := context.Background()
+	content := []byte("stored before the encryption")
+	writeTestFile(t, mem, "/f", content, len(content))
+	read, err := readTestFile(c, "/f")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("reading a plaintext file: %q, %v", read, err)
+	}
+	fi, err := c.Stat(ctx, "/f")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Errorf("stat of a plaintext file: size %d, %v", fi.Size(), err)
+	}
+	_, err = c.OpenFile(ctx, "/f", os.O_RDWR, 0)
+	if !errors.Is(err, ErrPlaintextFile) {
+		t.Errorf("modifying a plaintext file: %v", err)
+	}
+	// replaced as a whole, it is encrypted
+	writeTestFile(t, c, "/f", content, len(content))
+	stored, err := readTestFile(mem, "/f")
+	if err != nil || !bytes.HasPrefix(stored, []byte(cryptMagic)) {
+		t.Errorf("replacing a plaintext file: %q, %v", stored, err)
+	}
+	read, err = readTestFile(c, "/f")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("reading a replaced plaintext file: %q, %v", read, err)
+	}
+}
+
+func TestDataKeys(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	master := bytes.Repeat([]byte{1}, 32)
+	alice := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	bob := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	kr, err := newKeyring(db, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := kr.dataKey(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(key.since) > time.Minute {
+		t.Errorf("data key created at %s", key.since)
+	}
+	// the key is unwrapped again after a restart
+	kr, err = newKeyring(db, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := kr.dataKey(alice)
+	if err != nil || !again.since.Equal(key.since) {
+		t.Fatalf("data key created at %s then %s: %v", key.since, again.since, err)
+	}
+	nonce := make([]byte, cryptNonceSize)
+	sealed := key.aead.Seal(nil, nonce, []byte("content"), nil)
+	if opened, err := again.aead.Open(nil, nonce, sealed, nil); err != nil || string(opened) != "content" {
+		t.Errorf("the unwrapped key differs: %v", err)
+	}
+
+	// the key of alice cannot be unwrapped as the key of bob, nor with another master key
+	wrapped, err := types.GetDataKey(db, alice)
+	if err == nil {
+		_, err = types.SetDataKeyIfAbsent(db, bob, wrapped)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kr.dataKey(bob); err == nil {
+		t.Error("unwrapped the key of alice for bob")
+	}
+	kr, err = newKeyring(db, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kr.dataKey(alice); err == nil {
+		t.Error("unwrapped the key with another master key")
+	}
+}
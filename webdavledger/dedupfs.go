@@ -0,0 +1,657 @@
+package webdavledger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+// A deduplicated file is stored as a manifest: dedupMagic, the 8-byte size of the content,
+// and the hash and the 4-byte size of each block of the content. The blocks are cut where
+// a gear rolling hash of the content matches blockMask, so an insertion only changes the
+// blocks around it, and each distinct block is stored once at /.blocks/<hash> however many
+// files refer to it.
+const (
+	BlocksDir = ".blocks"
+
+	dedupMagic      = "CDD1"
+	dedupHeaderSize = len(dedupMagic) + 8
+	dedupEntrySize  = sha256.Size + 4
+
+	minBlockSize = 16 * 1024
+	maxBlockSize = 256 * 1024
+	blockMask    = 64*1024 - 1 // 64KB blocks on average
+)
+
+var ErrCorruptedBlock = errors.New("the block does not match its hash")
+
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		h := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(h[:8])
+	}
+}
+
+type blockEntry struct {
+	hash [32]byte
+	size int64
+}
+
+type manifest struct {
+	size   int64
+	blocks []blockEntry
+	ends   []int64 // the end offset of each block in the content
+}
+
+func (m *manifest) append(b blockEntry) {
+	m.blocks = append(m.blocks, b)
+	m.size += b.size
+	m.ends = append(m.ends, m.size)
+}
+
+func (m *manifest) encode() []byte {
+	bz := binary.BigEndian.AppendUint64([]byte(dedupMagic), uint64(m.size))
+	for _, b := range m.blocks {
+		bz = append(bz, b.hash[:]...)
+		bz = binary.BigEndian.AppendUint32(bz, uint32(b.size))
+	}
+	return bz
+}
+
+// readManifest reads the manifest from f, or returns nil if f is not deduplicated, which
+// is the case for the files stored before deduplication is enabled. Only the size is read
+// if blocks is false.
+func readManifest(f io.ReadSeeker, blocks bool) (*manifest, error) {
+	header := make([]byte, dedupHeaderSize)
+	_, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if err != nil || !bytes.Equal(header[:len(dedupMagic)], []byte(dedupMagic)) {
+		_, err = f.Seek(0, io.SeekStart)
+		return nil, err
+	}
+	m := &manifest{}
+	if !blocks {
+		m.size = int64(binary.BigEndian.Uint64(header[len(dedupMagic):]))
+		return m, nil
+	}
+	r := bufio.NewReader(f)
+	entry := make([]byte, dedupEntrySize)
+	for {
+		_, err = io.ReadFull(r, entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var b blockEntry
+		copy(b.hash[:], entry)
+		b.size = int64(binary.BigEndian.Uint32(entry[sha256.Size:]))
+		m.append(b)
+	}
+	if m.size != int64(binary.BigEndian.Uint64(header[len(dedupMagic):])) {
+		return nil, ErrCorruptedBlock
+	}
+	return m, nil
+}
+
+// dedupFS stores the content of the files of the underlying file system as deduplicated
+// blocks, whose references are counted in the database. Since encrypted content never
+// repeats, deduplication only pays off when encryption is disabled.
+type dedupFS struct {
+	webdav.FileSystem
+	db         *badger.DB
+	blockLocks stripedLocks // order the reference changes of a block with the storing and deleting of it
+	pathLocks  stripedLocks // order the replacing of the manifest of a file with the releasing of its blocks
+}
+
+var _ webdav.FileSystem = (*dedupFS)(nil)
+var _ StorageSizer = (*dedupFS)(nil)
+
+func newDedupFS(db *badger.DB, fs webdav.FileSystem) *dedupFS {
+	return &dedupFS{FileSystem: fs, db: db}
+}
+
+// stripedLocks spreads the keys over a fixed number of mutexes, so that unrelated keys are
+// rarely serialized without keeping a mutex for each key
+type stripedLocks [256]sync.Mutex
+
+func stripeOf(key string) int {
+	h := sha256.Sum256([]byte(key))
+	return int(h[0])
+}
+
+// lock locks the stripes of the keys in ascending order, so that the callers locking
+// several keys never deadlock, and returns the function unlocking them
+func (l *stripedLocks) lock(keys ...string) (unlock func()) {
+	var locked [len(l)]bool
+	for _, key := range keys {
+		locked[stripeOf(key)] = true
+	}
+	for i := range l {
+		if locked[i] {
+			l[i].Lock()
+		}
+	}
+	return func() {
+		for i := range l {
+			if locked[i] {
+				l[i].Unlock()
+			}
+		}
+	}
+}
+
+func blockPath(hash [32]byte) string {
+	h := hex.EncodeToString(hash[:])
+	return path.Join("/", BlocksDir, h[:2], h)
+}
+
+// storeBlock adds a reference to the block, storing it if it is new
+func (d *dedupFS) storeBlock(ctx context.Context, hash [32]byte, data []byte) error {
+	mu := &d.blockLocks[hash[0]]
+	mu.Lock()
+	defer mu.Unlock()
+	isNew, err := types.RefBlock(d.db, hash, int64(len(data)))
+	if err != nil || !isNew {
+		return err
+	}
+	err = d.writeBlock(ctx, hash, data)
+	if err != nil {
+		types.UnrefBlock(d.db, hash)
+	}
+	return err
+}
+
+func (d *dedupFS) writeBlock(ctx context.Context, hash [32]byte, data []byte) error {
+	p := blockPath(hash)
+	err := mkdirAll(ctx, d.FileSystem, path.Dir(p))
+	if err != nil {
+		return err
+	}
+	f, err := d.FileSystem.OpenFile(ctx, p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// releaseBlocks removes a reference to each block of m, deleting the unused ones
+func (d *dedupFS) releaseBlocks(ctx context.Context, m *manifest) error {
+	for _, b := range m.blocks {
+		err := d.releaseBlock(ctx, b.hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dedupFS) releaseBlock(ctx context.Context, hash [32]byte) error {
+	mu := &d.blockLocks[hash[0]]
+	mu.Lock()
+	defer mu.Unlock()
+	unused, err := types.UnrefBlock(d.db, hash)
+	if err != nil || !unused {
+		return err
+	}
+	err = d.FileSystem.RemoveAll(ctx, blockPath(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *dedupFS) readBlock(ctx context.Context, b blockEntry) ([]byte, error) {
+	f, err := d.FileSystem.OpenFile(ctx, blockPath(b.hash), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(data) != b.hash {
+		return nil, ErrCorruptedBlock
+	}
+	return data, nil
+}
+
+// storeContent cuts the content read from r into blocks, stores them and returns the manifest
+func (d *dedupFS) storeContent(ctx context.Context, r io.Reader) (*manifest, error) {
+	m := &manifest{}
+	br := bufio.NewReaderSize(r, maxBlockSize)
+	block := make([]byte, 0, maxBlockSize)
+	var h uint64
+	flush := func() error {
+		b := blockEntry{hash: sha256.Sum256(block), size: int64(len(block))}
+		err := d.storeBlock(ctx, b.hash, block)
+		if err != nil {
+			return err
+		}
+		m.append(b)
+		block, h = block[:0], 0
+		return nil
+	}
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.releaseBlocks(ctx, m)
+			return nil, err
+		}
+		block = append(block, c)
+		h = h<<1 + gearTable[c]
+		if len(block) >= maxBlockSize || (len(block) >= minBlockSize && h&blockMask == 0) {
+			if err = flush(); err != nil {
+				d.releaseBlocks(ctx, m)
+				return nil, err
+			}
+		}
+	}
+	if len(block) != 0 {
+		if err := flush(); err != nil {
+			d.releaseBlocks(ctx, m)
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// manifestOf returns the manifest of the file at name, nil if it is a directory, does not
+// exist or is not deduplicated
+func (d *dedupFS) manifestOf(ctx context.Context, name string) (*manifest, error) {
+	f, err := d.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return nil, err
+	}
+	return readManifest(f, true)
+}
+
+func (d *dedupFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	// the old manifest is needed to release its blocks, so it is never truncated here
+	underFlag := flag &^ (os.O_APPEND | os.O_TRUNC)
+	if writable {
+		underFlag = underFlag&^os.O_WRONLY | os.O_RDWR
+	}
+	f, err := d.FileSystem.OpenFile(ctx, name, underFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dedupDir{File: f, fs: d, name: name}, nil
+	}
+	m, err := readManifest(f, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	df := &dedupFile{File: f, fs: d, name: name, perm: perm, manifest: m, blockIdx: -1}
+	if m != nil {
+		df.size = m.size
+	} else {
+		df.size = fi.Size()
+	}
+	if writable {
+		err = df.openTemp(flag&os.O_TRUNC != 0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if flag&os.O_APPEND != 0 {
+		_, err = df.Seek(0, io.SeekEnd)
+	}
+	return df, err
+}
+
+// RemoveAll releases the blocks of the removed files, whose manifests are read while no
+// file being closed can replace them
+func (d *dedupFS) RemoveAll(ctx context.Context, name string) error {
+	var files []string
+	err := Walk(ctx, d.FileSystem, name, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	unlock := d.pathLocks.lock(files...)
+	defer unlock()
+	var manifests []*manifest
+	for _, p := range files {
+		m, err := d.manifestOf(ctx, p)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			manifests = append(manifests, m)
+		}
+	}
+	err = d.FileSystem.RemoveAll(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		err = d.releaseBlocks(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename releases the blocks of the file replaced at newName, if any
+func (d *dedupFS) Rename(ctx context.Context, oldName, newName string) error {
+	unlock := d.pathLocks.lock(oldName, newName)
+	defer unlock()
+	m, err := d.manifestOf(ctx, newName)
+	if err != nil {
+		return err
+	}
+	err = d.FileSystem.Rename(ctx, oldName, newName)
+	if err != nil || m == nil {
+		return err
+	}
+	return d.releaseBlocks(ctx, m)
+}
+
+func (d *dedupFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := d.FileSystem.Stat(ctx, name)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	return d.contentInfo(ctx, name, fi)
+}
+
+func (d *dedupFS) contentInfo(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, error) {
+	f, err := d.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := readManifest(f, false)
+	if err != nil || m == nil {
+		return fi, err
+	}
+	return &sizedFileInfo{FileInfo: fi, size: m.size}, nil
+}
+
+// StorageSize returns the share of the file at name in the blocks it refers to, each
+// block being split evenly among the files referring to it
+func (d *dedupFS) StorageSize(ctx context.Context, name string) (int64, error) {
+	m, err := d.manifestOf(ctx, name)
+	if err != nil || m == nil {
+		fi, statErr := d.FileSystem.Stat(ctx, name)
+		if err == nil {
+			err = statErr
+		}
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	size := int64(0)
+	for _, b := range m.blocks {
+		refs, err := types.GetBlockRefs(d.db, b.hash)
+		if err != nil {
+			return 0, err
+		}
+		if refs < 1 {
+			refs = 1
+		}
+		size += b.size / refs
+	}
+	return size, nil
+}
+
+// dedupDir is an opened directory of dedupFS
+type dedupDir struct {
+	webdav.File
+	fs   *dedupFS
+	name string
+}
+
+func (dd *dedupDir) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := dd.File.Readdir(count)
+	for i, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+		info, err := dd.fs.contentInfo(context.Background(), path.Join(dd.name, fi.Name()), fi)
+		if err == nil {
+			infos[i] = info
+		}
+	}
+	return infos, err
+}
+
+// dedupFile is an opened regular file of dedupFS. When opened for reading, the blocks are
+// loaded one by one as the file is read; when opened for writing, the content is edited in
+// a temporary file, which is cut into blocks on Close.
+type dedupFile struct {
+	webdav.File
+	fs       *dedupFS
+	name     string
+	perm     os.FileMode
+	manifest *manifest // nil for a file which is not deduplicated
+	size     int64
+	off      int64
+
+	block    []byte
+	blockIdx int
+
+	tmp   *os.File
+	dirty bool
+}
+
+var _ webdav.File = (*dedupFile)(nil)
+
+// openTemp copies the content into a temporary file, unless it is to be truncated
+func (df *dedupFile) openTemp(truncate bool) error {
+	tmp, err := os.CreateTemp("", "cashdisk-dedup-")
+	if err != nil {
+		return err
+	}
+	df.tmp, df.dirty = tmp, truncate
+	if !truncate && df.size != 0 {
+		_, err = io.Copy(tmp, &dedupReader{df})
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+	}
+	if truncate {
+		df.size = 0
+	}
+	df.off = 0
+	if err != nil {
+		df.discard()
+	}
+	return err
+}
+
+func (df *dedupFile) discard() {
+	df.tmp.Close()
+	os.Remove(df.tmp.Name())
+}
+
+// dedupReader reads the content of df from its current offset, hiding its Write method
+type dedupReader struct {
+	df *dedupFile
+}
+
+func (r *dedupReader) Read(p []byte) (int, error) {
+	return r.df.readContent(p)
+}
+
+func (df *dedupFile) loadBlock(idx int) error {
+	if df.blockIdx == idx {
+		return nil
+	}
+	data, err := df.fs.readBlock(context.Background(), df.manifest.blocks[idx])
+	if err != nil {
+		return err
+	}
+	df.block, df.blockIdx = data, idx
+	return nil
+}
+
+func (df *dedupFile) readContent(p []byte) (int, error) {
+	if df.manifest == nil {
+		return df.File.Read(p)
+	}
+	if df.off >= df.size {
+		return 0, io.EOF
+	}
+	m := df.manifest
+	idx := sort.Search(len(m.ends), func(i int) bool { return m.ends[i] > df.off })
+	err := df.loadBlock(idx)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, df.block[df.off-(m.ends[idx]-m.blocks[idx].size):])
+	df.off += int64(n)
+	return n, nil
+}
+
+func (df *dedupFile) Read(p []byte) (int, error) {
+	if df.tmp != nil {
+		return df.tmp.Read(p)
+	}
+	return df.readContent(p)
+}
+
+func (df *dedupFile) Write(p []byte) (int, error) {
+	if df.tmp == nil {
+		return 0, os.ErrPermission
+	}
+	df.dirty = true
+	return df.tmp.Write(p)
+}
+
+func (df *dedupFile) Seek(offset int64, whence int) (int64, error) {
+	if df.tmp != nil {
+		return df.tmp.Seek(offset, whence)
+	}
+	if df.manifest == nil {
+		return df.File.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += df.off
+	case io.SeekEnd:
+		offset += df.size
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	df.off = offset
+	return offset, nil
+}
+
+func (df *dedupFile) Stat() (fs.FileInfo, error) {
+	fi, err := df.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := df.size
+	if df.tmp != nil {
+		tfi, err := df.tmp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = tfi.Size()
+	}
+	return &sizedFileInfo{FileInfo: fi, size: size}, nil
+}
+
+func (df *dedupFile) Close() error {
+	err := df.File.Close()
+	if df.tmp == nil {
+		return err
+	}
+	defer df.discard()
+	if err != nil || !df.dirty {
+		return err
+	}
+	_, err = df.tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	m, err := df.fs.storeContent(context.Background(), df.tmp)
+	if err != nil {
+		return err
+	}
+	// another writer may have replaced the manifest read on opening, so the blocks of
+	// the one being replaced now are released
+	unlock := df.fs.pathLocks.lock(df.name)
+	defer unlock()
+	old, err := df.fs.manifestOf(context.Background(), df.name)
+	if err == nil {
+		err = df.writeManifest(m)
+	}
+	if err != nil {
+		df.fs.releaseBlocks(context.Background(), m)
+		return err
+	}
+	if old != nil {
+		return df.fs.releaseBlocks(context.Background(), old)
+	}
+	return nil
+}
+
+func (df *dedupFile) writeManifest(m *manifest) error {
+	f, err := df.fs.FileSystem.OpenFile(context.Background(), df.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, df.perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(m.encode())
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
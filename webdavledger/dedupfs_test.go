@@ -0,0 +1,111 @@
+package webdavledger
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"golang.org/x/net/webdav"
+)
+
+func newTestDedupFS(t *testing.T) *dedupFS {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newDedupFS(db, webdav.NewMemFS())
+}
+
+// storedBlocks returns the number of blocks kept in the backend
+func storedBlocks(t *testing.T, d *dedupFS) int {
+	n := 0
+	err := Walk(context.Background(), d.FileSystem, "/"+BlocksDir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDedupConcurrentWriters(t *testing.T) {
+	d := newTestDedupFS(t)
+	ctx := context.Background()
+	open := func() webdav.File {
+		f, err := d.OpenFile(ctx, "/f", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	write := func(f webdav.File, content string) {
+		_, err := f.Write([]byte(content))
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(open(), "a")
+	// both writers open the manifest of "a", the second one replaces the manifest of "b"
+	w1, w2 := open(), open()
+	write(w1, "b")
+	write(w2, "c")
+	if n := storedBlocks(t, d); n != 1 {
+		t.Errorf("%d blocks stored, want the block of the last content", n)
+	}
+	err := d.RemoveAll(ctx, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlocks(t, d); n != 0 {
+		t.Errorf("%d blocks left after removing the file", n)
+	}
+}
+
+func TestDedupSharedBlocks(t *testing.T) {
+	d := newTestDedupFS(t)
+	ctx := context.Background()
+	content := strings.Repeat("shared", 1000)
+	for _, name := range []string{"/a", "/b"} {
+		f, err := d.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write([]byte(content))
+		}
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := storedBlocks(t, d); n != 1 {
+		t.Errorf("%d blocks stored for the same content", n)
+	}
+	size, err := d.StorageSize(ctx, "/a")
+	if err != nil || size != int64(len(content))/2 {
+		t.Errorf("storage size %d, %v, want half of the content", size, err)
+	}
+	// the block is kept for the file renamed over the other one
+	err = d.Rename(ctx, "/a", "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlocks(t, d); n != 1 {
+		t.Errorf("%d blocks stored after the rename", n)
+	}
+	err = d.RemoveAll(ctx, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlocks(t, d); n != 0 {
+		t.Errorf("%d blocks left after removing the files", n)
+	}
+}
@@ -1,11 +1,10 @@
 package webdavledger
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"path"
 	"strings"
-	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/common"
@@ -13,34 +12,114 @@ import (
 
 	"github.com/smartbch/cashdisk/config"
 	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
 )
 
 type DiskService struct {
 	cfg       *config.Config
 	listenUrl string
 
-	db      *badger.DB
-	workDir string
+	db       *badger.DB
+	root     webdav.FileSystem // the backend holding the files of all the users
+	versions *VersionStore
+	trash    *TrashBin
+	keys     *keyring // nil if the files are not encrypted
+	throttle *throttle
+	locks    webdav.LockSystem // the WebDAV locks, named by the paths in root
+	staging  *staging
+
+	pwAuth  *passwordAuth
+	sigAuth *sigAuth
+
+	ipLimiter   *utils.RateLimiter
+	addrLimiter *utils.RateLimiter
 }
 
-func NewDiskService(url string) *DiskService {
+func newRateLimiter(c config.RateLimitConfig) *utils.RateLimiter {
+	return utils.NewRateLimiter(c.SlotDuration, c.NumTimeSlots, c.MaxCount)
+}
+
+func NewDiskService(cfg *config.Config, url string, db *badger.DB, root webdav.FileSystem) *DiskService {
 	d := &DiskService{
-		cfg:       &config.Config{},
-		listenUrl: url,
+		cfg:         cfg,
+		listenUrl:   url,
+		db:          db,
+		root:        root,
+		versions:    NewVersionStore(db, root),
+		trash:       NewTrashBin(db, root),
+		throttle:    newThrottle(db, cfg.Bandwidth),
+		locks:       webdav.NewMemLS(),
+		staging:     &staging{reserved: make(map[common.Address]int64)},
+		pwAuth:      newPasswordAuth(db, newRateLimiter(cfg.FailedLoginRateLimit)),
+		sigAuth:     newSigAuth(),
+		ipLimiter:   newRateLimiter(cfg.DiskServiceConfig.IPRateLimit),
+		addrLimiter: newRateLimiter(cfg.DiskServiceConfig.AddressRateLimit),
 	}
 	return d
 }
 
+// EnableEncryption encrypts the files written from now on with the data keys of their
+// owners, which are wrapped by masterKey, a 32-byte AES key. It cannot be combined with a
+// deduplicating backend, since the blocks sealed with random nonces never repeat.
+func (d *DiskService) EnableEncryption(masterKey []byte) error {
+	if _, ok := d.root.(*dedupFS); ok {
+		return errors.New("encryption cannot be enabled over a deduplicating backend")
+	}
+	keys, err := newKeyring(d.db, masterKey)
+	if err != nil {
+		return err
+	}
+	d.keys = keys
+	return nil
+}
+
+// newFS returns the file system rooted at dir in the home of owner
+func (d *DiskService) newFS(owner common.Address, dir string) (webdav.FileSystem, error) {
+	var fs webdav.FileSystem = newSubFS(d.root, homePath(owner, dir))
+	if d.keys == nil {
+		return fs, nil
+	}
+	key, err := d.keys.dataKey(owner)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFS{FileSystem: fs, key: key}, nil
+}
+
 func (d *DiskService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	//check basic auth
-	addr, errStr := authFunc(d.db, w, r)
+	if !d.ipLimiter.Allow(utils.ClientIP(r)) {
+		utils.WriteTooManyRequests(w, d.ipLimiter.RetryAfter())
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, shareLinkPrefix) {
+		d.serveShareLink(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, authPrefix) {
+		d.sigAuth.ServeHTTP(w, r)
+		return
+	}
+	//check bearer token or basic auth
+	cred, errStr, ok := d.sigAuth.bearerAuth(r)
+	if !ok {
+		if d.pwAuth.tooManyFailedLogins(r) {
+			utils.WriteTooManyRequests(w, d.pwAuth.failedLogins.RetryAfter())
+			return
+		}
+		cred, errStr = d.pwAuth.authFunc(w, r)
+	}
 	if len(errStr) != 0 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="restricted"`)
 		http.Error(w, errStr, http.StatusUnauthorized)
 		return
 	}
+	if !d.addrLimiter.Allow(cred.addr[:]) {
+		utils.WriteTooManyRequests(w, d.addrLimiter.RetryAfter())
+		return
+	}
 	// read uid
-	uid := types.GetUID(d.db, addr)
+	uid := types.GetUID(d.db, cred.addr)
 	if uid < 0 {
 		http.Error(w, "Inconsistent Database", http.StatusInternalServerError)
 		return
@@ -54,51 +133,13 @@ func (d *DiskService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "user is locked", http.StatusBadRequest)
 		return
 	}
-	// create webdav handler
-	handler := &webdav.Handler{LockSystem: &DummyLockSystem{}}
-	username, _, _ := r.BasicAuth()
-	parts := strings.Split(r.URL.Path, "/")
-	accessUserOwnedDir := len(parts) == 0 ||
-		(len(parts) > 0 && (parts[0] == username || !common.IsHexAddress(parts[0])))
-	if accessUserOwnedDir {
-		if parts[0] == username {
-			handler.Prefix = username
-		}
-		handler.FileSystem = &WatchedDir{
-			Dir: webdav.Dir(path.Join(d.workDir, username)),
-			db:  d.db,
-			uid: uid,
-			ro:  false,
-		}
-		handler.ServeHTTP(w, r)
-		return
-	}
-
-	// friend-shared directory
-	friendName := parts[0]
-	friendAddr := common.HexToAddress(friendName)
-	friendUid := types.GetUID(d.db, friendAddr)
-	if friendUid < 0 {
-		http.Error(w, "Inconsistent Database", http.StatusInternalServerError)
-		return
-	}
-	expireTime := getExpireTime(d.db, friendUid, uid, path.Join(parts[1:]...))
-	if expireTime < time.Now().UnixNano() {
-		http.Error(w, "Permission Denied", http.StatusBadRequest)
-		return
-	}
-	handler.Prefix = friendName
-	handler.FileSystem = &WatchedDir{
-		Dir: webdav.Dir(path.Join(d.workDir, friendName)),
-		db:  d.db,
-		uid: friendUid,
-		ro:  true,
-	}
-	handler.ServeHTTP(w, r)
+	d.route(w, r, cred, uid)
 }
 
 func (d *DiskService) Run() {
 	fmt.Printf("start disk service on %s\n", d.listenUrl)
+	go d.StartScrubRoutine()
+	go d.StartUploadCleanupRoutine()
 	err := http.ListenAndServe(d.listenUrl, d)
 	if err != nil {
 		panic(err)
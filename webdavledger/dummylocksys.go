@@ -1,31 +1,34 @@
 package webdavledger
 
 import (
+	"fmt"
 	"time"
 
 	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/utils"
 )
 
+// DummyLockSystem grants every lock without tracking it. webdav.Handler takes a
+// temporary lock for each modifying request, so refusing them would make the whole
+// disk readonly. It is only used for the trees which cannot be modified through WebDAV,
+// the files of the users are locked by ownerLockSystem.
 type DummyLockSystem struct {
 }
 
 func (_ DummyLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (release func(), err error) {
-	err = webdav.ErrNotImplemented
-	return
+	return func() {}, nil
 }
 
 func (_ DummyLockSystem) Create(now time.Time, details webdav.LockDetails) (token string, err error) {
-	err = webdav.ErrNotImplemented
-	return
+	return fmt.Sprintf("opaquelocktoken:%x", utils.GetTimestamp()), nil
 }
 
 func (_ DummyLockSystem) Refresh(now time.Time, token string, duration time.Duration) (details webdav.LockDetails, err error) {
-	err = webdav.ErrNotImplemented
+	err = webdav.ErrNoSuchLock
 	return
 }
 
 func (_ DummyLockSystem) Unlock(now time.Time, token string) error {
-	return webdav.ErrNotImplemented
+	return nil
 }
-
-
@@ -0,0 +1,145 @@
+package webdavledger
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// the prices of the tests are distinct, so that each operation shows in the charges
+var testPrices = config.PriceTable{
+	config.OpMkdir:     {PerCall: 200},
+	config.OpOpenFile:  {PerCall: 7},
+	config.OpRemoveAll: {PerCall: 100},
+	config.OpRename:    {PerCall: 150},
+	config.OpStat:      {PerCall: 30},
+	config.OpClose:     {PerCall: 5},
+	config.OpRead:      {PerUnit: 1},
+	config.OpSeek:      {PerCall: 3},
+	config.OpReaddir:   {PerUnit: 20},
+	config.OpWrite:     {PerUnit: 2},
+	config.OpDeadProps: {PerUnit: 1},
+	config.OpPatch:     {PerCall: 40, PerUnit: 10},
+}
+
+const testBalance = 1_000_000
+
+type testUser struct {
+	addr common.Address
+	uid  int64
+}
+
+type testDisk struct {
+	t     *testing.T
+	d     *DiskService
+	db    *badger.DB
+	root  webdav.FileSystem
+	owner testUser
+	other testUser
+}
+
+func newTestDisk(t *testing.T) *testDisk {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	root := webdav.NewMemFS()
+	td := &testDisk{
+		t:     t,
+		d:     NewDiskService(config.DefaultConfig(), "", db, root),
+		db:    db,
+		root:  root,
+		owner: testUser{common.HexToAddress("0x1111111111111111111111111111111111111111"), 1},
+		other: testUser{common.HexToAddress("0x2222222222222222222222222222222222222222"), 2},
+	}
+	td.d.cfg.Prices = testPrices
+	for _, u := range []testUser{td.owner, td.other} {
+		err = types.AddNewUser(db, u.addr, u.uid, [32]byte{})
+		if err == nil {
+			err = mkdirAll(context.Background(), root, homePath(u.addr, ""))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		td.setBalance(u, testBalance)
+	}
+	return td
+}
+
+func (td *testDisk) setBalance(u testUser, balance int64) {
+	key := append([]byte{types.RemainedPoints}, utils.Int64ToBytes(u.uid)...)
+	err := td.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, utils.Int64ToBytes(balance))
+	})
+	if err != nil {
+		td.t.Fatal(err)
+	}
+}
+
+func (td *testDisk) balance(u testUser) int64 {
+	_, balance, err := types.IsUserLock(td.db, u.uid)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	return balance
+}
+
+// writeFile writes a file directly to the backend, p is relative to the home of u
+func (td *testDisk) writeFile(u testUser, p, content string) {
+	ctx := context.Background()
+	name := homePath(u.addr, p)
+	err := mkdirAll(ctx, td.root, path.Dir(name))
+	if err != nil {
+		td.t.Fatal(err)
+	}
+	f, err := td.root.OpenFile(ctx, name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write([]byte(content))
+		f.Close()
+	}
+	if err != nil {
+		td.t.Fatal(err)
+	}
+}
+
+func (td *testDisk) readFile(u testUser, p string) (string, error) {
+	f, err := td.root.OpenFile(context.Background(), homePath(u.addr, p), os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	return string(content), err
+}
+
+// serve serves a WebDAV request of u as if it were authenticated
+func (td *testDisk) serve(u testUser, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	td.d.route(w, r, credential{addr: u.addr}, u.uid)
+	return w
+}
+
+// share shares dir of the owner with the other user
+func (td *testDisk) share(dir string, perm, payer byte) {
+	err := types.UpdateSharedDir(td.db, td.owner.uid, td.other.uid, dir, 1<<62, perm, payer)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+}
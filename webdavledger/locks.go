@@ -0,0 +1,53 @@
+package webdavledger
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// ownerLockSystem names the locks by the path of the files in the backend, so that the
+// owner, its friends and its share links all take the same locks on the same files,
+// whichever directory their file systems are rooted at
+type ownerLockSystem struct {
+	ls   webdav.LockSystem
+	root string // the directory of the file system in the backend
+}
+
+func newOwnerLockSystem(ls webdav.LockSystem, wd *WatchedDir) *ownerLockSystem {
+	return &ownerLockSystem{ls: ls, root: path.Join("/", wd.owner.Hex(), wd.base)}
+}
+
+func (ols *ownerLockSystem) toBackend(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Join(ols.root, name)
+}
+
+func (ols *ownerLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (release func(), err error) {
+	return ols.ls.Confirm(now, ols.toBackend(name0), ols.toBackend(name1), conditions...)
+}
+
+func (ols *ownerLockSystem) Create(now time.Time, details webdav.LockDetails) (token string, err error) {
+	details.Root = ols.toBackend(details.Root)
+	return ols.ls.Create(now, details)
+}
+
+func (ols *ownerLockSystem) Refresh(now time.Time, token string, duration time.Duration) (details webdav.LockDetails, err error) {
+	details, err = ols.ls.Refresh(now, token, duration)
+	if err != nil {
+		return
+	}
+	if details.Root != ols.root && !strings.HasPrefix(details.Root, ols.root+"/") {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	details.Root = "/" + strings.TrimPrefix(strings.TrimPrefix(details.Root, ols.root), "/")
+	return
+}
+
+func (ols *ownerLockSystem) Unlock(now time.Time, token string) error {
+	return ols.ls.Unlock(now, token)
+}
@@ -0,0 +1,160 @@
+package webdavledger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v3"
+
+	"github.com/smartbch/cashdisk/config"
+)
+
+// byteMeter charges the payers for the bytes passing through it by the started KB of
+// their total, so that the bytes of many small reads are not rounded up one by one. A KB
+// is charged as soon as it is started, before its bytes are passed on.
+type byteMeter struct {
+	db        *badger.DB
+	prices    config.PriceTable
+	payers    payers
+	op        config.Operation
+	operation string
+	total     int64
+	charged   int64 // the charged units
+}
+
+func newByteMeter(db *badger.DB, prices config.PriceTable, p payers, op config.Operation,
+	operation string) *byteMeter {
+	return &byteMeter{db: db, prices: prices, payers: p, op: op, operation: operation}
+}
+
+func (m *byteMeter) add(n int) error {
+	units := (m.total + int64(n) + 1023) / 1024
+	if units > m.charged {
+		operation := fmt.Sprintf("%s for %d bytes", m.operation, m.total+int64(n))
+		err := m.payers.charge(m.db, m.prices, m.op, units-m.charged, operation)
+		if err != nil {
+			return err
+		}
+		m.charged = units
+	}
+	m.total += int64(n)
+	return nil
+}
+
+type meteredKey struct{}
+
+// responseMetered reports whether the content read in ctx is charged as it is sent in the
+// response, instead of as it is read
+func responseMetered(ctx context.Context) bool {
+	return ctx.Value(meteredKey{}) != nil
+}
+
+// meteredResponse charges for the content sent in the body of a response before sending
+// it, and stops the response once the payers run out of points. Only the bodies of the
+// responses with the status 200 or 206 are content, and the boundaries and the part
+// headers of a multipart/byteranges body are not charged.
+type meteredResponse struct {
+	http.ResponseWriter
+	meter  *byteMeter
+	status int
+	ranges *rangesParser // nil unless several ranges are sent
+}
+
+func (mr *meteredResponse) WriteHeader(status int) {
+	if mr.status == 0 {
+		mr.status = status
+		if strings.HasPrefix(mr.Header().Get("Content-Type"), "multipart/byteranges") {
+			mr.ranges = &rangesParser{}
+		}
+	}
+	mr.ResponseWriter.WriteHeader(status)
+}
+
+func (mr *meteredResponse) Write(p []byte) (int, error) {
+	if mr.status == 0 {
+		mr.WriteHeader(http.StatusOK)
+	}
+	if mr.status != http.StatusOK && mr.status != http.StatusPartialContent {
+		return mr.ResponseWriter.Write(p)
+	}
+	n := len(p)
+	if mr.ranges != nil {
+		var err error
+		n, err = mr.ranges.content(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := mr.meter.add(n)
+	if err != nil {
+		return 0, err
+	}
+	return mr.ResponseWriter.Write(p)
+}
+
+const maxPartHeaderSize = 4096
+
+// rangesParser follows a multipart/byteranges body as it is written, to tell the content
+// of the parts from their boundaries and headers. The size of the content of each part is
+// taken from its Content-Range header.
+type rangesParser struct {
+	header []byte // the boundary and the header of the next part, read so far
+	left   int64  // the content left in the current part
+}
+
+// content returns the number of bytes of p which are content
+func (rp *rangesParser) content(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		if rp.left > 0 {
+			k := len(p)
+			if int64(k) > rp.left {
+				k = int(rp.left)
+			}
+			n += k
+			rp.left -= int64(k)
+			p = p[k:]
+			continue
+		}
+		rp.header = append(rp.header, p[0])
+		p = p[1:]
+		if len(rp.header) > maxPartHeaderSize {
+			return 0, errors.New("malformed multipart/byteranges body")
+		}
+		if !bytes.HasSuffix(rp.header, []byte("\r\n\r\n")) {
+			continue
+		}
+		var first, last, size int64
+		for _, line := range strings.Split(string(rp.header), "\r\n") {
+			name, value, _ := strings.Cut(line, ":")
+			if !strings.EqualFold(name, "Content-Range") {
+				continue
+			}
+			_, err := fmt.Sscanf(strings.TrimSpace(value), "bytes %d-%d/%d", &first, &last, &size)
+			if err != nil || last < first {
+				return 0, errors.New("malformed multipart/byteranges body")
+			}
+			rp.left = last - first + 1
+		}
+		rp.header = rp.header[:0]
+	}
+	return n, nil
+}
+
+// serveMetered serves a GET with handler, charging the readers for exactly the content
+// sent, whether the whole file or some ranges of it. Other methods are served as
+// they are, with the reads charged by WatchedFile.
+func serveMetered(w http.ResponseWriter, r *http.Request, handler http.Handler, db *badger.DB,
+	prices config.PriceTable, readers payers) {
+	if r.Method != http.MethodGet {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	operation := fmt.Sprintf("Send '%s'", r.URL.Path)
+	mr := &meteredResponse{ResponseWriter: w, meter: newByteMeter(db, prices, readers, config.OpRead, operation)}
+	handler.ServeHTTP(mr, r.WithContext(context.WithValue(r.Context(), meteredKey{}, true)))
+}
@@ -0,0 +1,81 @@
+package webdavledger
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sentContent returns the size of the content in the body of w, without the boundaries
+// and the part headers of a multipart body
+func sentContent(t *testing.T, w *httptest.ResponseRecorder) int {
+	mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		return w.Body.Len()
+	}
+	size := 0
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return size
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += len(content)
+	}
+}
+
+func TestRangeCharges(t *testing.T) {
+	content := strings.Repeat("0123456789", 500)
+	// opened, stated, seeked to find the size and closed
+	const base = 7 + 30 + 3 + 3 + 5
+	cases := []struct {
+		name   string
+		method string
+		ranges string
+		code   int
+		sent   int
+		want   int64 // each range is seeked to before it is read
+	}{
+		{"whole", http.MethodGet, "", 200, 5000, base + 5},
+		{"single", http.MethodGet, "bytes=0-1499", 206, 1500, base + 3 + 2},
+		// the boundaries and the part headers are not charged
+		{"multi", http.MethodGet, "bytes=0-511,4000-4511", 206, 1024, base + 2*3 + 1},
+		{"multi in one KB", http.MethodGet, "bytes=0-9,20-29,40-49", 206, 30, base + 3*3 + 1},
+		{"tail", http.MethodGet, "bytes=-100", 206, 100, base + 3 + 1},
+		{"to eof", http.MethodGet, "bytes=4900-", 206, 100, base + 3 + 1},
+		// the error message is not charged
+		{"unsatisfiable", http.MethodGet, "bytes=9000-", 416, -1, base},
+		{"head", http.MethodHead, "bytes=0-1499", 206, 0, base + 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			td := newTestDisk(t)
+			td.writeFile(td.owner, "f.txt", content)
+			var header map[string]string
+			if c.ranges != "" {
+				header = map[string]string{"Range": c.ranges}
+			}
+			w := td.serve(td.owner, c.method, "/home/f.txt", "", header)
+			if w.Code != c.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, c.code, w.Body.String())
+			}
+			if sent := sentContent(t, w); c.sent >= 0 && sent != c.sent {
+				t.Errorf("sent %d bytes of content, want %d", sent, c.sent)
+			}
+			if got := testBalance - td.balance(td.owner); got != c.want {
+				t.Errorf("charged %d, want %d", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package webdavledger
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+)
+
+// The URL layout of the disk service:
+//
+//	/home/<path>                the directory owned by the caller
+//	/shared/<address>/<path>    the directories shared with the caller by <address>
+//	/.versions/<path>/<id>      the old versions of the files in the home of the caller
+//	/uploads/<id>/<part>        the parts of the resumable uploads of the caller
+//	/s/<token>/<path>           the public share links, which need no authentication
+//	/auth/nonce, /auth/login    the signature based login, which needs no authentication
+//
+// "/", "/shared" and the ancestors of the shared directories are virtual readonly
+// directories, which can only be listed with PROPFIND. /.versions is readonly too.
+const (
+	homePrefix     = "/home"
+	sharedPrefix   = "/shared"
+	versionsPrefix = "/" + VersionsDir
+	uploadsPrefix  = "/uploads"
+)
+
+func (d *DiskService) route(w http.ResponseWriter, r *http.Request, cred credential, uid int64) {
+	p := path.Clean("/" + r.URL.Path)
+	if p == homePrefix || strings.HasPrefix(p, homePrefix+"/") {
+		d.serveHome(w, r, cred, uid)
+		return
+	}
+	if p == versionsPrefix || strings.HasPrefix(p, versionsPrefix+"/") {
+		d.serveVersions(w, r, cred, uid)
+		return
+	}
+	if p == uploadsPrefix || strings.HasPrefix(p, uploadsPrefix+"/") {
+		d.serveUploads(w, r, cred, uid)
+		return
+	}
+	if p == "/" || p == sharedPrefix {
+		d.serveVirtualDirs(w, r, uid, -1, "")
+		return
+	}
+	if !strings.HasPrefix(p, sharedPrefix+"/") {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if cred.scope != "" {
+		http.Error(w, "Permission Denied", http.StatusForbidden)
+		return
+	}
+	ownerName, dir, _ := strings.Cut(strings.TrimPrefix(p, sharedPrefix+"/"), "/")
+	if !common.IsHexAddress(ownerName) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	ownerUid := types.GetUID(d.db, common.HexToAddress(ownerName))
+	if ownerUid < 0 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	share, err := types.FindSharedDir(d.db, ownerUid, uid, dir)
+	if err == nil {
+		d.serveSharedDir(w, r, cred, ownerName, uid, share)
+		return
+	}
+	// the ancestors of the shared directories can be listed to reach them
+	incoming, err := types.GetSharedDirsTo(d.db, uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, s := range incoming {
+		if s.FromUid == ownerUid && (dir == "" || strings.HasPrefix(s.Dir, dir+"/")) {
+			d.serveVirtualDirs(w, r, uid, ownerUid, ownerName)
+			return
+		}
+	}
+	http.Error(w, "Permission Denied", http.StatusForbidden)
+}
+
+func (d *DiskService) serveHome(w http.ResponseWriter, r *http.Request, cred credential, uid int64) {
+	// an app password with a scope only sees the directory of its scope
+	prefix := path.Join(homePrefix, cred.scope)
+	p := path.Clean("/" + r.URL.Path)
+	if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		http.Error(w, "Permission Denied", http.StatusForbidden)
+		return
+	}
+	wd, err := d.homeDir(cred, uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.serveWatched(w, r, prefix, wd)
+}
+
+// homeDir returns the home of the caller, or the directory of its scope
+func (d *DiskService) homeDir(cred credential, uid int64) (*WatchedDir, error) {
+	perm := types.PermAll
+	if cred.readOnly {
+		perm = types.PermRead
+	}
+	fs, err := d.newFS(cred.addr, cred.scope)
+	if err != nil {
+		return nil, err
+	}
+	return &WatchedDir{
+		FileSystem: fs,
+		db:         d.db,
+		readers:    payers{uid},
+		writerUid:  uid,
+		perm:       perm,
+		prices:     d.cfg.Prices,
+		versions:   d.versions,
+		trash:      d.trash,
+		owner:      cred.addr,
+		ownerUid:   uid,
+		base:       cred.scope,
+		throttle:   d.throttle,
+	}, nil
+}
+
+func (d *DiskService) serveSharedDir(w http.ResponseWriter, r *http.Request, cred credential, ownerName string,
+	uid int64, share types.SharedDirInfo) {
+	perm := share.Permissions
+	if cred.readOnly {
+		perm &= types.PermRead
+	}
+	readers := payers{share.FromUid}
+	if share.Payer == types.PayerReader {
+		readers = payers{uid}
+	} else if share.Payer == types.PayerSplit {
+		readers = payers{share.FromUid, uid}
+	}
+	// root the file system at the shared directory, so that nothing outside of it
+	// can be reached, even as the destination of COPY and MOVE
+	owner := common.HexToAddress(ownerName)
+	fs, err := d.newFS(owner, share.Dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.serveWatched(w, r, path.Join(sharedPrefix, ownerName, share.Dir), &WatchedDir{
+		FileSystem: fs,
+		db:         d.db,
+		readers:    readers,
+		writerUid:  uid,
+		perm:       perm,
+		prices:     d.cfg.Prices,
+		versions:   d.versions,
+		trash:      d.trash,
+		owner:      owner,
+		ownerUid:   share.FromUid,
+		base:       share.Dir,
+		throttle:   d.throttle,
+	})
+}
+
+// serveVersions serves the readonly tree of the old versions in the home of the caller.
+// The caller pays for each listed version, and for reading their content.
+func (d *DiskService) serveVersions(w http.ResponseWriter, r *http.Request, cred credential, uid int64) {
+	if cred.scope != "" {
+		http.Error(w, "Permission Denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+	default:
+		http.Error(w, types.ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	var key *userKey
+	if d.keys != nil {
+		var err error
+		key, err = d.keys.dataKey(cred.addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fs, err := d.versions.newVersionsFS(cred.addr, uid, d.cfg.Prices, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fs.throttle = d.throttle
+	operation := fmt.Sprintf("List %d versions", len(fs.versions))
+	err = types.ConsumePoints(d.db, uid, d.cfg.Prices.Cost(config.OpReaddir, int64(len(fs.versions)+1)), operation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	}
+	handler := &webdav.Handler{Prefix: versionsPrefix, FileSystem: fs, LockSystem: &DummyLockSystem{}}
+	serveMetered(w, r, handler, d.db, d.cfg.Prices, payers{uid})
+}
+
+// serveVirtualDirs lists the top directories and all the active shares of uid, each
+// share appearing as /shared/<owner>/<dir>. The caller pays for each listed share. The
+// owner is written as the checksummed address, except ownerUid which is written as
+// ownerName, the way it was spelled in the request, for the entries to match its path.
+func (d *DiskService) serveVirtualDirs(w http.ResponseWriter, r *http.Request, uid, ownerUid int64, ownerName string) {
+	if r.Method != http.MethodOptions && r.Method != "PROPFIND" {
+		http.Error(w, types.ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	incoming, err := types.GetSharedDirsTo(d.db, uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := r.Context()
+	fs := webdav.NewMemFS()
+	dirs := []string{homePrefix, sharedPrefix, versionsPrefix, uploadsPrefix}
+	for _, s := range incoming {
+		name := ownerName
+		if s.FromUid != ownerUid {
+			owner, err := types.GetAddressByUID(d.db, s.FromUid)
+			if err != nil {
+				continue
+			}
+			name = owner.Hex()
+		}
+		dirs = append(dirs, path.Join(sharedPrefix, name, s.Dir))
+	}
+	for _, dir := range dirs {
+		err = mkdirAll(ctx, fs, dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	operation := fmt.Sprintf("List %d shares", len(incoming))
+	err = types.ConsumePoints(d.db, uid, d.cfg.Prices.Cost(config.OpReaddir, int64(len(incoming)+1)), operation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	}
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: &DummyLockSystem{}}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,110 @@
+package webdavledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+func (td *testDisk) addAppPassword(u testUser, password string, info types.AppPasswordInfo) {
+	err := types.AddAppPassword(td.db, u.addr, sha256.Sum256([]byte(password)), info)
+	if err != nil {
+		td.t.Fatal(err)
+	}
+}
+
+func TestAppPasswordRestrictions(t *testing.T) {
+	td := newTestDisk(t)
+	td.writeFile(td.other, "docs/a.txt", "a")
+	td.writeFile(td.other, "b.txt", "b")
+	td.writeFile(td.owner, "s/x.txt", "x")
+	td.share("s", types.PermAll, types.PayerOwner)
+	td.addAppPassword(td.other, "full", types.AppPasswordInfo{Label: "full"})
+	td.addAppPassword(td.other, "scoped", types.AppPasswordInfo{Label: "scoped", Scope: "docs"})
+	td.addAppPassword(td.other, "readonly", types.AppPasswordInfo{Label: "readonly", ReadOnly: true})
+	shared := "/shared/" + td.owner.addr.Hex() + "/s/"
+
+	serve := func(password, method, target string) *httptest.ResponseRecorder {
+		body := ""
+		if method == "PUT" {
+			body = "new"
+		} else if method == "PROPPATCH" {
+			body = propSet
+		}
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth(td.other.addr.Hex(), password)
+		r.Header.Set("Depth", "0")
+		r.Header.Set("Destination", target+".moved")
+		w := httptest.NewRecorder()
+		td.d.ServeHTTP(w, r)
+		return w
+	}
+	for _, c := range []struct {
+		password, method, target string
+		code                     int // 0 for any error
+	}{
+		{"full", "GET", "/home/b.txt", 200},
+		{"full", "GET", shared + "x.txt", 200},
+		{"full", "PROPFIND", "/.versions/", 207},
+		{"full", "PUT", "/home/full.txt", 201},
+		{"full", "PUT", shared + "full.txt", 201},
+		{"full", "PROPPATCH", "/home/full.txt", 207},
+
+		{"scoped", "GET", "/home/docs/a.txt", 200},
+		{"scoped", "PUT", "/home/docs/scoped.txt", 201},
+		{"scoped", "GET", "/home/b.txt", 403},
+		{"scoped", "PUT", "/home/scoped.txt", 403},
+		{"scoped", "GET", shared + "x.txt", 403},
+		{"scoped", "PUT", shared + "scoped.txt", 403},
+		{"scoped", "PROPFIND", "/.versions/", 403},
+		{"scoped", "GET", "/.versions/docs/a.txt", 403},
+
+		{"readonly", "GET", "/home/b.txt", 200},
+		{"readonly", "GET", shared + "x.txt", 200},
+		{"readonly", "PROPFIND", "/.versions/", 207},
+		{"readonly", "PUT", "/home/readonly.txt", 0},
+		{"readonly", "PUT", "/home/b.txt", 0},
+		{"readonly", "MKCOL", "/home/readonly", 0},
+		{"readonly", "DELETE", "/home/b.txt", 0},
+		{"readonly", "MOVE", "/home/b.txt", 0},
+		{"readonly", "PROPPATCH", "/home/b.txt", 0},
+		{"readonly", "PUT", shared + "readonly.txt", 0},
+		{"readonly", "DELETE", shared + "x.txt", 0},
+		{"readonly", "PUT", "/.versions/b.txt", 0},
+		{"readonly", "MKCOL", "/uploads/u1", 403},
+	} {
+		w := serve(c.password, c.method, c.target)
+		if (c.code != 0 && w.Code != c.code) || (c.code == 0 && w.Code < 400) {
+			t.Errorf("%s %s with the %s app password: status %d, want %d: %s",
+				c.method, c.target, c.password, w.Code, c.code, w.Body.String())
+		}
+	}
+
+	// the denied requests changed nothing
+	for _, c := range []struct {
+		u       testUser
+		p       string
+		content string
+	}{
+		{td.other, "b.txt", "b"},
+		{td.other, "full.txt", "new"},
+		{td.other, "docs/scoped.txt", "new"},
+		{td.other, "scoped.txt", ""},
+		{td.other, "readonly.txt", ""},
+		{td.owner, "s/x.txt", "x"},
+		{td.owner, "s/full.txt", "new"},
+		{td.owner, "s/scoped.txt", ""},
+		{td.owner, "s/readonly.txt", ""},
+	} {
+		if content, _ := td.readFile(c.u, c.p); content != c.content {
+			t.Errorf("%s of uid %d: %q, want %q", c.p, c.u.uid, content, c.content)
+		}
+	}
+	if _, err := td.root.Stat(context.Background(), homePath(td.other.addr, "readonly")); err == nil {
+		t.Error("the readonly app password created a directory")
+	}
+}
@@ -0,0 +1,817 @@
+package webdavledger
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+)
+
+// s3FS keeps each file as an object in a bucket of an S3-compatible object store, keyed by
+// its path without the leading slash. A directory is kept as an empty object whose key
+// ends with a slash, like most S3 browsers do, and the prefixes of the keys are taken as
+// directories too.
+type s3FS struct {
+	client *s3Client
+}
+
+var _ webdav.FileSystem = (*s3FS)(nil)
+
+func newS3FS(c config.S3Config) (*s3FS, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if c.Bucket == "" {
+		return nil, errors.New("the bucket of the s3 backend is not set")
+	}
+	return &s3FS{client: &s3Client{
+		endpoint:  endpoint,
+		region:    c.Region,
+		bucket:    c.Bucket,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		partSize:  s3PartSize,
+		http:      newS3HTTPClient(),
+	}}, nil
+}
+
+var (
+	s3DialTimeout           = 30 * time.Second
+	s3ResponseHeaderTimeout = time.Minute
+)
+
+// newS3HTTPClient returns the client of the S3 requests, which fail instead of hanging
+// the WebDAV requests when the endpoint stalls. There is no overall timeout, as the
+// objects may be big, but S3 sends the headers of a response early, even for the long
+// copies and completions of multipart uploads.
+func newS3HTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   s3DialTimeout,
+		ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	}}
+}
+
+func s3Key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func dirInfo(key string) os.FileInfo {
+	return &virtualFileInfo{name: path.Base("/" + key), isDir: true}
+}
+
+func (s *s3FS) stat(ctx context.Context, key string) (os.FileInfo, error) {
+	if key == "" {
+		return dirInfo(key), nil
+	}
+	info, err := s.client.head(ctx, key)
+	if !os.IsNotExist(err) {
+		return info, err
+	}
+	_, err = s.client.head(ctx, key+"/")
+	if err == nil {
+		return dirInfo(key), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	objects, _, err := s.client.list(ctx, key+"/", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return dirInfo(key), nil
+}
+
+func (s *s3FS) checkParent(ctx context.Context, key string) error {
+	parent, err := s.stat(ctx, s3Key(path.Dir("/"+key)))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (s *s3FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := s3Key(name)
+	if _, err := s.stat(ctx, key); err == nil {
+		return os.ErrExist
+	}
+	err := s.checkParent(ctx, key)
+	if err != nil {
+		return err
+	}
+	return s.client.put(ctx, key+"/", strings.NewReader(""), 0)
+}
+
+func (s *s3FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := s3Key(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0
+	fi, err := s.stat(ctx, key)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		err = s.checkParent(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return s.openWritable(ctx, key, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if fi.IsDir() {
+		if writable {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		return &s3Dir{client: s.client, key: key}, nil
+	}
+	if writable {
+		f, err := s.openWritable(ctx, key, flag&os.O_TRUNC == 0)
+		if err == nil && flag&os.O_APPEND != 0 {
+			_, err = f.Seek(0, io.SeekEnd)
+		}
+		return f, err
+	}
+	return &s3Reader{client: s.client, key: key, info: fi}, nil
+}
+
+// openWritable keeps the content in a temporary file, which is uploaded on Close
+func (s *s3FS) openWritable(ctx context.Context, key string, download bool) (*s3Writer, error) {
+	tmp, err := os.CreateTemp("", "cashdisk-s3-")
+	if err != nil {
+		return nil, err
+	}
+	w := &s3Writer{File: tmp, client: s.client, key: key, dirty: !download}
+	if download {
+		body, err := s.client.get(ctx, key, 0)
+		if err == nil {
+			_, err = io.Copy(tmp, body)
+			body.Close()
+		}
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (s *s3FS) RemoveAll(ctx context.Context, name string) error {
+	key := s3Key(name)
+	if key == "" {
+		return os.ErrInvalid
+	}
+	objects, _, err := s.client.list(ctx, key+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		err = s.client.delete(ctx, obj.Key)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.client.delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	return s.client.delete(ctx, key+"/")
+}
+
+func (s *s3FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldKey, newKey := s3Key(oldName), s3Key(newName)
+	if oldKey == "" || newKey == "" {
+		return os.ErrInvalid
+	}
+	fi, err := s.stat(ctx, oldKey)
+	if err != nil {
+		return err
+	}
+	err = s.checkParent(ctx, newKey)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		err = s.client.copy(ctx, oldKey, newKey, fi.Size())
+		if err != nil {
+			return err
+		}
+		return s.client.delete(ctx, oldKey)
+	}
+	objects, _, err := s.client.list(ctx, oldKey+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		// a directory which only exists as the prefix of its own marker
+		objects = []s3Object{{Key: oldKey + "/"}}
+	}
+	for _, obj := range objects {
+		err = s.client.copy(ctx, obj.Key, newKey+strings.TrimPrefix(obj.Key, oldKey), obj.Size)
+		if err != nil {
+			return err
+		}
+		err = s.client.delete(ctx, obj.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return s.stat(ctx, s3Key(name))
+}
+
+// s3Reader reads an object with ranged GETs, from the offset set by Seek
+type s3Reader struct {
+	client *s3Client
+	key    string
+	info   os.FileInfo
+	off    int64
+	body   io.ReadCloser
+}
+
+var _ webdav.File = (*s3Reader)(nil)
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.off >= r.info.Size() {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.client.get(context.Background(), r.key, r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	if err == io.EOF && r.off < r.info.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.info.Size()
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if offset != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+func (r *s3Reader) Readdir(count int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (r *s3Reader) Stat() (fs.FileInfo, error)               { return r.info, nil }
+func (r *s3Reader) Write(p []byte) (int, error)              { return 0, fs.ErrPermission }
+
+// s3Writer is an object opened for writing, whose content is kept in a temporary file
+type s3Writer struct {
+	*os.File
+	client *s3Client
+	key    string
+	dirty  bool
+}
+
+var _ webdav.File = (*s3Writer)(nil)
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.dirty = true
+	return w.File.Write(p)
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	fi, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &virtualFileInfo{name: path.Base("/" + w.key), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+func (w *s3Writer) Readdir(count int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+
+func (w *s3Writer) Close() error {
+	defer w.discard()
+	if !w.dirty {
+		return nil
+	}
+	fi, err := w.File.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = w.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return w.client.put(context.Background(), w.key, w.File, fi.Size())
+}
+
+func (w *s3Writer) discard() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// s3Dir is an opened directory of s3FS. Its entries are listed at the first Readdir, and
+// returned by count like by os.File.
+type s3Dir struct {
+	client  *s3Client
+	key     string
+	listed  bool
+	entries []fs.FileInfo // not returned yet
+}
+
+var _ webdav.File = (*s3Dir)(nil)
+
+func (d *s3Dir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+func (d *s3Dir) list() ([]fs.FileInfo, error) {
+	prefix := ""
+	if d.key != "" {
+		prefix = d.key + "/"
+	}
+	objects, prefixes, err := d.client.list(context.Background(), prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+	var infos []fs.FileInfo
+	for _, obj := range objects {
+		if obj.Key == prefix {
+			continue // the marker of d itself
+		}
+		infos = append(infos, &virtualFileInfo{
+			name:    strings.TrimPrefix(obj.Key, prefix),
+			size:    obj.Size,
+			modTime: obj.LastModified,
+		})
+	}
+	for _, p := range prefixes {
+		infos = append(infos, dirInfo(strings.TrimSuffix(p, "/")))
+	}
+	return infos, nil
+}
+
+func (d *s3Dir) Close() error                                 { return nil }
+func (d *s3Dir) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (d *s3Dir) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (d *s3Dir) Stat() (fs.FileInfo, error)                   { return dirInfo(d.key), nil }
+func (d *s3Dir) Write(p []byte) (int, error)                  { return 0, fs.ErrInvalid }
+
+const (
+	// s3PartSize is the size of the parts of the multipart uploads and copies. A single
+	// PUT or CopyObject is limited to 5 GB, so bigger objects must be sent in parts.
+	s3PartSize = 64 << 20
+	s3MaxParts = 10000
+)
+
+// s3Client makes the path-style requests of the S3 REST API signed by AWS Signature
+// Version 4, with unsigned payloads
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	partSize  int64 // the objects bigger than it are uploaded and copied in parts
+	http      *http.Client
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// s3Escape percent-encodes everything except the unreserved characters and, if keepSlash,
+// the slashes, as required by the canonical request of the signature
+func s3Escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' && keepSlash {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header,
+	body io.Reader, size int64) (*http.Response, error) {
+	escapedPath := strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(c.bucket, false) +
+		"/" + s3Escape(key, true)
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		params = append(params, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+	rawQuery := strings.Join(params, "&")
+	u := *c.endpoint
+	u.RawQuery = rawQuery
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path, err = url.PathUnescape(escapedPath)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = escapedPath
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	c.sign(req, escapedPath, rawQuery, time.Now())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("s3 %s '%s' failed: %s %s", method, key, res.Status, msg)
+	}
+	return res, nil
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to req, whose payload hash
+// is already in the X-Amz-Content-Sha256 header
+func (c *s3Client) sign(req *http.Request, escapedPath, rawQuery string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			signed[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, escapedPath, rawQuery, canonicalHeaders.String(),
+		signedHeaders, req.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) head(ctx context.Context, key string) (os.FileInfo, error) {
+	res, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &virtualFileInfo{name: path.Base("/" + key), size: res.ContentLength, modTime: modTime}, nil
+}
+
+func (c *s3Client) get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := c.do(ctx, http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (c *s3Client) put(ctx context.Context, key string, body io.Reader, size int64) error {
+	if size > c.partSize {
+		return c.multipart(ctx, key, size, func(uploadId string, part int, offset, n int64) (string, error) {
+			return c.uploadPart(ctx, key, uploadId, part, io.LimitReader(body, n), n)
+		})
+	}
+	res, err := c.do(ctx, http.MethodPut, key, nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *s3Client) copySource(key string) string {
+	return "/" + s3Escape(c.bucket, false) + "/" + s3Escape(key, true)
+}
+
+// copy copies srcKey, whose size is size, to dstKey
+func (c *s3Client) copy(ctx context.Context, srcKey, dstKey string, size int64) error {
+	if size > c.partSize {
+		return c.multipart(ctx, dstKey, size, func(uploadId string, part int, offset, n int64) (string, error) {
+			return c.copyPart(ctx, srcKey, dstKey, uploadId, part, offset, n)
+		})
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", c.copySource(srcKey))
+	res, err := c.do(ctx, http.MethodPut, dstKey, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	return readS3Result(res, &struct{}{})
+}
+
+// readS3Result decodes the XML body of res into v. CopyObject, UploadPartCopy and
+// CompleteMultipartUpload may fail after the status 200 is sent, with an Error element
+// as the body.
+func readS3Result(res *http.Response, v any) error {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var root struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	err = xml.Unmarshal(body, &root)
+	if err != nil {
+		return err
+	}
+	if root.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 request failed: %s %s", root.Code, root.Message)
+	}
+	return xml.Unmarshal(body, v)
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipart creates key from the parts of a multipart upload, each of which is sent by
+// sendPart, which returns its ETag. The upload is aborted if a part fails.
+func (c *s3Client) multipart(ctx context.Context, key string, size int64,
+	sendPart func(uploadId string, part int, offset, n int64) (string, error)) error {
+	// the parts of the biggest objects are made bigger to keep them within s3MaxParts
+	partSize := c.partSize
+	if size > partSize*s3MaxParts {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	query := url.Values{}
+	query.Set("uploads", "")
+	res, err := c.do(ctx, http.MethodPost, key, query, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string
+	}
+	err = readS3Result(res, &upload)
+	if err != nil {
+		return err
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if size-offset < n {
+			n = size - offset
+		}
+		part := len(complete.Parts) + 1
+		var etag string
+		etag, err = sendPart(upload.UploadId, part, offset, n)
+		if err != nil {
+			break
+		}
+		complete.Parts = append(complete.Parts, completedPart{part, etag})
+	}
+	if err == nil {
+		err = c.completeUpload(ctx, key, upload.UploadId, complete)
+	}
+	if err != nil {
+		query = url.Values{}
+		query.Set("uploadId", upload.UploadId)
+		if res, abortErr := c.do(context.Background(), http.MethodDelete, key, query, nil, nil, 0); abortErr == nil {
+			res.Body.Close()
+		}
+	}
+	return err
+}
+
+func (c *s3Client) completeUpload(ctx context.Context, key, uploadId string, complete any) error {
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("uploadId", uploadId)
+	res, err := c.do(ctx, http.MethodPost, key, query, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	return readS3Result(res, &struct{}{})
+}
+
+func (c *s3Client) uploadPart(ctx context.Context, key, uploadId string, part int, body io.Reader,
+	size int64) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(part))
+	query.Set("uploadId", uploadId)
+	res, err := c.do(ctx, http.MethodPut, key, query, nil, body, size)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+// copyPart copies n bytes of srcKey from offset as a part with UploadPartCopy
+func (c *s3Client) copyPart(ctx context.Context, srcKey, dstKey, uploadId string, part int,
+	offset, n int64) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(part))
+	query.Set("uploadId", uploadId)
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", c.copySource(srcKey))
+	header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	res, err := c.do(ctx, http.MethodPut, dstKey, query, header, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		ETag string
+	}
+	err = readS3Result(res, &result)
+	return result.ETag, err
+}
+
+// delete succeeds even if the object does not exist, like DeleteObject itself
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	res, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the objects and the common prefixes under prefix with ListObjectsV2, at
+// most maxKeys objects if it is positive
+func (c *s3Client) list(ctx context.Context, prefix, delimiter string, maxKeys int) (
+	objects []s3Object, prefixes []string, err error) {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, obj := range result.Contents {
+			objects = append(objects, s3Object{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || maxKeys > 0 {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,358 @@
+package webdavledger
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartbch/cashdisk/config"
+)
+
+// fakeS3 serves the part of the S3 REST API used by s3Client from memory, refusing the
+// single requests of objects bigger than maxObject like S3 does above 5 GB
+type fakeS3 struct {
+	t         *testing.T
+	mu        sync.Mutex
+	maxObject int
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	completed int // the multipart uploads completed
+}
+
+func newFakeS3(t *testing.T, maxObject int) (*fakeS3, *s3FS) {
+	f := &fakeS3{t: t, maxObject: maxObject, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	s, err := newS3FS(config.S3Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "bucket",
+		AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	err := xml.NewEncoder(w).Encode(v)
+	if err != nil {
+		f.t.Error(err)
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	uploadId := query.Get("uploadId")
+	source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/bucket/")
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		f.writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadId string
+		}{UploadId: id})
+	case r.Method == http.MethodPost && uploadId != "":
+		f.complete(w, r, key, uploadId)
+	case r.Method == http.MethodPut && uploadId != "":
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			http.Error(w, "NoSuchUpload", http.StatusNotFound)
+			return
+		}
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		if source == "" {
+			parts[part], _ = io.ReadAll(r.Body)
+			w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, uploadId, part))
+			return
+		}
+		var first, last int
+		fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &first, &last)
+		parts[part] = append([]byte{}, f.objects[source][first:last+1]...)
+		f.writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyPartResult"`
+			ETag    string
+		}{ETag: fmt.Sprintf(`"%s-%d"`, uploadId, part)})
+	case r.Method == http.MethodPut:
+		content, _ := io.ReadAll(r.Body)
+		if source != "" {
+			content = f.objects[source]
+		}
+		if len(content) > f.maxObject {
+			http.Error(w, "EntityTooLarge", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = append([]byte{}, content...)
+		if source != "" {
+			f.writeXML(w, struct {
+				XMLName xml.Name `xml:"CopyObjectResult"`
+			}{})
+		}
+	case r.Method == http.MethodDelete && uploadId != "":
+		delete(f.uploads, uploadId)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		content, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		var offset int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)-offset))
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Write(content[offset:])
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, r *http.Request, key, uploadId string) {
+	var complete struct {
+		Parts []completedPart `xml:"Part"`
+	}
+	err := xml.NewDecoder(r.Body).Decode(&complete)
+	parts, ok := f.uploads[uploadId]
+	if err != nil || !ok {
+		http.Error(w, "MalformedXML", http.StatusBadRequest)
+		return
+	}
+	var content []byte
+	for i, part := range complete.Parts {
+		if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"%s-%d"`, uploadId, i+1) {
+			// S3 reports the errors of a completion after the status 200
+			f.writeXML(w, struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string
+			}{Code: "InvalidPart"})
+			return
+		}
+		content = append(content, parts[part.PartNumber]...)
+	}
+	f.objects[key] = content
+	delete(f.uploads, uploadId)
+	f.completed++
+	f.writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	}{})
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	var result listBucketResult
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{Key: k, Size: int64(len(f.objects[k]))})
+	}
+	f.writeXML(w, struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: result})
+}
+
+func writeS3File(t *testing.T, s *s3FS, name, content string) {
+	f, err := s.OpenFile(context.Background(), name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write([]byte(content))
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readS3File(t *testing.T, s *s3FS, name string, offset int64) string {
+	f, err := s.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestS3FSMultipart(t *testing.T) {
+	f, s := newFakeS3(t, 16)
+	s.client.partSize = 10
+	ctx := context.Background()
+	err := s.Mkdir(ctx, "/dir", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, big := "0123456789", strings.Repeat("abcdefghij", 2)+"klmno"
+
+	writeS3File(t, s, "/dir/small", small)
+	writeS3File(t, s, "/dir/big", big)
+	if f.completed != 1 {
+		t.Errorf("%d multipart uploads, want only the big file", f.completed)
+	}
+	if got := readS3File(t, s, "/dir/big", 0); got != big {
+		t.Errorf("read %q, want %q", got, big)
+	}
+	if got := readS3File(t, s, "/dir/big", 22); got != big[22:] {
+		t.Errorf("read %q from 22, want %q", got, big[22:])
+	}
+
+	// the big file is copied in parts, the small one with CopyObject
+	err = s.Rename(ctx, "/dir", "/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.completed != 2 {
+		t.Errorf("%d multipart uploads after the rename, want 2", f.completed)
+	}
+	if got := readS3File(t, s, "/moved/big", 0); got != big {
+		t.Errorf("read %q after the rename, want %q", got, big)
+	}
+	if got := readS3File(t, s, "/moved/small", 0); got != small {
+		t.Errorf("read %q after the rename, want %q", got, small)
+	}
+	if _, err = s.Stat(ctx, "/dir/big"); !os.IsNotExist(err) {
+		t.Errorf("the renamed file is still found: %v", err)
+	}
+	if len(f.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(f.uploads))
+	}
+}
+
+func TestS3FSAbortsFailedUploads(t *testing.T) {
+	f, s := newFakeS3(t, 16)
+	s.client.partSize = 10
+	err := s.client.multipart(context.Background(), "broken", 25,
+		func(uploadId string, part int, offset, n int64) (string, error) {
+			return "wrong", nil
+		})
+	if err == nil || !strings.Contains(err.Error(), "InvalidPart") {
+		t.Errorf("completing with wrong parts: %v", err)
+	}
+	if _, ok := f.objects["broken"]; ok || len(f.uploads) != 0 {
+		t.Error("the failed upload is not aborted")
+	}
+}
+
+func TestS3FSDirs(t *testing.T) {
+	_, s := newFakeS3(t, 1<<20)
+	ctx := context.Background()
+	for _, dir := range []string{"/a", "/a/b"} {
+		err := s.Mkdir(ctx, dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Mkdir(ctx, "/x/y", 0755); !os.IsNotExist(err) {
+		t.Errorf("mkdir without its parent: %v", err)
+	}
+	writeS3File(t, s, "/a/f", "f")
+	d, err := s.OpenFile(ctx, "/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := d.Readdir(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fmt.Sprintf("%s:%v", fi.Name(), fi.IsDir()))
+	}
+	if got := strings.Join(names, " "); got != "f:false b:true" {
+		t.Errorf("listed %s", got)
+	}
+	// the entries are returned by count
+	d, err = s.OpenFile(ctx, "/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"f", "b"} {
+		infos, err = d.Readdir(1)
+		if err != nil || len(infos) != 1 || infos[0].Name() != want {
+			t.Fatalf("Readdir %d: %v, %v", i, infos, err)
+		}
+	}
+	if infos, err = d.Readdir(1); err != io.EOF {
+		t.Errorf("Readdir after the entries: %v, %v", infos, err)
+	}
+	err = s.RemoveAll(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Stat(ctx, "/a/b"); !os.IsNotExist(err) {
+		t.Errorf("the removed dir is still found: %v", err)
+	}
+}
+
+func TestS3FSStalledEndpoint(t *testing.T) {
+	timeout := s3ResponseHeaderTimeout
+	s3ResponseHeaderTimeout = 100 * time.Millisecond
+	defer func() { s3ResponseHeaderTimeout = timeout }()
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+	s, err := newS3FS(config.S3Config{Endpoint: server.URL, Region: "us-east-1", Bucket: "bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = s.Stat(context.Background(), "/f")
+	if err == nil || time.Since(start) > 10*time.Second {
+		t.Errorf("stat on a stalled endpoint: %v after %s", err, time.Since(start))
+	}
+}
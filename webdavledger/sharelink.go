@@ -0,0 +1,107 @@
+package webdavledger
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+const shareLinkPrefix = "/s/"
+
+// serveShareLink serves the file or directory behind a public share link without
+// authentication. It is readonly, and the owner of the link pays for the access.
+func (d *DiskService) serveShareLink(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, shareLinkPrefix), "/")
+	info, err := types.GetShareLink(d.db, token)
+	if err != nil {
+		http.Error(w, "No such share link", http.StatusNotFound)
+		return
+	}
+	if len(info.PasswordHash) != 0 {
+		status, errStr := d.pwAuth.checkShareLinkPassword(r, token, info.PasswordHash)
+		if status == http.StatusTooManyRequests {
+			utils.WriteTooManyRequests(w, d.pwAuth.failedLogins.RetryAfter())
+			return
+		}
+		if len(errStr) != 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="share link", charset="UTF-8"`)
+			http.Error(w, errStr, status)
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+	default:
+		http.Error(w, types.ErrReadOnly.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	isLocked, _, err := types.IsUserLock(d.db, info.Uid)
+	if err != nil {
+		http.Error(w, "get user lock status error"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isLocked {
+		http.Error(w, "user is locked", http.StatusBadRequest)
+		return
+	}
+	owner, err := types.GetAddressByUID(d.db, info.Uid)
+	if err != nil {
+		http.Error(w, "Inconsistent Database", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		err = types.UseShareLink(d.db, token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	fs, err := d.newFS(owner, info.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	d.serveWatched(sw, r, shareLinkPrefix+token, &WatchedDir{
+		FileSystem: fs,
+		db:         d.db,
+		readers:    payers{info.Uid},
+		writerUid:  info.Uid,
+		perm:       types.PermRead,
+		prices:     d.cfg.Prices,
+		owner:      owner,
+		ownerUid:   info.Uid,
+		base:       info.Path,
+		throttle:   d.throttle,
+	})
+	if r.Method == http.MethodGet && sw.status != http.StatusOK && sw.status != http.StatusPartialContent {
+		err = types.ReleaseShareLink(d.db, token)
+		if err != nil {
+			log.Printf("Error in ReleaseShareLink: %s\n", err.Error())
+		}
+	}
+}
+
+// statusWriter records the status of the response, so that a download which failed
+// is not counted
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
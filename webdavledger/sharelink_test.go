@@ -0,0 +1,96 @@
+package webdavledger
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+func TestShareLinkPassword(t *testing.T) {
+	td := newTestDisk(t)
+	td.writeFile(td.owner, "a.txt", "shared content")
+	const token = "token"
+	err := types.AddShareLink(td.db, token, types.ShareLinkInfo{
+		Uid:               td.owner.uid,
+		ExpiredTime:       time.Now().Add(time.Hour).UnixNano(),
+		RemainedDownloads: -1,
+		PasswordHash:      utils.HashPassword(sha256.Sum256([]byte("secret"))),
+		Path:              "a.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ip, password string) int {
+		r := httptest.NewRequest(http.MethodGet, shareLinkPrefix+token, nil)
+		r.RemoteAddr = ip + ":1234"
+		r.SetBasicAuth("", password)
+		w := httptest.NewRecorder()
+		td.d.serveShareLink(w, r)
+		return w.Code
+	}
+
+	if status := get("192.0.2.1", "secret"); status != http.StatusOK {
+		t.Fatalf("status %d with the password", status)
+	}
+	// the verified password is cached
+	cached := td.d.pwAuth.verified.Count()
+	if status := get("192.0.2.1", "secret"); status != http.StatusOK || cached != 1 || td.d.pwAuth.verified.Count() != 1 {
+		t.Errorf("status %d with %d then %d verified passwords cached", status, cached, td.d.pwAuth.verified.Count())
+	}
+
+	maxCount := int(td.d.cfg.FailedLoginRateLimit.MaxCount)
+	for i := 0; i < maxCount; i++ {
+		if status := get("192.0.2.2", "guess"); status != http.StatusUnauthorized {
+			t.Fatalf("status %d for guess %d", status, i)
+		}
+	}
+	// once the failures of a client are exceeded, the password is not even checked
+	if status := get("192.0.2.2", "secret"); status != http.StatusTooManyRequests {
+		t.Errorf("status %d after %d failures", status, maxCount)
+	}
+	if status := get("192.0.2.3", "secret"); status != http.StatusOK {
+		t.Errorf("status %d from another client", status)
+	}
+}
+
+func TestParallelShareLinkDownloads(t *testing.T) {
+	td := newTestDisk(t)
+	td.writeFile(td.owner, "a.txt", "shared content")
+	const token, downloads = "token", 20
+	err := types.AddShareLink(td.db, token, types.ShareLinkInfo{
+		Uid:               td.owner.uid,
+		ExpiredTime:       time.Now().Add(time.Hour).UnixNano(),
+		RemainedDownloads: downloads,
+		Path:              "a.txt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(chan int, downloads+1)
+	var wg sync.WaitGroup
+	for i := 0; i < downloads+1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			td.d.serveShareLink(w, httptest.NewRequest(http.MethodGet, shareLinkPrefix+token, nil))
+			statuses <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	// the downloads of the limit all succeed, however they conflict
+	if counts[http.StatusOK] != downloads || counts[http.StatusForbidden] != 1 {
+		t.Errorf("statuses of the downloads: %v", counts)
+	}
+}
@@ -0,0 +1,151 @@
+package webdavledger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ReneKroon/ttlcache"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+// Wallet based apps can log in without a password: they get a nonce from /auth/nonce,
+// sign the returned message with personal_sign and post the signature to /auth/login,
+// which returns a bearer token for the following WebDAV requests.
+const authPrefix = "/auth/"
+
+var (
+	loginNonceTTL  = 5 * time.Minute
+	bearerTokenTTL = time.Hour
+
+	// the caches are bounded, so that requesting nonces or logging in repeatedly cannot
+	// exhaust the memory. The bounds are checked before adding, so they may be exceeded
+	// by the requests served concurrently.
+	maxLoginNonces  = 100_000
+	maxBearerTokens = 100_000
+)
+
+type sigAuth struct {
+	nonces *ttlcache.Cache // nonce => common.Address
+	tokens *ttlcache.Cache // token => common.Address
+}
+
+func newSigAuth() *sigAuth {
+	nonces := ttlcache.NewCache()
+	nonces.SetTTL(loginNonceTTL)
+	nonces.SkipTtlExtensionOnHit(true)
+	tokens := ttlcache.NewCache()
+	tokens.SetTTL(bearerTokenTTL)
+	tokens.SkipTtlExtensionOnHit(true)
+	return &sigAuth{nonces: nonces, tokens: tokens}
+}
+
+func loginMessage(addr common.Address, nonce string) string {
+	return fmt.Sprintf("Log in to CashDisk\nAddress: %s\nNonce: %s", addr.Hex(), nonce)
+}
+
+func randomHex(n int) (string, error) {
+	bz := make([]byte, n)
+	_, err := rand.Read(bz)
+	return hex.EncodeToString(bz), err
+}
+
+func (s *sigAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, authPrefix) {
+	case "nonce":
+		s.handleGetNonce(w, r)
+	case "login":
+		s.handleLogin(w, r)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (s *sigAuth) handleGetNonce(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if !common.IsHexAddress(address) {
+		http.Error(w, "Invalid address", http.StatusBadRequest)
+		return
+	}
+	addr := common.HexToAddress(address)
+	nonce, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.nonces.Count() >= maxLoginNonces {
+		http.Error(w, "Too many pending logins", http.StatusServiceUnavailable)
+		return
+	}
+	s.nonces.Set(nonce, addr)
+	out, _ := json.Marshal(types.GetLoginNonceRes{
+		Nonce:   nonce,
+		Message: loginMessage(addr, nonce),
+	})
+	w.Write(out)
+}
+
+func (s *sigAuth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var param types.LoginParam
+	body, _ := io.ReadAll(r.Body)
+	err := json.Unmarshal(body, &param)
+	if err != nil {
+		http.Error(w, "param parsed failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, ok := s.nonces.Get(param.Nonce)
+	if !ok || value.(common.Address) != param.Address {
+		http.Error(w, "Invalid or expired nonce", http.StatusUnauthorized)
+		return
+	}
+	var hash [32]byte
+	copy(hash[:], accounts.TextHash([]byte(loginMessage(param.Address, param.Nonce))))
+	signer, err := utils.GetAddressAndCheckSig(hash, param.Sig)
+	if err != nil || signer != param.Address {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	// each nonce can only be used once: of the concurrent logins with the same nonce,
+	// only the one which removes it succeeds
+	if !s.nonces.Remove(param.Nonce) {
+		http.Error(w, "Invalid or expired nonce", http.StatusUnauthorized)
+		return
+	}
+	if s.tokens.Count() >= maxBearerTokens {
+		http.Error(w, "Too many active logins", http.StatusServiceUnavailable)
+		return
+	}
+	token, err := randomHex(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.tokens.Set(token, param.Address)
+	out, _ := json.Marshal(types.LoginRes{
+		Token:       token,
+		ExpiredTime: time.Now().Add(bearerTokenTTL).UnixNano(),
+	})
+	w.Write(out)
+}
+
+// bearerAuth returns ok=false if the request does not carry a bearer token
+func (s *sigAuth) bearerAuth(r *http.Request) (cred credential, errStr string, ok bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return cred, "", false
+	}
+	value, found := s.tokens.Get(token)
+	if !found {
+		return cred, "Invalid or expired token", true
+	}
+	return credential{addr: value.(common.Address)}, "", true
+}
@@ -0,0 +1,188 @@
+package webdavledger
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+const TrashDir = ".trash"
+
+var ErrRestoreTargetExists = errors.New("the original path is occupied")
+
+// TrashBin keeps the files and directories removed through WebDAV until they are restored
+// or purged. A trashed entry is stored at /.trash/<owner>/<deletedTime> in the backend,
+// where it is counted by the storage scan like any other file of the owner.
+type TrashBin struct {
+	db   *badger.DB
+	root webdav.FileSystem
+}
+
+func NewTrashBin(db *badger.DB, root webdav.FileSystem) *TrashBin {
+	return &TrashBin{db: db, root: root}
+}
+
+func trashPath(owner common.Address, deletedTime int64) string {
+	return path.Join("/", TrashDir, owner.Hex(), strconv.FormatInt(deletedTime, 10))
+}
+
+// trashedMetadataPath is the path under which the checksums and the dead properties of
+// a trashed entry are kept. It starts with "..", so it is never the path of a file in
+// a home, and the scrubbing skips it.
+func trashedMetadataPath(deletedTime int64) string {
+	return path.Join("..", TrashDir, strconv.FormatInt(deletedTime, 10))
+}
+
+func isTrashedMetadataPath(p string) bool {
+	return strings.HasPrefix(p, "../")
+}
+
+// Trash moves the file or directory at p, which is relative to the home of owner, into the
+// trash. It does nothing if p does not exist.
+func (tb *TrashBin) Trash(owner common.Address, uid int64, p string) error {
+	ctx := context.Background()
+	p = types.CleanPath(p)
+	src := homePath(owner, p)
+	fi, err := tb.root.Stat(ctx, src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if fi.IsDir() {
+		size = 0
+		err = Walk(ctx, tb.root, src, func(_ string, f os.FileInfo, err error) error {
+			if err == nil && !f.IsDir() {
+				size += f.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	deletedTime := utils.GetTimestamp()
+	dst := trashPath(owner, deletedTime)
+	err = mkdirAll(ctx, tb.root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	err = tb.root.Rename(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	err = types.AddTrashEntry(tb.db, uid, types.TrashEntryInfo{
+		DeletedTime: deletedTime,
+		Path:        p,
+		Size:        size,
+		IsDir:       fi.IsDir(),
+	})
+	if err != nil {
+		return err
+	}
+	return moveMetadata(tb.db, uid, p, trashedMetadataPath(deletedTime))
+}
+
+func (tb *TrashBin) List(uid int64) ([]types.TrashEntryInfo, error) {
+	entries, err := types.GetTrashEntries(tb.db, uid)
+	return entries[uid], err
+}
+
+// Restore moves the entry back to its original path, which must not be occupied
+func (tb *TrashBin) Restore(owner common.Address, uid int64, deletedTime int64) error {
+	ctx := context.Background()
+	info, err := types.GetTrashEntry(tb.db, uid, deletedTime)
+	if err != nil {
+		return err
+	}
+	dst := homePath(owner, info.Path)
+	if _, err = tb.root.Stat(ctx, dst); err == nil {
+		return ErrRestoreTargetExists
+	}
+	err = mkdirAll(ctx, tb.root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	err = tb.root.Rename(ctx, trashPath(owner, deletedTime), dst)
+	if err != nil {
+		return err
+	}
+	err = moveMetadata(tb.db, uid, trashedMetadataPath(deletedTime), info.Path)
+	if err != nil {
+		return err
+	}
+	return types.DeleteTrashEntry(tb.db, uid, deletedTime)
+}
+
+// Purge removes the entry permanently, or all the entries of uid if deletedTime is zero
+func (tb *TrashBin) Purge(owner common.Address, uid int64, deletedTime int64) error {
+	if deletedTime != 0 {
+		_, err := types.GetTrashEntry(tb.db, uid, deletedTime)
+		if err != nil {
+			return err
+		}
+		return tb.purge(owner, uid, deletedTime)
+	}
+	entries, err := tb.List(uid)
+	if err != nil {
+		return err
+	}
+	for _, info := range entries {
+		err = tb.purge(owner, uid, info.DeletedTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tb *TrashBin) purge(owner common.Address, uid int64, deletedTime int64) error {
+	err := tb.root.RemoveAll(context.Background(), trashPath(owner, deletedTime))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = deleteMetadata(tb.db, uid, trashedMetadataPath(deletedTime))
+	if err != nil {
+		return err
+	}
+	return types.DeleteTrashEntry(tb.db, uid, deletedTime)
+}
+
+// PurgeExpired removes the entries of all the users which were deleted before the
+// given unix nano time, and returns how many entries are purged
+func (tb *TrashBin) PurgeExpired(before int64) (int, error) {
+	all, err := types.GetTrashEntries(tb.db, -1)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for uid, entries := range all {
+		owner, err := types.GetAddressByUID(tb.db, uid)
+		if err != nil {
+			return count, err
+		}
+		for _, info := range entries {
+			if info.DeletedTime >= before {
+				break
+			}
+			err = tb.purge(owner, uid, info.DeletedTime)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
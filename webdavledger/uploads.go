@@ -0,0 +1,405 @@
+package webdavledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+)
+
+// Resumable uploads follow the chunking protocol of Nextcloud (version 2):
+//
+//	MKCOL  /uploads/<id>           starts an upload
+//	PUT    /uploads/<id>/<n>       uploads the part n, from 1 to maxUploadParts
+//	PROPFIND /uploads/<id>         lists the parts received, to resume after a failure
+//	MOVE   /uploads/<id>/.file     assembles the parts in order into the Destination
+//	DELETE /uploads/<id>           aborts the upload
+//
+// The parts are staged at /.uploads/<address>/<id> in the backend, encrypted like the
+// home, where they are neither charged nor counted by the storage scan. The assembled
+// file is moved into the home at once, and its bytes are charged like a PUT, refunded if
+// the move fails. An upload which is not committed within UploadExpiry of its MKCOL is
+// removed, however recently its parts were uploaded, so that the uncharged staging area
+// cannot hold files for longer.
+const (
+	UploadsDir     = ".uploads"
+	uploadFile     = ".file"
+	maxUploadParts = 10000
+
+	uploadCleanupInterval = time.Hour
+)
+
+func stagePath(owner common.Address) string {
+	return path.Join("/", UploadsDir, owner.Hex())
+}
+
+// stageFS returns the staging area of owner
+func (d *DiskService) stageFS(ctx context.Context, owner common.Address) (webdav.FileSystem, error) {
+	err := mkdirAll(ctx, d.root, stagePath(owner))
+	if err != nil {
+		return nil, err
+	}
+	var fs webdav.FileSystem = newSubFS(d.root, stagePath(owner))
+	if d.keys == nil {
+		return fs, nil
+	}
+	key, err := d.keys.dataKey(owner)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFS{FileSystem: fs, key: key}, nil
+}
+
+func parsePartNumber(name string) (int, bool) {
+	n, err := strconv.Atoi(name)
+	return n, err == nil && n >= 1 && n <= maxUploadParts && strconv.Itoa(n) == name
+}
+
+func (d *DiskService) serveUploads(w http.ResponseWriter, r *http.Request, cred credential, uid int64) {
+	if cred.readOnly {
+		http.Error(w, types.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	names := splitPath(strings.TrimPrefix(path.Clean("/"+r.URL.Path), uploadsPrefix))
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") && !(len(names) == 2 && name == uploadFile) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+	allowed := false
+	switch r.Method {
+	case http.MethodOptions, "PROPFIND":
+		allowed = len(names) <= 2
+	case "MKCOL":
+		allowed = len(names) == 1
+	case http.MethodDelete:
+		allowed = len(names) == 1 || len(names) == 2
+	case http.MethodPut:
+		_, allowed = parsePartNumber(path.Base(r.URL.Path))
+		allowed = allowed && len(names) == 2
+	case "MOVE":
+		allowed = len(names) == 2 && names[1] == uploadFile
+	}
+	if !allowed {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	fs, err := d.stageFS(ctx, cred.addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "MKCOL" {
+		_, err = types.StartUpload(d.db, cred.addr, names[0], time.Now().UnixNano(), d.uploadStartTTL())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.Method == "MOVE" {
+		status, err := d.commitUpload(r, cred, uid, fs, names[0])
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(status)
+		return
+	}
+	if r.Method == http.MethodPut {
+		reserved, err := d.staging.reserve(ctx, fs, cred.addr, r.ContentLength, d.cfg.MaxStagedSize)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errStagingFull) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		defer d.staging.release(cred.addr, reserved)
+		r.Body = http.MaxBytesReader(w, r.Body, reserved)
+		r.Body = &throttledReader{ReadCloser: r.Body, ctx: ctx, throttle: d.throttle, uid: uid}
+	}
+	handler := &webdav.Handler{Prefix: uploadsPrefix, FileSystem: fs, LockSystem: &DummyLockSystem{}}
+	handler.ServeHTTP(w, r)
+	if r.Method == http.MethodDelete && len(names) == 1 {
+		// a start time left behind only expires, so a failure is not reported
+		_ = types.EndUpload(d.db, cred.addr, names[0])
+	}
+}
+
+// uploadStartTTL keeps the start time of an upload until after it is purged
+func (d *DiskService) uploadStartTTL() time.Duration {
+	return d.cfg.UploadExpiry + 2*uploadCleanupInterval
+}
+
+var errStagingFull = errors.New("the staged parts take all the space allowed")
+
+// staging keeps the space reserved by the parts being uploaded by each user, so that the
+// parts uploaded in parallel cannot exceed the space allowed together
+type staging struct {
+	mu       sync.Mutex
+	reserved map[common.Address]int64
+}
+
+// reserve reserves size bytes for a part uploaded by owner, or all the space left if the
+// size is unknown, and returns the bytes reserved
+func (s *staging) reserve(ctx context.Context, fs webdav.FileSystem, owner common.Address, size,
+	maxSize int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	staged, err := stagedSize(ctx, fs, "/")
+	if err != nil {
+		return 0, err
+	}
+	// the parts being uploaded are counted both as staged and reserved, to stay on the safe side
+	left := maxSize - staged - s.reserved[owner]
+	if size < 0 {
+		size = left
+	}
+	if left <= 0 || size > left {
+		return 0, errStagingFull
+	}
+	s.reserved[owner] += size
+	return size, nil
+}
+
+func (s *staging) release(owner common.Address, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved[owner] -= size
+	if s.reserved[owner] == 0 {
+		delete(s.reserved, owner)
+	}
+}
+
+func stagedSize(ctx context.Context, fs webdav.FileSystem, name string) (int64, error) {
+	size := int64(0)
+	err := Walk(ctx, fs, name, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// listParts returns the part numbers of the upload id in order, and their total size
+func listParts(ctx context.Context, fs webdav.FileSystem, id string) ([]int, int64, error) {
+	f, err := fs.OpenFile(ctx, "/"+id, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	infos, err := f.Readdir(0)
+	f.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	var parts []int
+	total := int64(0)
+	for _, fi := range infos {
+		if n, ok := parsePartNumber(fi.Name()); ok && !fi.IsDir() {
+			parts = append(parts, n)
+			total += fi.Size()
+		}
+	}
+	sort.Ints(parts)
+	return parts, total, nil
+}
+
+// commitUpload assembles the parts of the upload id into the Destination of r, which must
+// be in the home of the caller, and returns the HTTP status
+func (d *DiskService) commitUpload(r *http.Request, cred credential, uid int64, fs webdav.FileSystem,
+	id string) (int, error) {
+	ctx := r.Context()
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || (dest.Host != "" && dest.Host != r.Host) {
+		return http.StatusBadGateway, fmt.Errorf("invalid destination")
+	}
+	prefix := path.Join(homePrefix, cred.scope)
+	name := strings.TrimPrefix(path.Clean("/"+dest.Path), prefix)
+	if !strings.HasPrefix(name, "/") || name == "/" {
+		return http.StatusForbidden, types.ErrNoPermission
+	}
+	parts, total, err := listParts(ctx, fs, id)
+	if os.IsNotExist(err) {
+		return http.StatusNotFound, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(parts) == 0 || parts[len(parts)-1] != len(parts) {
+		return http.StatusBadRequest, fmt.Errorf("the parts from 1 to %d are not all uploaded", len(parts))
+	}
+	if l := r.Header.Get("OC-Total-Length"); l != "" && l != strconv.FormatInt(total, 10) {
+		return http.StatusBadRequest, fmt.Errorf("the parts have %d bytes instead of %s", total, l)
+	}
+	wd, err := d.homeDir(cred, uid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	status, err := wd.checkUpload(ctx, name)
+	if err != nil {
+		return status, err
+	}
+	sum, err := assembleParts(ctx, fs, id, parts)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	status, err = wd.commitUpload(ctx, d.root, path.Join(stagePath(cred.addr), id, uploadFile), name, total, sum)
+	if err != nil {
+		return status, err
+	}
+	err = fs.RemoveAll(ctx, "/"+id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_ = types.EndUpload(d.db, cred.addr, id)
+	return status, nil
+}
+
+// assembleParts concatenates the parts into the upload file, and returns its checksum
+func assembleParts(ctx context.Context, fs webdav.FileSystem, id string, parts []int) ([]byte, error) {
+	out, err := fs.OpenFile(ctx, path.Join("/", id, uploadFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	for _, n := range parts {
+		var in webdav.File
+		in, err = fs.OpenFile(ctx, path.Join("/", id, strconv.Itoa(n)), os.O_RDONLY, 0)
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(w, in)
+		in.Close()
+		if err != nil {
+			break
+		}
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), closeErr
+}
+
+// checkUpload checks that an uploaded file can be committed at name, like a PUT
+func (wd *WatchedDir) checkUpload(ctx context.Context, name string) (int, error) {
+	if fi, err := wd.FileSystem.Stat(ctx, path.Dir(name)); err != nil || !fi.IsDir() {
+		return http.StatusConflict, os.ErrNotExist
+	}
+	need := types.PermCreate
+	fi, err := wd.FileSystem.Stat(ctx, name)
+	if err == nil {
+		if fi.IsDir() {
+			return http.StatusMethodNotAllowed, os.ErrExist
+		}
+		need = types.PermWrite
+	}
+	err = checkPerm(wd.perm, need)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	return 0, nil
+}
+
+// commitUpload moves the assembled file at src in the backend root to name, and charges
+// the writer for opening and writing it. The writer is refunded if the file is not moved.
+func (wd *WatchedDir) commitUpload(ctx context.Context, root webdav.FileSystem, src, name string,
+	size int64, sum []byte) (status int, err error) {
+	operation := fmt.Sprintf("Upload '%s' for %d bytes", name, size)
+	writer := payers{wd.writerUid}
+	payments, err := writer.chargePayments(wd.db, wd.prices, config.OpOpenFile, 0, operation)
+	if err == nil {
+		var writes []payment
+		writes, err = writer.chargePayments(wd.db, wd.prices, config.OpWrite, (size+1023)/1024, operation)
+		payments = append(payments, writes...)
+	}
+	defer func() {
+		if err != nil {
+			refund(wd.db, payments, operation)
+		}
+	}()
+	if err != nil {
+		return http.StatusPaymentRequired, err
+	}
+	status = http.StatusCreated
+	if fi, err := wd.FileSystem.Stat(ctx, name); err == nil && !fi.IsDir() {
+		status = http.StatusNoContent
+		err = wd.saveVersion(name)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	err = root.Rename(ctx, src, homePath(wd.owner, wd.pathOf(name)))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = types.SetChecksum(wd.db, wd.ownerUid, wd.pathOf(name), sum)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return status, nil
+}
+
+// PurgeStaleUploads removes the uploads started before before. The uploads staged before
+// the start times were recorded are deemed started at their first purge.
+func (d *DiskService) PurgeStaleUploads(before time.Time) (int, error) {
+	ctx := context.Background()
+	now := time.Now().UnixNano()
+	count := 0
+	err := Walk(ctx, d.root, "/"+UploadsDir, func(name string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		names := splitPath(name)
+		if err != nil || len(names) != 3 {
+			return err
+		}
+		owner := common.HexToAddress(names[1])
+		started, err := types.StartUpload(d.db, owner, names[2], now, d.uploadStartTTL())
+		if err != nil || started >= before.UnixNano() {
+			return err
+		}
+		count++
+		err = d.root.RemoveAll(ctx, name)
+		if err != nil {
+			return err
+		}
+		return types.EndUpload(d.db, owner, names[2])
+	})
+	return count, err
+}
+
+func (d *DiskService) StartUploadCleanupRoutine() {
+	for {
+		time.Sleep(uploadCleanupInterval)
+		n, err := d.PurgeStaleUploads(time.Now().Add(-d.cfg.UploadExpiry))
+		if err != nil {
+			log.Printf("Error in PurgeStaleUploads: %s\n", err.Error())
+		}
+		if n != 0 {
+			log.Printf("%d stale uploads removed\n", n)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package webdavledger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/types"
+)
+
+func (td *testDisk) upload(id string, parts ...string) {
+	if w := td.serve(td.owner, "MKCOL", "/uploads/"+id, "", nil); w.Code != http.StatusCreated {
+		td.t.Fatalf("MKCOL status %d: %s", w.Code, w.Body.String())
+	}
+	for i, part := range parts {
+		w := td.serve(td.owner, http.MethodPut, "/uploads/"+id+"/"+strconv.Itoa(i+1), part, nil)
+		if w.Code != http.StatusCreated {
+			td.t.Fatalf("PUT part %d status %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUploadCommit(t *testing.T) {
+	td := newTestDisk(t)
+	parts := []string{strings.Repeat("a", 1500), strings.Repeat("b", 1500)}
+	td.upload("u1", parts...)
+	if got := testBalance - td.balance(td.owner); got != 0 {
+		t.Errorf("charged %d for the staged parts", got)
+	}
+	w := td.serve(td.owner, "MOVE", "/uploads/u1/.file", "", map[string]string{
+		"Destination":     "/home/f.txt",
+		"OC-Total-Length": "3000",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MOVE status %d: %s", w.Code, w.Body.String())
+	}
+	if content, err := td.readFile(td.owner, "f.txt"); err != nil || content != parts[0]+parts[1] {
+		t.Errorf("the committed file is not assembled from the parts: %v", err)
+	}
+	// opened and written for 3 KB
+	if got := testBalance - td.balance(td.owner); got != 7+3*2 {
+		t.Errorf("charged %d for the commit", got)
+	}
+}
+
+// renameFailFS fails to move the uploads out of the staging area
+type renameFailFS struct {
+	webdav.FileSystem
+}
+
+func (fs renameFailFS) Rename(ctx context.Context, oldName, newName string) error {
+	if strings.HasPrefix(oldName, "/"+UploadsDir+"/") {
+		return errors.New("rename failed")
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+func TestUploadRefundsFailedCommit(t *testing.T) {
+	td := newTestDisk(t)
+	td.upload("u1", "content")
+	td.d.root = renameFailFS{td.root}
+	w := td.serve(td.owner, "MOVE", "/uploads/u1/.file", "", map[string]string{"Destination": "/home/f.txt"})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("MOVE status %d: %s", w.Code, w.Body.String())
+	}
+	if got := testBalance - td.balance(td.owner); got != 0 {
+		t.Errorf("charged %d for the failed commit", got)
+	}
+}
+
+func TestUploadStagingLimit(t *testing.T) {
+	td := newTestDisk(t)
+	td.d.cfg.MaxStagedSize = 10
+	td.upload("u1", "12")
+
+	// the first part holds its space while it is being uploaded
+	pr, pw := io.Pipe()
+	r := httptest.NewRequest(http.MethodPut, "/uploads/u1/2", pr)
+	r.ContentLength = 6
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		td.d.route(w, r, credential{addr: td.owner.addr}, td.owner.uid)
+		done <- w.Code
+	}()
+	_, err := pw.Write([]byte("345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := td.serve(td.owner, http.MethodPut, "/uploads/u1/3", "678", nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("parallel part status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	pw.Write([]byte("678"))
+	pw.Close()
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("first part status %d", code)
+	}
+	// the space is released once the part is staged
+	if w := td.serve(td.owner, http.MethodPut, "/uploads/u1/3", "90", nil); w.Code != http.StatusCreated {
+		t.Errorf("part status %d after the upload: %s", w.Code, w.Body.String())
+	}
+	if w := td.serve(td.owner, http.MethodPut, "/uploads/u1/4", "x", nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("part status %d over the limit", w.Code)
+	}
+}
+
+func TestPurgeStaleUploads(t *testing.T) {
+	td := newTestDisk(t)
+	ttl := td.d.uploadStartTTL()
+	td.upload("u1", "1")
+	time.Sleep(time.Millisecond)
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+	td.upload("u2", "1")
+	// an upload staged before the start times were recorded
+	err := mkdirAll(context.Background(), td.root, path.Join(stagePath(td.owner.addr), "u3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uploading a part or starting the upload again does not delay its purge
+	if w := td.serve(td.owner, http.MethodPut, "/uploads/u1/2", "2", nil); w.Code != http.StatusCreated {
+		t.Fatalf("PUT status %d: %s", w.Code, w.Body.String())
+	}
+	if w := td.serve(td.owner, "MKCOL", "/uploads/u1", "", nil); w.Code == http.StatusCreated {
+		t.Fatal("started the upload twice")
+	}
+
+	n, err := td.d.PurgeStaleUploads(before)
+	if err != nil || n != 1 {
+		t.Fatalf("%d uploads purged: %v", n, err)
+	}
+	for _, c := range []struct {
+		id   string
+		kept bool
+	}{{"u1", false}, {"u2", true}, {"u3", true}} {
+		_, err = td.root.Stat(context.Background(), path.Join(stagePath(td.owner.addr), c.id))
+		if (err == nil) != c.kept {
+			t.Errorf("upload %s kept: %v", c.id, err)
+		}
+	}
+	// the upload staged before is deemed started at the purge
+	started, err := types.StartUpload(td.db, td.owner.addr, "u3", 0, ttl)
+	if err != nil || started < before.UnixNano() {
+		t.Errorf("upload u3 started at %d: %v", started, err)
+	}
+
+	// the start time is forgotten once the upload is aborted, or purged
+	if w := td.serve(td.owner, http.MethodDelete, "/uploads/u2", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status %d: %s", w.Code, w.Body.String())
+	}
+	for _, id := range []string{"u1", "u2"} {
+		started, err = types.StartUpload(td.db, td.owner.addr, id, 1, ttl)
+		if err != nil || started != 1 {
+			t.Errorf("upload %s started at %d: %v", id, started, err)
+		}
+	}
+}
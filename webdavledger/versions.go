@@ -0,0 +1,358 @@
+package webdavledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/webdav"
+
+	"github.com/smartbch/cashdisk/config"
+	"github.com/smartbch/cashdisk/types"
+	"github.com/smartbch/cashdisk/utils"
+)
+
+const VersionsDir = ".versions"
+
+var ErrNoSuchVersion = errors.New("no such version")
+
+// VersionStore keeps the overwritten files of the versioned directories. The content of
+// a version is stored at /.versions/<owner>/<hex sha256(path)>/<versionId> in the backend,
+// where it is counted by the storage scan like any other file of the owner.
+type VersionStore struct {
+	db   *badger.DB
+	root webdav.FileSystem
+}
+
+func NewVersionStore(db *badger.DB, root webdav.FileSystem) *VersionStore {
+	return &VersionStore{db: db, root: root}
+}
+
+func homePath(owner common.Address, p string) string {
+	return path.Join("/", owner.Hex(), p)
+}
+
+func versionPath(owner common.Address, p string, versionId int64) string {
+	pathHash := sha256.Sum256([]byte(p))
+	return path.Join("/", VersionsDir, owner.Hex(), hex.EncodeToString(pathHash[:]),
+		strconv.FormatInt(versionId, 10))
+}
+
+// Save moves the file at p, or all the files under p if it is a directory, into the
+// version store, if versioning is enabled for p. p is relative to the home of owner.
+func (vs *VersionStore) Save(owner common.Address, uid int64, p string) error {
+	home := homePath(owner, "")
+	return Walk(context.Background(), vs.root, homePath(owner, p), func(name string, f os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || f.IsDir() {
+			return err
+		}
+		filePath := types.CleanPath(strings.TrimPrefix(name, home))
+		maxVersions, err := types.FindVersionedDir(vs.db, uid, filePath)
+		if err != nil || maxVersions == 0 {
+			return err
+		}
+		err = vs.saveFile(owner, uid, filePath, f.Size())
+		if err != nil {
+			return err
+		}
+		return vs.prune(owner, uid, filePath, maxVersions)
+	})
+}
+
+func (vs *VersionStore) saveFile(owner common.Address, uid int64, p string, size int64) error {
+	ctx := context.Background()
+	versionId := utils.GetTimestamp()
+	dst := versionPath(owner, p, versionId)
+	err := mkdirAll(ctx, vs.root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	err = vs.root.Rename(ctx, homePath(owner, p), dst)
+	if err != nil {
+		return err
+	}
+	return types.AddFileVersion(vs.db, uid, types.FileVersionInfo{Path: p, VersionId: versionId, Size: size})
+}
+
+// prune removes the oldest versions of p until at most maxVersions are left. Nothing is
+// removed if maxVersions is 0, i.e. versioning was disabled for p, as the versions left
+// can still be restored.
+func (vs *VersionStore) prune(owner common.Address, uid int64, p string, maxVersions int64) error {
+	if maxVersions == 0 {
+		return nil
+	}
+	versions, err := types.GetFileVersions(vs.db, uid, &p)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(versions)-int(maxVersions); i++ {
+		err = vs.remove(owner, uid, versions[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vs *VersionStore) remove(owner common.Address, uid int64, v types.FileVersionInfo) error {
+	err := vs.root.RemoveAll(context.Background(), versionPath(owner, v.Path, v.VersionId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return types.DeleteFileVersion(vs.db, uid, v.Path, v.VersionId)
+}
+
+// List returns the versions of p, or of all the files of owner if p is empty
+func (vs *VersionStore) List(uid int64, p string) ([]types.FileVersionInfo, error) {
+	if p == "" {
+		return types.GetFileVersions(vs.db, uid, nil)
+	}
+	p = types.CleanPath(p)
+	return types.GetFileVersions(vs.db, uid, &p)
+}
+
+// Restore puts the version back to p. The current file at p is saved as a new version,
+// even if versioning is no longer enabled for p, so that restoring never loses a file.
+func (vs *VersionStore) Restore(owner common.Address, uid int64, p string, versionId int64) error {
+	ctx := context.Background()
+	p = types.CleanPath(p)
+	versions, err := types.GetFileVersions(vs.db, uid, &p)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, v := range versions {
+		found = found || v.VersionId == versionId
+	}
+	if !found {
+		return ErrNoSuchVersion
+	}
+	maxVersions, err := types.FindVersionedDir(vs.db, uid, p)
+	if err != nil {
+		return err
+	}
+	dst := homePath(owner, p)
+	if f, err := vs.root.Stat(ctx, dst); err == nil && !f.IsDir() {
+		err = vs.saveFile(owner, uid, p, f.Size())
+		if err != nil {
+			return err
+		}
+	}
+	err = mkdirAll(ctx, vs.root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	err = vs.root.Rename(ctx, versionPath(owner, p, versionId), dst)
+	if err != nil {
+		return err
+	}
+	err = types.DeleteFileVersion(vs.db, uid, p, versionId)
+	if err != nil {
+		return err
+	}
+	// the checksum of the replaced content is stale, the restored one has none
+	err = types.DeleteChecksums(vs.db, uid, p)
+	if err != nil {
+		return err
+	}
+	return vs.prune(owner, uid, p, maxVersions)
+}
+
+// versionsFS is the readonly tree under /.versions, in which each versioned file appears
+// as a directory containing its versions, named by their version ids
+type versionsFS struct {
+	db       *badger.DB
+	root     webdav.FileSystem
+	prices   config.PriceTable
+	key      *userKey // nil if the files are not encrypted
+	readers  payers
+	throttle *throttle
+	dirs     map[string][]os.FileInfo
+	versions map[string]string // from the path in the tree to the path in the backend
+}
+
+var _ webdav.FileSystem = (*versionsFS)(nil)
+
+func (vs *VersionStore) newVersionsFS(owner common.Address, uid int64, prices config.PriceTable,
+	key *userKey) (*versionsFS, error) {
+	versions, err := vs.List(uid, "")
+	if err != nil {
+		return nil, err
+	}
+	vfs := &versionsFS{
+		db:       vs.db,
+		root:     vs.root,
+		prices:   prices,
+		key:      key,
+		readers:  payers{uid},
+		dirs:     map[string][]os.FileInfo{"/": nil},
+		versions: make(map[string]string),
+	}
+	for _, v := range versions {
+		name := path.Join("/", v.Path, strconv.FormatInt(v.VersionId, 10))
+		vfs.versions[name] = versionPath(owner, v.Path, v.VersionId)
+		vfs.addEntry(name, &virtualFileInfo{
+			name:    path.Base(name),
+			size:    v.Size,
+			modTime: time.Unix(0, v.VersionId),
+		})
+	}
+	return vfs, nil
+}
+
+// addEntry adds the entry at name into its parent, creating the missing ancestors
+func (vfs *versionsFS) addEntry(name string, info *virtualFileInfo) {
+	for name != "/" {
+		parent := path.Dir(name)
+		_, exists := vfs.dirs[parent]
+		vfs.dirs[parent] = append(vfs.dirs[parent], info)
+		if exists {
+			return
+		}
+		name = parent
+		info = &virtualFileInfo{name: path.Base(name), isDir: true}
+	}
+}
+
+func (vfs *versionsFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return types.ErrReadOnly
+}
+
+func (vfs *versionsFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC|os.O_CREATE) != 0 {
+		return nil, types.ErrReadOnly
+	}
+	name = path.Clean("/" + name)
+	if versionPath, ok := vfs.versions[name]; ok {
+		f, err := vfs.open(versionPath)
+		if err != nil {
+			return nil, err
+		}
+		wf := &WatchedFile{File: f, db: vfs.db, prices: vfs.prices, name: name, readers: vfs.readers,
+			writerUid: vfs.readers[0], opener: vfs.readers, perm: types.PermRead, ctx: ctx, throttle: vfs.throttle}
+		if !responseMetered(ctx) {
+			wf.reads = newByteMeter(vfs.db, vfs.prices, vfs.readers, config.OpRead, fmt.Sprintf("Read '%s'", name))
+		}
+		return wf, nil
+	}
+	entries, ok := vfs.dirs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	info := &virtualFileInfo{name: path.Base(name), isDir: true}
+	return &virtualDir{info: info, entries: entries}, nil
+}
+
+// open opens the content of a version, decrypting it if needed
+func (vfs *versionsFS) open(versionPath string) (webdav.File, error) {
+	f, err := vfs.root.OpenFile(context.Background(), versionPath, os.O_RDONLY, 0)
+	if err != nil || vfs.key == nil {
+		return f, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cf, err := newCryptFile(f, vfs.key, fi, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (vfs *versionsFS) RemoveAll(ctx context.Context, name string) error {
+	return types.ErrReadOnly
+}
+
+func (vfs *versionsFS) Rename(ctx context.Context, oldName, newName string) error {
+	return types.ErrReadOnly
+}
+
+func (vfs *versionsFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	if versionPath, ok := vfs.versions[name]; ok {
+		f, err := vfs.open(versionPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.Stat()
+	}
+	if _, ok := vfs.dirs[name]; ok {
+		return &virtualFileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+type virtualFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *virtualFileInfo) Name() string       { return fi.name }
+func (fi *virtualFileInfo) Size() int64        { return fi.size }
+func (fi *virtualFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *virtualFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *virtualFileInfo) Sys() any           { return nil }
+
+func (fi *virtualFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// virtualDir is an opened directory of versionsFS
+type virtualDir struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	read    bool
+}
+
+var _ webdav.File = (*virtualDir)(nil)
+
+func (d *virtualDir) Close() error { return nil }
+
+func (d *virtualDir) Read(p []byte) (int, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (d *virtualDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, fs.ErrInvalid
+}
+
+func (d *virtualDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.read && count > 0 {
+		return nil, io.EOF
+	}
+	d.read = true
+	return d.entries, nil
+}
+
+func (d *virtualDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *virtualDir) Write(p []byte) (int, error) {
+	return 0, types.ErrReadOnly
+}